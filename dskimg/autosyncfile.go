@@ -45,3 +45,20 @@ func (s *SyncFile) WriteAt(b []byte, off int64) (n int, err error) {
 	return
 }
 
+
+/*
+ Synchronizes every WriteAt(...) on a Device. Files are synchronized using
+ FileRangeSync, other devices using Sync().
+ */
+func NewSyncDevice(d Device) IoReaderWriterAt {
+	if f,ok := d.(*FileDevice); ok { return &SyncFile{f.File} }
+	return &syncDevice{d}
+}
+type syncDevice struct{
+	Device
+}
+func (s *syncDevice) WriteAt(b []byte, off int64) (n int, err error) {
+	n,err = s.Device.WriteAt(b,off)
+	if err==nil { err = s.Device.Sync() }
+	return
+}
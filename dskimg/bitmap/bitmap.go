@@ -80,7 +80,7 @@ type BitRegion struct{
 }
 func (r *BitRegion) Apply(buf []byte,begin, end uint64,rf RangeFunc,write bool) (uint64,error) {
 	p := int64(begin>>3)
-	n := int64((end+7)>>3)+1
+	n := int64((end+7)>>3)
 	pn := n-p
 	off := uint64(p)<<3
 	if int64(len(buf))>pn {
@@ -93,7 +93,7 @@ func (r *BitRegion) Apply(buf []byte,begin, end uint64,rf RangeFunc,write bool)
 	n2,e := r.Image.ReadAt(buf,p)
 	if n2>=len(buf) { e = nil }
 	if e!=nil { return begin,e }
-	if int64(n2)<n { buf = buf[:n2] }
+	if int64(n2)<n-p { buf = buf[:n2] }
 	res := rf(buf,begin-off,end-off)
 	if write {
 		n2,e := r.Image.WriteAt(buf,p)
@@ -0,0 +1,268 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package dskimg
+
+import "io"
+import "sync"
+import "github.com/hashicorp/golang-lru"
+
+type BlockCacheStats struct{
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	WriteBacks uint64
+}
+
+type cacheBlock struct{
+	data  []byte
+	valid int  /* Number of valid bytes (short, at the end of the device). */
+	dirty bool
+}
+
+/*
+ A bounded block cache, that sits on top of an IoReaderWriterAt.
+
+ In write-through mode (default), every WriteAt(...) is passed to the backing
+ device immediately and the cached copy is updated. In write-back mode, writes
+ only modify the cached block, which is marked dirty and written back on
+ eviction or on Flush(). If the write-back on eviction fails, the block is
+ kept as dirty block and served from there, until a write-back succeeds; the
+ error is returned by the next Flush().
+ */
+type BlockCache struct{
+	Backing   IoReaderWriterAt
+	BlockSize int
+	WriteBack bool
+	
+	mutex     sync.Mutex
+	blocks    *lru.Cache
+	dirty     map[int64]*cacheBlock
+	stats     BlockCacheStats
+	err       error /* First error of a write-back on eviction. */
+}
+
+func NewBlockCache(rwa IoReaderWriterAt, blockSize, numBlocks int, writeBack bool) (*BlockCache,error) {
+	c := new(BlockCache)
+	c.Backing   = rwa
+	c.BlockSize = blockSize
+	c.WriteBack = writeBack
+	c.dirty     = make(map[int64]*cacheBlock)
+	var e error
+	c.blocks,e = lru.NewWithEvict(numBlocks,c.evict)
+	if e!=nil { return nil,e }
+	return c,nil
+}
+
+/* Called by the LRU with c.mutex held. */
+func (c *BlockCache) evict(key interface{},value interface{}) {
+	i := key.(int64)
+	b := value.(*cacheBlock)
+	c.stats.Evictions++
+	if !b.dirty { return }
+	e := c.writeBlock(i,b)
+	if e!=nil && c.err==nil { c.err = e }
+}
+func (c *BlockCache) writeBlock(i int64, b *cacheBlock) error {
+	n,e := c.Backing.WriteAt(b.data[:b.valid],i*int64(c.BlockSize))
+	if n>=b.valid { e = nil }
+	if e!=nil { return e }
+	b.dirty = false
+	delete(c.dirty,i)
+	c.stats.WriteBacks++
+	return nil
+}
+func (c *BlockCache) getBlock(i int64) (*cacheBlock,error) {
+	if raw,ok := c.blocks.Get(i); ok {
+		c.stats.Hits++
+		return raw.(*cacheBlock),nil
+	}
+	/* A block, whose write-back on eviction failed, is newer than the device. */
+	if b,ok := c.dirty[i]; ok {
+		c.stats.Hits++
+		c.blocks.Add(i,b)
+		return b,nil
+	}
+	c.stats.Misses++
+	b := &cacheBlock{data:make([]byte,c.BlockSize)}
+	n,e := c.Backing.ReadAt(b.data,i*int64(c.BlockSize))
+	if n>=len(b.data) { e = nil }
+	if e==io.EOF { e = nil }
+	if e!=nil { return nil,e }
+	b.valid = n
+	c.blocks.Add(i,b)
+	return b,nil
+}
+
+func (c *BlockCache) ReadAt(p []byte, off int64) (n int, err error) {
+	if off<0 { return 0,io.EOF }
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	bz := int64(c.BlockSize)
+	for n<len(p) {
+		pos := off+int64(n)
+		b,e := c.getBlock(pos/bz)
+		if e!=nil { return n,e }
+		bo := int(pos%bz)
+		if bo>=b.valid { return n,io.EOF }
+		n += copy(p[n:],b.data[bo:b.valid])
+	}
+	return n,nil
+}
+
+func (c *BlockCache) WriteAt(p []byte, off int64) (n int, err error) {
+	if off<0 { return 0,io.EOF }
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	bz := int64(c.BlockSize)
+	if !c.WriteBack {
+		n,err = c.Backing.WriteAt(p,off)
+		/* Update the blocks we already have. */
+		for i := off/bz; i*bz < off+int64(n); i++ {
+			raw,ok := c.blocks.Peek(i)
+			if !ok { continue }
+			c.update(raw.(*cacheBlock),i,p[:n],off)
+		}
+		return
+	}
+	for n<len(p) {
+		pos := off+int64(n)
+		i := pos/bz
+		b,e := c.getBlock(i)
+		if e!=nil { return n,e }
+		n += c.update(b,i,p[n:],pos)
+		if !b.dirty {
+			b.dirty = true
+			c.dirty[i] = b
+		}
+	}
+	return n,nil
+}
+func (c *BlockCache) update(b *cacheBlock, i int64, p []byte, off int64) int {
+	bz := int64(c.BlockSize)
+	base := i*bz
+	/* Clip p to the block. */
+	if off<base {
+		p = p[base-off:]
+		off = base
+	}
+	bo := int(off-base)
+	n := copy(b.data[bo:],p)
+	if b.valid<bo+n {
+		/* Zero the hole between the old end and the write position. */
+		for j := b.valid; j<bo; j++ { b.data[j] = 0 }
+		b.valid = bo+n
+	}
+	return n
+}
+
+// Writes all dirty blocks back to the backing device.
+func (c *BlockCache) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := c.err
+	c.err = nil
+	for i,b := range c.dirty {
+		e := c.writeBlock(i,b)
+		if e!=nil && err==nil { err = e }
+	}
+	return err
+}
+
+// Flushes the cache and drops all cached blocks.
+func (c *BlockCache) Invalidate() error {
+	err := c.Flush()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.blocks.Purge()
+	if err==nil { err = c.err }
+	c.err = nil
+	return err
+}
+
+// Writes the dirty blocks overlapping [off,off+n) back to the backing device.
+func (c *BlockCache) WriteBackRange(off, n int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	bz := int64(c.BlockSize)
+	if len(c.dirty)==0 || n<=0 { return nil }
+	for i := off/bz; i*bz < off+n; i++ {
+		b,ok := c.dirty[i]
+		if !ok { continue }
+		e := c.writeBlock(i,b)
+		if e!=nil { return e }
+	}
+	return nil
+}
+
+/*
+ Drops the cached blocks overlapping [off,off+n), without writing them back.
+ Must be called, when the range is written to the backing device directly or
+ when it is freed and may be reused for data that bypasses the cache.
+ */
+func (c *BlockCache) Discard(off, n int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	bz := int64(c.BlockSize)
+	if n<=0 { return }
+	first,last := off/bz,(off+n-1)/bz
+	drop := func(i int64) {
+		delete(c.dirty,i)
+		if raw,ok := c.blocks.Peek(i); ok {
+			/* Keep evict() from writing it back. */
+			raw.(*cacheBlock).dirty = false
+			c.blocks.Remove(i)
+		}
+	}
+	if last-first >= int64(c.blocks.Len()) {
+		/* Large range, walk the cache instead. */
+		for _,k := range c.blocks.Keys() {
+			i := k.(int64)
+			if first<=i && i<=last { drop(i) }
+		}
+		for i := range c.dirty {
+			if first<=i && i<=last { delete(c.dirty,i) }
+		}
+		return
+	}
+	for i := first; i<=last; i++ { drop(i) }
+}
+
+// Returns the number of dirty blocks.
+func (c *BlockCache) Dirty() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.dirty)
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+func (c *BlockCache) ResetStats() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats = BlockCacheStats{}
+}
@@ -0,0 +1,96 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package dskimg
+
+import "testing"
+import "bytes"
+import "errors"
+
+var eTestWrite = errors.New("write failed")
+
+/* A MemDevice, whose writes can be made to fail. */
+type failingDevice struct{
+	*MemDevice
+	fail bool
+}
+func (f *failingDevice) WriteAt(p []byte, off int64) (int,error) {
+	if f.fail { return 0,eTestWrite }
+	return f.MemDevice.WriteAt(p,off)
+}
+
+func readBlock(t *testing.T, r IoReaderWriterAt, i int64) []byte {
+	buf := make([]byte,512)
+	if _,e := r.ReadAt(buf,i*512); e!=nil { t.Fatal(e) }
+	return buf
+}
+func fill(b byte) []byte { return bytes.Repeat([]byte{b},512) }
+
+func TestBlockCacheWriteThrough(t *testing.T) {
+	dev := NewMemDevice(16*512)
+	c,e := NewBlockCache(dev,512,4,false)
+	if e!=nil { t.Fatal(e) }
+	readBlock(t,c,1)
+	if _,e := c.WriteAt(fill(1),512); e!=nil { t.Fatal(e) }
+	if !bytes.Equal(readBlock(t,dev,1),fill(1)) { t.Error("not written through") }
+	if !bytes.Equal(readBlock(t,c,1),fill(1)) { t.Error("cached copy not updated") }
+	if c.Dirty()!=0 { t.Error("dirty blocks in write-through mode") }
+}
+
+func TestBlockCacheWriteBack(t *testing.T) {
+	dev := NewMemDevice(16*512)
+	c,_ := NewBlockCache(dev,512,4,true)
+	c.WriteAt(fill(1),0)
+	c.WriteAt(fill(2),512)
+	if !bytes.Equal(readBlock(t,dev,0),fill(0)) { t.Error("written before Flush") }
+	if e := c.WriteBackRange(512,512); e!=nil { t.Fatal(e) }
+	if !bytes.Equal(readBlock(t,dev,1),fill(2)) || c.Dirty()!=1 { t.Error("WriteBackRange") }
+	if e := c.Flush(); e!=nil { t.Fatal(e) }
+	if !bytes.Equal(readBlock(t,dev,0),fill(1)) || c.Dirty()!=0 { t.Error("Flush") }
+	
+	/* Discarded blocks are neither written back nor served. */
+	c.WriteAt(fill(3),0)
+	dev.WriteAt(fill(4),0)
+	c.Discard(0,512)
+	c.Flush()
+	if !bytes.Equal(readBlock(t,c,0),fill(4)) { t.Error("Discard") }
+}
+
+func TestBlockCacheEvictionFailure(t *testing.T) {
+	dev := &failingDevice{MemDevice:NewMemDevice(16*512)}
+	c,_ := NewBlockCache(dev,512,2,true)
+	c.WriteAt(fill(1),0)
+	dev.fail = true
+	/* Evict block 0; its write-back fails. */
+	readBlock(t,c,1)
+	readBlock(t,c,2)
+	if !bytes.Equal(readBlock(t,c,0),fill(1)) { t.Fatal("evicted block read from the device") }
+	c.WriteAt(fill(5),0)
+	readBlock(t,c,3)
+	readBlock(t,c,4)
+	if e := c.Flush(); e!=eTestWrite { t.Fatal("expected the write-back error, got ",e) }
+	dev.fail = false
+	if e := c.Flush(); e!=nil { t.Fatal(e) }
+	if !bytes.Equal(readBlock(t,dev,0),fill(5)) { t.Fatal("newer write lost") }
+}
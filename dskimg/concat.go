@@ -0,0 +1,154 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package dskimg
+
+import "io"
+import "os"
+
+/*
+ A Device, that concatenates several devices into one address space. It is
+ used to build volumes spanning a fast and a slow device.
+ */
+type Concat struct{
+	parts []Device
+	bases []int64 /* Offset of each part; bases[len(parts)] is the total size. */
+}
+func NewConcat(parts ...Device) (*Concat,error) {
+	c := &Concat{parts:parts,bases:make([]int64,len(parts)+1)}
+	for i,d := range parts {
+		s,e := d.Size()
+		if e!=nil { return nil,e }
+		c.bases[i+1] = c.bases[i]+s
+	}
+	return c,nil
+}
+/* Returns the i-th part and the offset, at which it starts. */
+func (c *Concat) Part(i int) (Device,int64) {
+	return c.parts[i],c.bases[i]
+}
+func (c *Concat) Parts() int { return len(c.parts) }
+
+/* Calls fn for each part overlapping [off,off+n), with offsets relative to the part. */
+func (c *Concat) split(off, n int64, fn func(d Device, off int64, from, to int64) error) error {
+	for i,d := range c.parts {
+		b,e := c.bases[i],c.bases[i+1]
+		if off+n<=b { break }
+		if off>=e { continue }
+		from := off
+		if from<b { from = b }
+		to := off+n
+		if to>e { to = e }
+		err := fn(d,from-b,from-off,to-off)
+		if err!=nil { return err }
+	}
+	return nil
+}
+func (c *Concat) clip(p []byte, off int64) ([]byte,error) {
+	size := c.bases[len(c.parts)]
+	if off<0 || off>=size { return nil,io.EOF }
+	if max := size-off; max<int64(len(p)) { return p[:int(max)],io.EOF }
+	return p,nil
+}
+func (c *Concat) ReadAt(p []byte, off int64) (n int, err error) {
+	p,err = c.clip(p,off)
+	if len(p)==0 { return 0,err }
+	e := c.split(off,int64(len(p)),func(d Device, doff int64, from, to int64) error {
+		k,e := d.ReadAt(p[from:to],doff)
+		n += k
+		if k==int(to-from) { return nil }
+		if e==nil { e = io.ErrUnexpectedEOF }
+		return e
+	})
+	if e!=nil { return n,e }
+	return
+}
+func (c *Concat) WriteAt(p []byte, off int64) (n int, err error) {
+	p,err = c.clip(p,off)
+	if len(p)==0 { return 0,err }
+	e := c.split(off,int64(len(p)),func(d Device, doff int64, from, to int64) error {
+		k,e := d.WriteAt(p[from:to],doff)
+		n += k
+		if k==int(to-from) { return nil }
+		if e==nil { e = io.ErrShortWrite }
+		return e
+	})
+	if e!=nil { return n,e }
+	return
+}
+func (c *Concat) Size() (int64,error) { return c.bases[len(c.parts)],nil }
+func (c *Concat) Sync() error {
+	var err error
+	for _,d := range c.parts {
+		e := d.Sync()
+		if err==nil { err = e }
+	}
+	return err
+}
+func (c *Concat) Discard(off, n int64) error {
+	return c.split(off,n,func(d Device, doff int64, from, to int64) error {
+		e := Discard(d,doff,to-from)
+		if e==ENotSupported { e = nil }
+		return e
+	})
+}
+/* Closes all parts, that can be closed. */
+func (c *Concat) Close() error {
+	var err error
+	for _,d := range c.parts {
+		cl,ok := d.(io.Closer)
+		if !ok { continue }
+		e := cl.Close()
+		if err==nil { err = e }
+	}
+	return err
+}
+
+/* A Device, that owns the files it is built on. */
+type DeviceCloser interface{
+	Device
+	io.Closer
+}
+
+/*
+ Opens an image. If slow is not empty, it is opened too and appended to the
+ image as its slow tier.
+ */
+func OpenImage(name, slow string, flag int) (DeviceCloser,error) {
+	f,e := os.OpenFile(name,flag,0666)
+	if e!=nil { return nil,e }
+	if slow=="" { return &FileDevice{f},nil }
+	s,e := os.OpenFile(slow,flag,0666)
+	if e!=nil {
+		f.Close()
+		return nil,e
+	}
+	c,e := NewConcat(&FileDevice{f},&FileDevice{s})
+	if e!=nil {
+		f.Close()
+		s.Close()
+		return nil,e
+	}
+	return c,nil
+}
@@ -0,0 +1,167 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package dskimg
+
+import "os"
+import "io"
+import "sync"
+import "errors"
+
+var ENotSupported = errors.New("Operation not supported by the device")
+
+/*
+ A Device is the storage, a filesystem image lives on. It may be a file, a
+ partition of another device, a buffer in memory or a custom backend.
+ */
+type Device interface{
+	IoReaderWriterAt
+	Size() (int64,error)
+	Sync() error
+}
+
+/*
+ Implemented by devices backed by a file descriptor. Fd() must refer to the
+ same offsets as ReadAt and WriteAt.
+ */
+type FdDevice interface{
+	Device
+	Fd() uintptr
+}
+
+/* Implemented by devices, that can release storage (TRIM, hole punching). */
+type Discarder interface{
+	Discard(off, n int64) error
+}
+
+/* Returns the file descriptor of the device, if it has one. */
+func DeviceFd(d Device) (uintptr,bool) {
+	fd,ok := d.(FdDevice)
+	if !ok { return 0,false }
+	return fd.Fd(),true
+}
+/* Discards the given range, if the device supports it. */
+func Discard(d Device, off, n int64) error {
+	dd,ok := d.(Discarder)
+	if !ok { return ENotSupported }
+	return dd.Discard(off,n)
+}
+
+type FileDiscarder func(file *os.File, off, n int64) (err error)
+/* Releases a range of a file. nil, if the platform has no support for it. */
+var FileDiscard FileDiscarder
+
+/* A Device on top of a file or a block special file. */
+type FileDevice struct{
+	*os.File
+}
+func (f *FileDevice) Size() (int64,error) {
+	fi,e := f.File.Stat()
+	if e!=nil { return 0,e }
+	if fi.Mode().IsRegular() { return fi.Size(),nil }
+	/* Block devices report a size of 0. */
+	return f.File.Seek(0,io.SeekEnd)
+}
+func (f *FileDevice) Discard(off, n int64) error {
+	if FileDiscard==nil { return ENotSupported }
+	return FileDiscard(f.File,off,n)
+}
+
+/* A Device on a section of another device. */
+type Partition struct{
+	*SectionIo
+	dev Device
+}
+func NewPartition(dev Device, base, length int64) *Partition {
+	return &Partition{NewSectionIo(dev,base,length),dev}
+}
+func (p *Partition) Size() (int64,error) { return p.SectionIo.Size(),nil }
+func (p *Partition) Sync() error { return p.dev.Sync() }
+func (p *Partition) Discard(off, n int64) error {
+	if off<0 || off>=p.lngt { return io.EOF }
+	if max := p.lngt-off; max<n { n = max }
+	return Discard(p.dev,off+p.base,n)
+}
+
+/* A Device in memory. It is safe for concurrent use. */
+type MemDevice struct{
+	mutex sync.RWMutex
+	buf   []byte
+}
+func NewMemDevice(size int64) *MemDevice {
+	return &MemDevice{buf:make([]byte,int(size))}
+}
+func (m *MemDevice) ReadAt(p []byte, off int64) (n int, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if off<0 || off>=int64(len(m.buf)) { return 0,io.EOF }
+	n = copy(p,m.buf[off:])
+	if n<len(p) { err = io.EOF }
+	return
+}
+func (m *MemDevice) WriteAt(p []byte, off int64) (n int, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if off<0 || off>=int64(len(m.buf)) { return 0,io.EOF }
+	n = copy(m.buf[off:],p)
+	if n<len(p) { err = io.EOF }
+	return
+}
+func (m *MemDevice) Size() (int64,error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return int64(len(m.buf)),nil
+}
+func (m *MemDevice) Sync() error { return nil }
+func (m *MemDevice) Discard(off, n int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if off<0 || off>=int64(len(m.buf)) { return io.EOF }
+	if max := int64(len(m.buf))-off; max<n { n = max }
+	z := m.buf[off:off+n]
+	for i := range z { z[i] = 0 }
+	return nil
+}
+
+/*
+ Takes an advisory lock on the device (see FileLock). Devices, that are not
+ backed by a file, are not locked.
+ */
+func LockDevice(d Device, exclusive bool) error {
+	switch v := d.(type) {
+	case *FileDevice: return FileLock(v.File,exclusive)
+	case *Partition: return LockDevice(v.dev,exclusive)
+	case *Concat:
+		for _,d := range v.parts {
+			e := LockDevice(d,exclusive)
+			if e!=nil { return e }
+		}
+	case *Mirror:
+		for _,d := range v.Devices() {
+			e := LockDevice(d,exclusive)
+			if e!=nil { return e }
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package dskimg
+
+import "os"
+import "errors"
+
+var ELocked = errors.New("Image is locked by another process")
+
+func std_file_locker (file *os.File, exclusive bool) (err error) {
+	return nil
+}
+
+/*
+ Takes an advisory lock on the file, that is held until the file is closed.
+ An exclusive lock conflicts with any other lock, a shared lock only with an
+ exclusive one. If the lock is held by someone else, ELocked is returned.
+ The default implementation does nothing; platform plugins replace it.
+ */
+type FileLocker func(file *os.File, exclusive bool) (err error)
+var FileLock FileLocker = std_file_locker
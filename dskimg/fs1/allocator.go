@@ -25,13 +25,52 @@
 
 package fs1
 
+import "github.com/maxymania/anyfs/dskimg"
 import "github.com/maxymania/anyfs/dskimg/ods"
 import "github.com/maxymania/anyfs/dskimg/bitmap"
 import "github.com/maxymania/anyfs/debug"
 import "errors"
+import "sync"
 
 var badalloc = errors.New("No Allocation possible")
 
+/*
+ The bitmap is split into allocation groups of allocGroup blocks, each one
+ guarded by its own lock. Files growing in parallel allocate from different
+ groups. Runs spanning several groups are found by a scan, that holds all
+ group locks. Group locks are always taken in ascending order.
+ */
+const allocGroup = 1<<12
+
+type allocGroups struct{
+	once  sync.Once
+	locks []sync.Mutex
+}
+func (f *FileSystem) groups() []sync.Mutex {
+	f.allocGroups.once.Do(func(){
+		n := (f.SB.Block_Len+allocGroup-1)/allocGroup
+		if n==0 { n = 1 }
+		f.allocGroups.locks = make([]sync.Mutex,int(n))
+	})
+	return f.allocGroups.locks
+}
+/* Locks all groups overlapping [begin,end) and returns the unlock function. */
+func (f *FileSystem) lockRange(begin, end uint64) func() {
+	g := f.groups()
+	lg := uint64(len(g))
+	b := begin/allocGroup
+	n := (end+allocGroup-1)/allocGroup
+	if n>lg { n = lg }
+	if b>=n { return func(){} }
+	for i:=b; i<n; i++ { g[i].Lock() }
+	return func(){ for i:=b; i<n; i++ { g[i].Unlock() } }
+}
+/* The group, in which a file starts to search for free blocks. */
+func allocHint(mfte *ods.MFTE) uint64 {
+	if mfte.Begin_BLK!=0 && mfte.End_BLK>mfte.Begin_BLK { return mfte.End_BLK }
+	return uint64(mfte.First_IDX)*allocGroup
+}
+
 
 type AllocRange struct{
 	Begin,End uint64
@@ -41,25 +80,33 @@ type fs_job struct{
 	from,to,clear,free AllocRange
 }
 func (f *FileSystem) FreeMFTE(mfte *ods.MFTE) error {
+	if f.ReadOnly { return EReadOnly }
 	blank := new(ods.MFTE)
 	e := f.MMFT.PutEntryLL(mfte.File_MFT,mfte.File_IDX,blank)
 	if e!=nil { return e }
-	_,e = f.FreeRangeSync(mfte.Begin_BLK,mfte.End_BLK)
+	_,e = f.FreeRange(mfte.Begin_BLK,mfte.End_BLK)
 	return e
 }
 func (f *FileSystem) ClearMFTE(mfte *ods.MFTE) error {
+	if f.ReadOnly { return EReadOnly }
 	beg,end := mfte.Begin_BLK,mfte.End_BLK
 	mfte.Begin_BLK = 0
 	mfte.End_BLK = 0
 	e := f.MMFT.PutEntry(mfte)
 	if e!=nil { return e }
-	_,e = f.FreeRangeSync(beg,end)
+	_,e = f.FreeRange(beg,end)
 	return e
 }
 func (f *FileSystem) dojob(job* fs_job) {
 	status := false
 	buf := []byte{}
 	i,n,j,m := job.from.Begin,job.from.End,job.to.Begin,job.to.End
+	/* The blocks are copied on the Device, bypassing the block cache. */
+	if f.Cache!=nil && i<n {
+		f.Cache.WriteBackRange(f.SB.Offset(i),f.SB.Length(n-i))
+	}
+	f.discardCache(j,m)
+	f.discardCache(job.clear.Begin,job.clear.End)
 	for i<n && j<m {
 		if !status { buf = make([]byte,f.SB.BlockSize); status = true }
 		f.Device.ReadAt(buf,f.SB.Offset(i))
@@ -75,18 +122,71 @@ func (f *FileSystem) dojob(job* fs_job) {
 	}
 	i,n = job.free.Begin,job.free.End
 	if i<n {
-		f.BMLck.Lock()
-		defer f.BMLck.Unlock()
 		f.FreeRange(i,n)
 		//f.BitMap.Apply(buf,i,n,bitmap.FreeRange,true)
 	}
 }
+/* Copies the blocks of 'from' to 'to' on the Device, bypassing the block cache. */
+func (f *FileSystem) copyBlocks(from, to AllocRange) error {
+	if f.Cache!=nil && from.Begin<from.End {
+		e := f.Cache.WriteBackRange(f.SB.Offset(from.Begin),f.SB.Length(from.End-from.Begin))
+		if e!=nil { return e }
+	}
+	f.discardCache(to.Begin,to.End)
+	const chunk = 64
+	buf := make([]byte,f.SB.Length(chunk))
+	i,j := from.Begin,to.Begin
+	for i<from.End && j<to.End {
+		n := uint64(chunk)
+		if from.End-i<n { n = from.End-i }
+		if to.End-j<n { n = to.End-j }
+		p := buf[:f.SB.Length(n)]
+		k,e := f.Device.ReadAt(p,f.SB.Offset(i))
+		if k<len(p) {
+			if e==nil { e = EIO }
+			return e
+		}
+		k,e = f.Device.WriteAt(p,f.SB.Offset(j))
+		if k<len(p) {
+			if e==nil { e = EIO }
+			return e
+		}
+		i += n
+		j += n
+	}
+	return nil
+}
+/*
+ Grows the MFT entry to nblocks blocks, appending new entries to the chain if
+ needed. The growth is charged against the quotas of the file's owners.
+ */
 func (f *FileSystem) GrowMFTE(mfte *ods.MFTE, nblocks uint64) (error,bool) {
+	if f.ReadOnly { return EReadOnly,false }
+	have := uint64(0)
+	if mfte.Begin_BLK!=0 && mfte.End_BLK>mfte.Begin_BLK { have = mfte.End_BLK-mfte.Begin_BLK }
+	if nblocks<=have { return f.growMFTE_Chain(mfte,nblocks) }
+	sids := f.quotaSubjects(mfte.File_MFT,mfte.First_IDX)
+	if sids==nil { return f.growMFTE_Chain(mfte,nblocks) }
+	
+	need := int64(nblocks-have)
+	e := f.Quota.charge(sids,need,0,true)
+	if e!=nil { return e,false }
+	before := f.chainBlocks(mfte.File_MFT,mfte.First_IDX)
+	e,dirty := f.growMFTE_Chain(mfte,nblocks)
+	if e!=nil {
+		/* Only charge, what has actually been allocated. */
+		grown := int64(f.chainBlocks(mfte.File_MFT,mfte.First_IDX))-int64(before)
+		if grown<need { f.Quota.charge(sids,grown-need,0,false) }
+	}
+	return e,dirty
+}
+func (f *FileSystem) growMFTE_Chain(mfte *ods.MFTE, nblocks uint64) (error,bool) {
+	tr := f.placement(mfte.File_MFT,mfte.First_IDX)
 	j := new(fs_job)
 	debug.Println("GrowMFTE(",nblocks,") {")
 	defer debug.Println("}GrowMFTE")
 	debug.Println(" f.growMFTE...")
-	e,more := f.growMFTE(mfte,nblocks,j)
+	e,more := f.growMFTE(mfte,nblocks,j,tr)
 	debug.Println(" f.growMFTE(",nblocks,j,") -> ",e,more)
 	f.dojob(j)
 	dirty := false
@@ -101,7 +201,7 @@ func (f *FileSystem) GrowMFTE(mfte *ods.MFTE, nblocks uint64) (error,bool) {
 		mfte = m2
 		*j = fs_job{}
 		debug.Println(" f.growMFTE...")
-		e,more = f.growMFTE(mfte,nblocks,j)
+		e,more = f.growMFTE(mfte,nblocks,j,tr)
 		debug.Println(" f.growMFTE(",nblocks,j,") -> ",e,more)
 		f.dojob(j)
 		if e!=nil { return e,dirty }
@@ -110,10 +210,12 @@ func (f *FileSystem) GrowMFTE(mfte *ods.MFTE, nblocks uint64) (error,bool) {
 }
 
 func (f *FileSystem) addMFTE(mfte *ods.MFTE) (*ods.MFTE,bool,error) {
-	f.MFTLck.Lock()
-	defer f.MFTLck.Unlock()
 	m2,e := f.MMFT.Allocate(mfte.File_MFT)
 	if e!=nil { return nil,false,e }
+	defer func() {
+		/* Give the entry back, unless it has been written. */
+		if e!=nil { f.MMFT.Unreserve(m2.File_MFT,m2.File_IDX) }
+	}()
 	m2.First_IDX  = mfte.File_IDX
 	mfte.Next_IDX = m2.File_IDX
 	e = f.MMFT.PutEntry(m2)
@@ -122,12 +224,11 @@ func (f *FileSystem) addMFTE(mfte *ods.MFTE) (*ods.MFTE,bool,error) {
 	if e!=nil { return nil,true,e }
 	return m2,true,nil
 }
-func (f *FileSystem) growMFTE(mfte *ods.MFTE, nblocks uint64, j* fs_job) (error,bool) {
-	f.BMLck.Lock()
-	defer f.BMLck.Unlock()
+func (f *FileSystem) growMFTE(mfte *ods.MFTE, nblocks uint64, j* fs_job, tr AllocRange) (error,bool) {
+	hint := allocHint(mfte)
 	if mfte.Begin_BLK==0 || mfte.Begin_BLK>=mfte.End_BLK {
 		debug.Println("  f.AllocateRange...")
-		ar,e := f.AllocateRange(nblocks)
+		ar,e := f.allocateRange(nblocks,hint,tr)
 		debug.Println("  f.AllocateRange(",nblocks,") -> ",ar,e)
 		// TODO: Handle badalloc
 		if e!=nil { return e,false }
@@ -139,7 +240,7 @@ func (f *FileSystem) growMFTE(mfte *ods.MFTE, nblocks uint64, j* fs_job) (error,
 	} else {
 		diff := mfte.End_BLK-mfte.Begin_BLK
 		if diff>=nblocks { return nil,false } /* Don't grow if not needed. */
-		ddiff := (nblocks-diff)
+		ddiff := f.clipTier(mfte.End_BLK,nblocks-diff)
 		debug.Println("  f.AllocAppend...")
 		ne,e := f.AllocAppend(mfte.End_BLK,ddiff)
 		debug.Println("  f.AllocAppend(",mfte.End_BLK,ddiff,") -> ",ne,e)
@@ -157,7 +258,7 @@ func (f *FileSystem) growMFTE(mfte *ods.MFTE, nblocks uint64, j* fs_job) (error,
 		dndiff := (nblocks-ndiff)
 		minimum := ndiff+(dndiff/2)
 		debug.Println("  f.AllocateBiggest...")
-		ar,e := f.AllocateBiggest(nblocks,minimum)
+		ar,e := f.allocateBiggest(nblocks,minimum,hint,tr)
 		debug.Println("  f.AllocateBiggest(",nblocks,minimum,") -> ",ar,e)
 		//fmt.Println("Biggest: ",ar)
 		if e==badalloc {
@@ -197,11 +298,11 @@ func (f *FileSystem) AllocAppend(pos, n uint64) (uint64,error) {
 	if pos>posn { return 0,badalloc }
 	if pos==posn { return pos,nil }
 	
+	defer f.lockRange(pos,posn)()
 	return f.BitMap.Apply(buf,pos,posn,bitmap.AllocRange,true)
 }
+/* Same as FreeRange. */
 func (f *FileSystem) FreeRangeSync(pos, end uint64) (uint64,error) {
-	f.BMLck.Lock()
-	defer f.BMLck.Unlock()
 	return f.FreeRange(pos,end)
 }
 func (f *FileSystem) FreeRange(pos, end uint64) (uint64,error) {
@@ -211,6 +312,10 @@ func (f *FileSystem) FreeRange(pos, end uint64) (uint64,error) {
 	if bl>(1<<20) { bl = 1<<20 }
 	buf := make([]byte,int(bl))
 	
+	defer f.lockRange(pos,end)()
+	f.discardCache(pos,end)
+	/* Discard, while the blocks are still allocated. */
+	if f.Discard && pos<end { dskimg.Discard(f.Device,f.SB.Offset(pos),f.SB.Length(end-pos)) }
 	for {
 		np,e := f.BitMap.Apply(buf,pos,end,bitmap.FreeRange,true)
 		if e!=nil { return np,e }
@@ -220,16 +325,34 @@ func (f *FileSystem) FreeRange(pos, end uint64) (uint64,error) {
 	}
 	return pos,nil
 }
-func (f *FileSystem) AllocateRange(n uint64) (*AllocRange,error) {
-	bl := (n+7)>>3
-	bl += 2
-	if bl>(1<<20) { bl = 1<<20 }
-	buf := make([]byte,int(bl))
-	
-	pos := uint64(0)
-	end := f.SB.Block_Len
-	// min64(end,pos+n)
-	
+/*
+ Tries to allocate n blocks within a single group of the range tr, starting
+ with the group of the hint.
+ */
+func (f *FileSystem) allocateInGroup(buf []byte, n, hint uint64, tr AllocRange) (*AllocRange,error) {
+	lg := uint64(len(f.groups()))
+	if n>allocGroup { return nil,badalloc }
+	gl := tr.Begin/allocGroup
+	gh := (tr.End+allocGroup-1)/allocGroup
+	if gh>lg { gh = lg }
+	if gh<=gl { return nil,badalloc }
+	ng := gh-gl
+	g := hint/allocGroup
+	if g<gl || g>=gh { g = gl+g%ng }
+	for i:=uint64(0); i<ng; i++ {
+		gr := gl+(g-gl+i)%ng
+		begin := gr*allocGroup
+		end := begin+allocGroup
+		if begin<tr.Begin { begin = tr.Begin }
+		if end>tr.End { end = tr.End }
+		unlock := f.lockRange(begin,end)
+		ar,e := f.scanRange(buf,n,begin,end)
+		unlock()
+		if e!=badalloc { return ar,e }
+	}
+	return nil,badalloc
+}
+func (f *FileSystem) scanRange(buf []byte, n, pos, end uint64) (*AllocRange,error) {
 	for {
 		debug.Println("SkipAllocated(",pos,"...",end,") ...")
 		for {
@@ -241,6 +364,7 @@ func (f *FileSystem) AllocateRange(n uint64) (*AllocRange,error) {
 		debug.Println("SkipAllocated(...) -> ",pos,"...",end)
 		goal := pos+n
 		lp,e := f.BitMap.Apply(buf,pos,end,bitmap.ScanRange,false)
+		if e!=nil { return nil,e }
 		if goal<=lp {
 			_,e = f.BitMap.Apply(buf,pos,goal,bitmap.SetRange,true)
 			if e!=nil { return nil,e }
@@ -252,19 +376,52 @@ func (f *FileSystem) AllocateRange(n uint64) (*AllocRange,error) {
 	}
 	return nil,badalloc
 }
-func (f *FileSystem) AllocateBiggest(n, minimum uint64) (*AllocRange,error) {
+func allocBuffer(n uint64) []byte {
 	bl := (n+7)>>3
 	bl += 2
 	if bl>(1<<20) { bl = 1<<20 }
-	buf := make([]byte,int(bl))
-	
+	return make([]byte,int(bl))
+}
+func (f *FileSystem) allocateIn(buf []byte, n, hint uint64, tr AllocRange) (*AllocRange,error) {
+	ar,e := f.allocateInGroup(buf,n,hint,tr)
+	if e!=badalloc { return ar,e }
+	defer f.lockRange(tr.Begin,tr.End)()
+	return f.scanRange(buf,n,tr.Begin,tr.End)
+}
+/* Allocates n blocks within tr only. */
+func (f *FileSystem) allocateStrict(n, hint uint64, tr AllocRange) (*AllocRange,error) {
+	return f.allocateIn(allocBuffer(n),n,hint,tr)
+}
+func (f *FileSystem) AllocateRange(n uint64) (*AllocRange,error) {
+	return f.allocateRange(n,0,AllocRange{0,f.SB.Block_Len})
+}
+/* Allocates n blocks, preferably within tr. */
+func (f *FileSystem) allocateRange(n, hint uint64, tr AllocRange) (*AllocRange,error) {
+	buf := allocBuffer(n)
+	ar,e := f.allocateIn(buf,n,hint,tr)
+	if e!=badalloc || f.wholeRange(tr) { return ar,e }
+	return f.allocateIn(buf,n,hint,AllocRange{0,f.SB.Block_Len})
+}
+func (f *FileSystem) AllocateBiggest(n, minimum uint64) (*AllocRange,error) {
+	return f.allocateBiggest(n,minimum,0,AllocRange{0,f.SB.Block_Len})
+}
+/* Like allocateRange, but accepts the biggest free run of at least minimum blocks. */
+func (f *FileSystem) allocateBiggest(n, minimum, hint uint64, tr AllocRange) (*AllocRange,error) {
+	buf := allocBuffer(n)
+	ar,e := f.allocateInGroup(buf,n,hint,tr)
+	if e!=badalloc { return ar,e }
+	ar,e = f.biggest(buf,n,minimum,tr)
+	if e!=badalloc || f.wholeRange(tr) { return ar,e }
+	return f.biggest(buf,n,minimum,AllocRange{0,f.SB.Block_Len})
+}
+func (f *FileSystem) biggest(buf []byte, n, minimum uint64, tr AllocRange) (*AllocRange,error) {
 	aro := new(AllocRange)
 	arl := uint64(0)
 	
-	pos := uint64(0)
-	end := f.SB.Block_Len
-	// min64(end,pos+n)
+	pos := tr.Begin
+	end := tr.End
 	
+	defer f.lockRange(pos,end)()
 	for {
 		lp,e := f.BitMap.Apply(buf,pos,end,bitmap.ScanSetRange,false)
 		if e!=nil { return nil,e }
@@ -289,5 +446,3 @@ func (f *FileSystem) AllocateBiggest(n, minimum uint64) (*AllocRange,error) {
 	
 	return aro,err
 }
-
-
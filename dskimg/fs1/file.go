@@ -24,17 +24,18 @@
 
 package fs1
 
-import "os"
 import "io"
+import "github.com/maxymania/anyfs/dskimg"
 import "github.com/maxymania/anyfs/dskimg/ods"
 import "errors"
+import "time"
 
 var invalidfiles = errors.New("Bad MFT Entry Allocation")
 
 var EIO = errors.New("IO_ERROR")
 
 type FileRange struct{
-	Device *os.File
+	Device dskimg.Device
 	Pos    int64
 	Len    int64
 }
@@ -85,7 +86,7 @@ func WriteFileRanges(rr []*FileRange,p []byte) (n int,err error) {
 
 
 type FileBlockRange struct {
-	Device *os.File
+	Device dskimg.Device
 	Block  uint32
 	Begin  uint64
 	End    uint64
@@ -105,8 +106,9 @@ type File struct{
 }
 func (f *File) GetMFTE() (*ods.MFTE,error) {
 	mfte,e := f.FS.MMFT.GetEntry(f.MFT,f.FID)
+	if e!=nil { return nil,e }
 	if mfte.First_IDX!=f.FID { return nil,invalidfiles } /* Invalid file-head. */
-	return mfte,e
+	return mfte,nil
 }
 func (f *File) offset(begin, end, voff uint64, mfte *ods.MFTE, rp* FileBlockRange) uint64{
 	bb := mfte.Begin_BLK
@@ -129,6 +131,9 @@ func (f *File) Foffset(bblk,eblk uint64) ([]FileBlockRange,error){
 	rp := new(FileBlockRange)
 	rp.Device = f.FS.Device
 	rp.Block  = f.FS.SB.BlockSize
+	if head,e := f.FS.MMFT.GetEntry(f.MFT,f.FID); e==nil {
+		rp.Device = f.FS.deviceOf(head.FileType)
+	}
 	
 	for bblk<eblk {
 		mfte,e := f.FS.MMFT.GetEntry(f.MFT,bidx)
@@ -177,34 +182,41 @@ func (f *File) FrangesLL(pos,end int64) ([]*FileRange,error){
 
 // Purge file segments, that are not longer needed. (truncate)
 func (f *File) ShrinkDsk() error {
-	f.FS.MFTLck.Lock()
-	defer f.FS.MFTLck.Unlock()
+	if f.FS.ReadOnly { return EReadOnly }
+	sids := f.FS.quotaSubjects(f.MFT,f.FID)
+	freed,e := f.shrinkDsk()
+	if freed>0 { f.FS.Quota.charge(sids,-int64(freed),0,false) }
+	return e
+}
+func (f *File) shrinkDsk() (uint64,error) {
+	defer f.FS.lockFile(f.MFT,f.FID)()
 	mfte,e := f.GetMFTE()
-	if e!=nil { return e }
+	if e!=nil { return 0,e }
 	
 	bz := uint64(f.FS.SB.BlockSize)
 	blks := (uint64(mfte.FileSize)+bz-1)/bz
 	
 	gec,e := f.FS.MMFT.GetEntryChain(f.MFT,f.FID)
-	if e!=nil { return e }
+	if e!=nil { return 0,e }
 	
 	if gec.TotalBLK <= blks {
-		return nil
+		return 0,nil
 	}
+	freed := gec.TotalBLK-blks
 	i := len(gec.Indeces)-1
 	
 	for {
 		lb := gec.Off_BLK[i]
 		bmfte,e := f.FS.MMFT.GetEntry(f.MFT,gec.Indeces[i])
-		if e!=nil { return e }
+		if e!=nil { return 0,e }
 		if lb >= blks {
 			if i>0 {
 				i--
 				pmfte,e := f.FS.MMFT.GetEntry(f.MFT,gec.Indeces[i])
-				if e!=nil { return e }
+				if e!=nil { return 0,e }
 				pmfte.Next_IDX = 0
 				e = f.FS.MMFT.PutEntry(pmfte)
-				if e!=nil { return e }
+				if e!=nil { return 0,e }
 				f.FS.FreeMFTE(bmfte)
 				continue
 			}else{
@@ -220,22 +232,30 @@ func (f *File) ShrinkDsk() error {
 			ne := bmfte.Begin_BLK+cdif
 			bmfte.End_BLK = ne
 			e := f.FS.MMFT.PutEntry(bmfte)
-			if e!=nil { return e }
-			f.FS.FreeRangeSync(ne,oe)
+			if e!=nil { return 0,e }
+			f.FS.FreeRange(ne,oe)
 			break
 		}
 	}
 	/* Flush Cache. */
 	f.FS.MMFT.ResetEntryChain(f.MFT,f.FID)
-	return nil
+	return freed,nil
 }
 func (f *File) Grow(size int64) error {
-	return f.sizectl(size,false,true)
+	return f.sizectl(size,false,true,size)
 }
 func (f *File) Resize(size int64) error {
-	return f.sizectl(size,true,true)
+	return f.sizectl(size,true,true,size)
 }
-func (f *File) sizectl(size int64,shrink, grow bool) error {
+/*
+ When growing, the bytes between the old end of file and 'fill', that are in
+ blocks allocated before, are zeroed, as they may hold data from before a
+ shrink. (New blocks are cleared by the allocator.) Writers pass the offset
+ of their write, as they overwrite the rest anyway.
+ */
+func (f *File) sizectl(size int64,shrink, grow bool, fill int64) error {
+	if f.FS.ReadOnly { return EReadOnly }
+	defer f.FS.lockFile(f.MFT,f.FID)()
 	bz := uint64(f.FS.SB.BlockSize)
 	blks := (uint64(size)+bz-1)/bz
 	mfte,e := f.GetMFTE()
@@ -252,6 +272,9 @@ func (f *File) sizectl(size int64,shrink, grow bool) error {
 	
 	gec,e := f.FS.MMFT.GetEntryChain(f.MFT,f.FID)
 	if e!=nil { return e }
+	if alloc := int64(gec.TotalBLK*bz); fill>alloc { fill = alloc }
+	e = f.zero(mfte.FileSize,fill)
+	if e!=nil { return e }
 	if gec.TotalBLK < blks {
 		i := len(gec.Indeces)-1
 		needblk := blks-gec.Off_BLK[i]
@@ -273,6 +296,28 @@ func (f *File) sizectl(size int64,shrink, grow bool) error {
 	mfte.FileSize = size
 	return f.FS.MMFT.PutEntry(mfte)
 }
+/* Writes zeros to the allocated bytes from 'pos' to 'end'. */
+func (f *File) zero(pos, end int64) error {
+	if pos>=end { return nil }
+	zeros := make([]byte,64<<10)
+	for pos<end {
+		n := end-pos
+		if n>int64(len(zeros)) { n = int64(len(zeros)) }
+		r,e := f.FrangesLL(pos,pos+n)
+		if e!=nil { return e }
+		w,e := WriteFileRanges(r,zeros[:n])
+		if e!=nil { return e }
+		if int64(w)<n { return EIO }
+		pos += n
+	}
+	return nil
+}
+// Sets the size of the file and releases the blocks beyond it.
+func (f *File) Truncate(size int64) error {
+	e := f.Resize(size)
+	if e!=nil { return e }
+	return f.ShrinkDsk()
+}
 func (f *File) Size() (int64,error) {
 	mfte,e := f.GetMFTE()
 	if e!=nil { return 0,e }
@@ -281,6 +326,7 @@ func (f *File) Size() (int64,error) {
 
 func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
 	lp := len(p)
+	defer f.FS.rlockFile(f.MFT,f.FID)()
 	r,e := f.Franges(off,lp)
 	if e!=nil  { return 0,e }
 	n,err = ReadFileRanges(r,p)
@@ -293,7 +339,9 @@ func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.FS.ReadOnly { return 0,EReadOnly }
 	lp := len(p)
+	defer f.FS.rlockFile(f.MFT,f.FID)()
 	r,e := f.Franges(off,lp)
 	if e!=nil  { return 0,e }
 	n,err = WriteFileRanges(r,p)
@@ -306,25 +354,73 @@ func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *File) AsDirectory() (*ods.Directory,error) {
-	return ods.NewDirectory(&AutoGrowingFile{f},int(f.FS.SB.DirSegSize))
+	d,e := ods.NewDirectory(&AutoGrowingFile{f},int(f.FS.SB.DirSegSize))
+	if e!=nil { return nil,e }
+	d.Names = ods.NamePolicy(f.FS.SB.NameFlags)
+	if !f.FS.ReadOnly { e = d.Recover() }
+	if e!=nil { return nil,e }
+	return d,nil
 }
 func (f *File) AsDirectoryLite() *ods.Directory {
-	return ods.NewDirectoryLite(&AutoGrowingFile{f},int(f.FS.SB.DirSegSize))
+	d := ods.NewDirectoryLite(&AutoGrowingFile{f},int(f.FS.SB.DirSegSize))
+	d.Names = ods.NamePolicy(f.FS.SB.NameFlags)
+	return d
 }
 func (f *File) GetMDF() (*MetaDataFile,error) {
 	return f.FS.GetMDF(f.MFT,f.FID)
 }
 
+// Records a read access of the file, see MetaDataFile.Accessed.
+func (f *File) Accessed() {
+	if f.FS.ReadOnly { return }
+	mdf,e := f.GetMDF()
+	if e==nil { mdf.Accessed(time.Now()) }
+}
+
+// Writes the cached metadata file of this file back, if it is dirty.
+func (f *File) FlushMetadata() {
+	mdf := f.FS.cachedMDF(f.MFT,f.FID)
+	if mdf!=nil { mdf.flush() }
+}
+
+/*
+ Makes the file durable: its data, its MFT entries, the bitmap and (unless
+ 'datasync' is set) its metadata file. As all of them live on the same
+ device, this ends in a sync of the whole device.
+ */
+func (f *File) Sync(datasync bool) error {
+	if !datasync { f.FlushMetadata() }
+	e := f.FS.FlushCache()
+	e2 := f.FS.Device.Sync()
+	if e==nil { e = e2 }
+	return e
+}
+
 
 type AutoGrowingFile struct{
 	*File
 }
 func (f *AutoGrowingFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.FS.ReadOnly { return 0,EReadOnly }
 	lp := len(p)
-	f.Grow(off+int64(lp))
-	r,e := f.Franges(off,lp)
-	if e!=nil  { return 0,e }
-	n,err = WriteFileRanges(r,p)
+	end := off+int64(lp)
+	for {
+		/*
+		 Grow takes the file lock exclusively, so another writer may shrink the
+		 file before we write. Check the size again under the shared lock.
+		 */
+		e := f.sizectl(end,false,true,off)
+		if e!=nil  { return 0,e }
+		unlock := f.FS.rlockFile(f.MFT,f.FID)
+		mfte,e := f.GetMFTE()
+		if e!=nil  { unlock(); return 0,e }
+		if mfte.FileSize<end { unlock(); continue }
+		r,e := f.Franges(off,lp)
+		if e!=nil  { unlock(); return 0,e }
+		n,err = WriteFileRanges(r,p)
+		unlock()
+		break
+	}
 	if n<lp {
 		if err==nil { err = EIO }
 	} else {
@@ -0,0 +1,132 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1
+
+import "testing"
+import "bytes"
+import "errors"
+import "fmt"
+
+import "github.com/maxymania/anyfs/dskimg"
+import "github.com/maxymania/anyfs/dskimg/ods"
+
+/* Creates a fresh file system on a MemDevice. */
+func newTestFS(t *testing.T) *FileSystem {
+	dev := dskimg.NewMemDevice(16<<20)
+	fs := new(FileSystem)
+	fs.Device = dev
+	fs.NoSync = true
+	e := fs.Mkfs(512,&MkfsInfo{BlockSize:4096,MftBlocks:16})
+	if e!=nil { t.Fatal("mkfs: ",e) }
+	fs = new(FileSystem)
+	fs.Device = dev
+	fs.NoSync = true
+	e = fs.LoadFileSystem(512)
+	if e!=nil { t.Fatal("load: ",e) }
+	return fs
+}
+
+/* Bytes, that were written before a shrink, must not come back when the file grows again. */
+func TestRegrowZeroes(t *testing.T) {
+	fs := newTestFS(t)
+	f,e := fs.CreateFile(ods.FT_FILE)
+	if e!=nil { t.Fatal(e) }
+	ag := &AutoGrowingFile{f}
+	old := bytes.Repeat([]byte{0xaa},3*4096)
+	if _,e := ag.WriteAt(old,0); e!=nil { t.Fatal(e) }
+	
+	if e := f.Resize(100); e!=nil { t.Fatal(e) }
+	if e := f.Grow(4096); e!=nil { t.Fatal(e) }
+	if _,e := ag.WriteAt([]byte{1},3*4096-1); e!=nil { t.Fatal(e) }
+	
+	buf := make([]byte,3*4096)
+	if _,e := f.ReadAt(buf,0); e!=nil { t.Fatal(e) }
+	if !bytes.Equal(buf[:100],old[:100]) { t.Error("head lost") }
+	if i := bytes.IndexByte(buf[100:len(buf)-1],0xaa); i>=0 { t.Errorf("stale byte at %d",100+i) }
+	if buf[len(buf)-1]!=1 { t.Error("write lost") }
+}
+
+var errCrash = errors.New("crash")
+
+/* A directory file, that fails every write after the first 'left' ones. */
+type crashFile struct{
+	*AutoGrowingFile
+	left int
+}
+func (c *crashFile) WriteAt(p []byte, off int64) (int,error) {
+	if c.left==0 { return 0,errCrash }
+	c.left--
+	return c.AutoGrowingFile.WriteAt(p,off)
+}
+func (c *crashFile) Truncate(size int64) error {
+	if c.left==0 { return errCrash }
+	c.left--
+	return c.AutoGrowingFile.Truncate(size)
+}
+
+/* A compaction, that is cut off at any write, must neither lose nor duplicate an entry. */
+func TestCompactCrash(t *testing.T) {
+	for crash := 0; true; crash++ {
+		fs := newTestFS(t)
+		f,e := fs.CreateFile(ods.FT_DIR)
+		if e!=nil { t.Fatal(e) }
+		d,e := f.AsDirectory()
+		if e!=nil { t.Fatal(e) }
+		d.NoAutoCompact = true
+		name := func(i int) string { return fmt.Sprintf("a-rather-long-file-name-%05d",i) }
+		for i:=0; i<400; i++ {
+			if e := d.Add(ods.DirectoryEntry{name(i),ods.DirectoryEntryValue{File_IDX:uint32(i),FileType:ods.FT_FILE}}); e!=nil { t.Fatal(e) }
+		}
+		for i:=0; i<400; i++ {
+			if i%8==0 { continue }
+			if _,e := d.Delete(name(i)); e!=nil { t.Fatal(e) }
+		}
+		before,_ := f.Size()
+		
+		cd,e := ods.NewDirectory(&crashFile{&AutoGrowingFile{f},crash},d.Segsz)
+		if e!=nil { t.Fatal(e) }
+		cd.Names = d.Names
+		ce := cd.Compact()
+		
+		d,e = f.AsDirectory()
+		if e!=nil { t.Fatal(crash,e) }
+		seen := make(map[string]int)
+		for i:=int64(0); true; i++ {
+			ents,e := d.ReadDir(i)
+			if e!=nil { break }
+			for _,ent := range ents { seen[ent.Name]++ }
+		}
+		if len(seen)!=50 { t.Fatalf("crash after %d writes: %d entries",crash,len(seen)) }
+		for i:=0; i<400; i+=8 {
+			if seen[name(i)]!=1 { t.Fatalf("crash after %d writes: %s seen %d times",crash,name(i),seen[name(i)]) }
+		}
+		after,_ := f.Size()
+		if ce==nil {
+			if after>=before { t.Fatal("not compacted",before,after) }
+			if crash<3 { t.Fatal("too few writes",crash) }
+			return
+		}
+	}
+}
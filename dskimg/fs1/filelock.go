@@ -0,0 +1,79 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1
+
+import "sync"
+
+/*
+ Per-file reader/writer locks, keyed by the head of the file's MFT chain.
+ Readers and writers of the file's data take the lock shared, everything that
+ changes the chain, the size or the reference count takes it exclusively.
+ 
+ If two file locks are held at once, the lock of a file is taken before the
+ lock of its metadata file.
+ */
+type fileLock struct{
+	sync.RWMutex
+	refs int
+}
+
+func (f *FileSystem) fileLock(ii, i uint32) *fileLock {
+	key := join32to64(ii,i)
+	f.fileLck.Lock()
+	defer f.fileLck.Unlock()
+	if f.fileLocks==nil { f.fileLocks = make(map[uint64]*fileLock) }
+	l := f.fileLocks[key]
+	if l==nil {
+		l = new(fileLock)
+		f.fileLocks[key] = l
+	}
+	l.refs++
+	return l
+}
+func (f *FileSystem) putFileLock(ii, i uint32, l *fileLock) {
+	f.fileLck.Lock()
+	defer f.fileLck.Unlock()
+	l.refs--
+	if l.refs==0 { delete(f.fileLocks,join32to64(ii,i)) }
+}
+
+/* Locks the file exclusively and returns the unlock function. */
+func (f *FileSystem) lockFile(ii, i uint32) func() {
+	l := f.fileLock(ii,i)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		f.putFileLock(ii,i,l)
+	}
+}
+/* Locks the file shared and returns the unlock function. */
+func (f *FileSystem) rlockFile(ii, i uint32) func() {
+	l := f.fileLock(ii,i)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		f.putFileLock(ii,i,l)
+	}
+}
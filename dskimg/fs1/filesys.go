@@ -32,9 +32,11 @@ import "github.com/maxymania/anyfs/dskimg"
 import "github.com/maxymania/anyfs/dskimg/ods"
 import "github.com/maxymania/anyfs/dskimg/bitmap"
 import "github.com/maxymania/anyfs/debug"
+import "github.com/maxymania/anyfs/security"
 import "errors"
 import "sync"
 import "math/rand"
+import "fmt"
 import "github.com/hashicorp/golang-lru"
 
 var badmz = errors.New("Bad Magic number")
@@ -42,15 +44,45 @@ var badmz = errors.New("Bad Magic number")
 var oor = errors.New("Out of Resources")
 var Enotfound = errors.New("Not found")
 var einvalidfile = errors.New("Invalid file")
+var EDirty = errors.New("File system was not cleanly unmounted")
+var EReadOnly = errors.New("Read-only file system")
+var EDeviceSize = errors.New("Device is smaller than the file system (missing slow tier?)")
+
+// Returned, if the image is mounted by another process or host.
+type InUseError struct{
+	Host string
+	PID  uint32
+}
+func (e *InUseError) Error() string {
+	if e.Host=="" { return "Image is in use" }
+	return fmt.Sprintf("Image is in use (mounted on %s by pid %d)",e.Host,e.PID)
+}
+
+func hostname() string {
+	h,_ := os.Hostname()
+	return h
+}
 
 const (
 	FS_SPECIAL_ROOT = 1+iota
+	FS_SPECIAL_QUOTA
+	FS_SPECIAL_ORPHANS
 )
 
+/* The reference count of the special files. They are never deleted. */
+const REFCOUNT_PINNED = 10000000
+
 type MkfsInfo struct{
 	BlockSize  uint32
 	MftBlocks  uint32
 	DirSegSize uint32
+	NameFlags  ods.NamePolicy
+	
+	/*
+	 * If not 0, the volume has two tiers: the first FastBlocks blocks are the
+	 * fast tier, the rest is the slow tier.
+	 */
+	FastBlocks uint64
 }
 func (mf *MkfsInfo) bitmap(i int64, blknum uint64) (blk,lng uint64){
 	blk  = uint64(i+256)+uint64(mf.BlockSize)-1
@@ -64,6 +96,11 @@ func join32to64(ii, i uint32) uint64 {
 	return (uint64(ii)<<32)|uint64(i)
 }
 
+// Returns the inode number of a file. It is stable across mounts.
+func InodeNumber(ii, i uint32) uint64 {
+	return join32to64(ii,i)
+}
+
 func mdfcacheEvict (key interface{},val interface{}) {
 	val.(*MetaDataFile).flush()
 }
@@ -78,30 +115,135 @@ type initialFile struct{
 }
 
 type FileSystem struct{
-	Device *os.File
+	Device  dskimg.Device
 	SB     *ods.Superblock
 	MMFT    ods.MMFT
-	MFTLck  sync.Mutex
 	BitMap  bitmap.BitRegion
-	BMLck   sync.Mutex
+	
+	fileLck     sync.Mutex
+	fileLocks   map[uint64]*fileLock
+	allocGroups allocGroups
+	
+	/*
+	 * If NoSync is false, every write to the MFT and the Bitmap is synchronized.
+	 * If it is true (write-back mode), nothing is synchronized until File.Sync()
+	 * or FileSystem.Sync() is called.
+	 */
 	NoSync  bool
+	
+	/*
+	 * If Discard is set, blocks are discarded on the Device when they are
+	 * freed, if the Device supports it (see dskimg.Discarder).
+	 */
+	Discard bool
+	
+	/*
+	 * If ReadOnly is set, nothing is ever written to the Device. All mutating
+	 * operations fail with EReadOnly. The Device may be opened O_RDONLY.
+	 */
+	ReadOnly bool
+	
+	/*
+	 * Mkfs and LoadFileSystem take an advisory lock on the Device (shared in
+	 * ReadOnly mode, exclusive otherwise). If ForceLock is set, they proceed
+	 * even if the lock can not be acquired.
+	 */
+	ForceLock bool
 	Temp    uint32
 	
+	/*
+	 * If CacheBlocks is not 0, all I/O to the Bitmap, the MFT and the segments
+	 * of directories goes through a BlockCache of CacheBlocks blocks. CacheWriteBack turns on write-back
+	 * mode; the cache must then be flushed with FlushCache().
+	 */
+	CacheBlocks    int
+	CacheWriteBack bool
+	Cache   *dskimg.BlockCache
+	
+	/* The quota file. nil, if the image has none. */
+	Quota   *Quota
+	
+	/* The orphan list. nil, if the image has none. */
+	Orphans *Orphans
+	
 	condev  dskimg.IoReaderWriterAt
+	dirdev  dskimg.Device
+	sbOff   int64
 	
 	mdfsync  sync.Mutex
 	mdfcache *lru.Cache
+	
+	openLck  sync.Mutex
+	opens    map[uint64]int /* Open count of files. */
+	orphanLck sync.Mutex
 }
 func (f *FileSystem) initdev(){
-	if f.NoSync {
+	if f.NoSync || f.ReadOnly {
 		f.condev = f.Device
 	}else{
-		f.condev = &dskimg.SyncFile{f.Device}
+		f.condev = dskimg.NewSyncDevice(f.Device)
 	}
 }
+func (f *FileSystem) lock() error {
+	e := dskimg.LockDevice(f.Device,!f.ReadOnly)
+	if e!=nil && f.ForceLock { return nil }
+	return e
+}
+/* Must be called after f.SB.BlockSize is known. */
+func (f *FileSystem) initcache() error {
+	if f.CacheBlocks<=0 { return nil }
+	c,e := dskimg.NewBlockCache(f.condev,int(f.SB.BlockSize),f.CacheBlocks,f.CacheWriteBack)
+	if e!=nil { return e }
+	f.Cache  = c
+	f.condev = c
+	f.dirdev = &cachedDevice{f.Device,c}
+	return nil
+}
+/* Returns the device, the data of files of type 'ft' is accessed through. */
+func (f *FileSystem) deviceOf(ft uint8) dskimg.Device {
+	if ft==ods.FT_DIR && f.dirdev!=nil { return f.dirdev }
+	return f.Device
+}
+/*
+ Makes the block cache forget [pos,end), before the blocks are freed or
+ overwritten directly on the Device.
+ */
+func (f *FileSystem) discardCache(pos, end uint64) {
+	if f.Cache==nil || pos>=end { return }
+	f.Cache.Discard(f.SB.Offset(pos),f.SB.Length(end-pos))
+}
+
+/* Directory segments are cached like the bitmap and the MFT. */
+type cachedDevice struct{
+	dskimg.Device
+	cache *dskimg.BlockCache
+}
+func (c *cachedDevice) ReadAt(p []byte, off int64) (int,error) { return c.cache.ReadAt(p,off) }
+func (c *cachedDevice) WriteAt(p []byte, off int64) (int,error) { return c.cache.WriteAt(p,off) }
+// Writes all dirty blocks of the metadata cache back to the device.
+func (f *FileSystem) FlushCache() error {
+	if f.Cache==nil { return nil }
+	return f.Cache.Flush()
+}
+
+/*
+ Writes all cached metadata files and metadata blocks back and synchronizes
+ the device. After Sync() returns, everything written before is durable.
+ */
+func (f *FileSystem) Sync() error {
+	if f.ReadOnly { return nil }
+	f.flushMDFs()
+	e := f.FlushCache()
+	e2 := f.Device.Sync()
+	if e==nil { e = e2 }
+	return e
+}
 func (f *FileSystem) Mkfs(i int64, mf *MkfsInfo) error {
+	if f.ReadOnly { return EReadOnly }
+	e := f.lock()
+	if e!=nil { return e }
 	f.initdev()
-	fif,e := f.Device.Stat()
+	size,e := f.Device.Size()
 	if e!=nil { return e }
 	f.mdfcache,e = mdfcacheCreate(1024)
 	if e!=nil { return e }
@@ -109,10 +251,10 @@ func (f *FileSystem) Mkfs(i int64, mf *MkfsInfo) error {
 	f.SB.MagicNumber = ods.Superblock_MagicNumber
 	f.SB.BlockSize   = mf.BlockSize
 	f.SB.DiskSerial  = uint64(rand.Int63())
-	f.SB.Block_Len   = uint64(fif.Size())/uint64(mf.BlockSize)
-	debug.Println("fif.Size() = ",fif.Size())
+	f.SB.Block_Len   = uint64(size)/uint64(mf.BlockSize)
+	debug.Println("Device.Size() = ",size)
 	debug.Println("mf.BlockSize = ",mf.BlockSize)
-	debug.Println("uint64(",fif.Size(),")/uint64(",mf.BlockSize,") = ",uint64(fif.Size())/uint64(mf.BlockSize))
+	debug.Println("uint64(",size,")/uint64(",mf.BlockSize,") = ",uint64(size)/uint64(mf.BlockSize))
 	f.SB.Bitmap_BLK,f.SB.Bitmap_LEN = mf.bitmap(i,f.SB.Block_Len)
 	f.SB.DirSegSize  = mf.BlockSize
 	if mf.DirSegSize!=0 { f.SB.DirSegSize = mf.DirSegSize }
@@ -121,6 +263,10 @@ func (f *FileSystem) Mkfs(i int64, mf *MkfsInfo) error {
 	} else if f.SB.DirSegSize > (1<<16) { 
 		f.SB.DirSegSize = (1<<16)
 	}
+	f.SB.NameFlags   = uint32(mf.NameFlags)
+	if mf.FastBlocks<f.SB.Block_Len { f.SB.Tier_BLK = mf.FastBlocks }
+	e = f.initcache()
+	if e!=nil { return e }
 	
 	img := dskimg.NewSectionIo(f.condev,f.SB.Offset(f.SB.Bitmap_BLK),f.SB.Length(f.SB.Bitmap_LEN))
 	buffer := make([]byte,int(mf.BlockSize))
@@ -150,13 +296,15 @@ func (f *FileSystem) Mkfs(i int64, mf *MkfsInfo) error {
 	f.Temp = mft.Head.MFT_ID
 	
 	initialFiles := [...]initialFile{
-		initialFile{FS_SPECIAL_ROOT,ods.FT_DIR},
+		initialFile{FileType:ods.FT_DIR,File_IDX:FS_SPECIAL_ROOT},
+		initialFile{FileType:ods.FT_QUOTA,File_IDX:FS_SPECIAL_QUOTA},
+		initialFile{FileType:ods.FT_ORPHANS,File_IDX:FS_SPECIAL_ORPHANS},
 	}
 	
 	for _,inf := range initialFiles {
 		mfte := f.MMFT.CreateEntry(f.Temp,inf.File_IDX)
 		mfte.FileType = inf.FileType
-		mfte.RefCount = 10000000
+		mfte.RefCount = REFCOUNT_PINNED
 		
 		e := f.MMFT.PutEntry(mfte)
 		if e!=nil { return e }
@@ -164,15 +312,20 @@ func (f *FileSystem) Mkfs(i int64, mf *MkfsInfo) error {
 	
 	for _,inf := range initialFiles {
 		mfe,e := f.CreateFileLL(ods.FT_METADATA,nil)
-		if e!=nil { continue }
+		if e!=nil { return e }
 		e = f.setMetadataFile_Or_Shred(f.Temp,inf.File_IDX,mfe)
-		if e!=nil { continue }
+		if e!=nil { return e }
 		mdf,e := f.getMDF(f.Temp,inf.File_IDX)
-		if e!=nil { continue }
+		if e!=nil { return e }
 		
 		mdf.initialContent()
 	}
 	
+	e = f.loadQuota()
+	if e!=nil { return e }
+	e = f.loadOrphans()
+	if e!=nil { return e }
+	
 	debug.Println("SuperBlock = {")
 	debug.Println(" - MagicNumber ",f.SB.MagicNumber)
 	debug.Println(" - BlockSize   ",f.SB.BlockSize)
@@ -182,11 +335,17 @@ func (f *FileSystem) Mkfs(i int64, mf *MkfsInfo) error {
 	debug.Println(" - Bitmap_LEN  ",f.SB.Bitmap_LEN)
 	debug.Println(" - FirstMFT    ",f.SB.FirstMFT)
 	debug.Println(" - DirSegSize  ",f.SB.DirSegSize)
+	debug.Println(" - State       ",f.SB.State)
 	debug.Println("}")
 	
+	f.sbOff = i
+	e = f.FlushCache()
+	if e!=nil { return e }
+	
 	return f.SB.StoreSuperblock(i,f.Device)
 }
 func (f *FileSystem) LoadFileSystem(i int64) error {
+	le := f.lock()
 	f.initdev()
 	f.SB = new(ods.Superblock)
 	e := f.SB.LoadSuperblock(i,f.Device)
@@ -199,13 +358,26 @@ func (f *FileSystem) LoadFileSystem(i int64) error {
 	debug.Println(" - Bitmap_LEN  ",f.SB.Bitmap_LEN)
 	debug.Println(" - FirstMFT    ",f.SB.FirstMFT)
 	debug.Println(" - DirSegSize  ",f.SB.DirSegSize)
+	debug.Println(" - State       ",f.SB.State)
+	debug.Println(" - MountHost   ",f.SB.GetMountHost())
+	debug.Println(" - MountPID    ",f.SB.MountPID)
 	debug.Println("}")
 	
 	if e!=nil { return e }
+	if le!=nil {
+		if f.SB.State==ods.SB_STATE_MOUNTED { return &InUseError{f.SB.GetMountHost(),f.SB.MountPID} }
+		return le
+	}
+	f.sbOff = i
 	f.mdfcache,e = mdfcacheCreate(1024)
 	if e!=nil { return e }
 	
 	if f.SB.MagicNumber != ods.Superblock_MagicNumber { return badmz }
+	size,e := f.Device.Size()
+	if e!=nil { return e }
+	if uint64(size)/uint64(f.SB.BlockSize) < f.SB.Block_Len { return EDeviceSize }
+	e = f.initcache()
+	if e!=nil { return e }
 	f.BitMap.Image = dskimg.NewSectionIo(f.condev,f.SB.Offset(f.SB.Bitmap_BLK),f.SB.Length(f.SB.Bitmap_LEN))
 	
 	img := dskimg.NewSectionIo(f.condev,f.SB.Offset(f.SB.FirstMFT),f.SB.Length(1))
@@ -219,7 +391,56 @@ func (f *FileSystem) LoadFileSystem(i int64) error {
 	
 	f.Temp = mft.Head.MFT_ID
 	
-	return nil
+	e = f.loadQuota()
+	if e!=nil { return e }
+	return f.loadOrphans()
+}
+
+// Returns true, if the file system has been cleanly unmounted.
+func (f *FileSystem) IsClean() bool {
+	return f.SB.State==ods.SB_STATE_CLEAN
+}
+
+/*
+ Marks the file system as mounted by this process in the superblock.
+ If it is already marked as mounted by another host, an *InUseError is
+ returned; if it is marked by this host (which can not be, as we hold the
+ lock), it has not been cleanly unmounted and EDirty is returned. Both can
+ be overridden with 'force'. In read-only mode the superblock is left
+ untouched, so dirty images can be inspected.
+ Orphans left behind by a crash are deleted.
+ */
+func (f *FileSystem) Mount(force bool) error {
+	if f.ReadOnly { return nil } /* Leave the superblock as it is. */
+	if !f.IsClean() && !force {
+		host := f.SB.GetMountHost()
+		if host!="" && host!=hostname() { return &InUseError{host,f.SB.MountPID} }
+		return EDirty
+	}
+	f.SB.State = ods.SB_STATE_MOUNTED
+	f.SB.MountPID = uint32(os.Getpid())
+	f.SB.SetMountHost(hostname())
+	e := f.SB.StoreSuperblock(f.sbOff,f.Device)
+	if e!=nil { return e }
+	e = f.Device.Sync()
+	if e!=nil { return e }
+	return f.purgeOrphans()
+}
+
+/*
+ Writes everything back, synchronizes the device and marks the file system
+ as cleanly unmounted.
+ */
+func (f *FileSystem) Unmount() error {
+	if f.ReadOnly { return nil }
+	e := f.Sync()
+	if e!=nil { return e }
+	f.SB.State = ods.SB_STATE_CLEAN
+	f.SB.MountPID = 0
+	f.SB.SetMountHost("")
+	e = f.SB.StoreSuperblock(f.sbOff,f.Device)
+	if e!=nil { return e }
+	return f.Device.Sync()
 }
 
 // Get file.
@@ -234,9 +455,34 @@ func (f *FileSystem) GetRootDir() *File {
 
 /*
  * Creates a new File in filesystem.
- * 'ft' must be one of FT_FILE, FT_DIR, FT_FIFO
+ * 'ft' must be one of FT_FILE, FT_DIR, FT_FIFO, FT_SOCK, FT_CHR, FT_BLK
  */
 func (f *FileSystem) CreateFile(ft uint8) (*File,error) {
+	return f.CreateFileOwned(ft,0,0)
+}
+
+/*
+ * Like CreateFile, but records 'owner' and 'group' in the metadata file
+ * and charges the new file against their quotas. A SID of 0 means "none".
+ */
+func (f *FileSystem) CreateFileOwned(ft uint8, owner, group security.SID) (*File,error) {
+	if f.ReadOnly { return nil,EReadOnly }
+	sids := []security.SID{owner,group}
+	e := f.Quota.charge(sids,0,1,true)
+	if e!=nil { return nil,e }
+	fl,e := f.createFile(ft)
+	if e!=nil {
+		f.Quota.charge(sids,0,-1,false)
+		return nil,e
+	}
+	if owner==0 && group==0 { return fl,nil }
+	mdf,e := fl.GetMDF()
+	if e!=nil { return fl,nil }
+	if owner!=0 { mdf.SetOwner(owner) }
+	if group!=0 { mdf.SetGroup(group) }
+	return fl,nil
+}
+func (f *FileSystem) createFile(ft uint8) (*File,error) {
 	mfe,e := f.CreateFileLL(ods.FT_METADATA,nil)
 	if e!=nil { return nil,e }
 	mfte,e := mfe.GetMFTE()
@@ -251,8 +497,7 @@ func (f *FileSystem) CreateFile(ft uint8) (*File,error) {
 	return fl,e
 }
 func (f *FileSystem) CreateFileLL(ft uint8, mdf_e *ods.MFTE) (*File,error) {
-	f.MFTLck.Lock()
-	defer f.MFTLck.Unlock()
+	if f.ReadOnly { return nil,EReadOnly }
 	retries := 32
 	id,ok := f.MMFT.RandomGet()
 	if !ok { return nil,oor }
@@ -265,6 +510,10 @@ func (f *FileSystem) CreateFileLL(ft uint8, mdf_e *ods.MFTE) (*File,error) {
 		mfte,e = f.MMFT.Allocate(id)
 	}
 	if e!=nil { return nil,e }
+	defer func() {
+		/* Give the entry back, unless it has been written. */
+		if e!=nil { f.MMFT.Unreserve(mfte.File_MFT,mfte.File_IDX) }
+	}()
 	mfte.FileType = ft
 	mfte.Cookie = uint64(rand.Int63())
 	mfte.RefCount = 1
@@ -285,8 +534,8 @@ func (f *FileSystem) setMetadataFile_Or_Shred(ii, i uint32, mfe *File) error {
 	return e
 }
 func (f *FileSystem) setMetadataFile(ii, i uint32, mfe *File) error {
-	f.MFTLck.Lock()
-	defer f.MFTLck.Unlock()
+	if f.ReadOnly { return EReadOnly }
+	defer f.lockFile(ii,i)()
 	mfte,e := f.MMFT.GetEntry(ii,i)
 	if e!=nil { return e }
 	mfte2,e := mfe.GetMFTE()
@@ -312,34 +561,70 @@ func (f *FileSystem) shred(ii,i uint32) error {
 }
 
 func (f *FileSystem) Decrement(ii,i uint32) error{
-	f.MFTLck.Lock()
-	defer f.MFTLck.Unlock()
+	if f.ReadOnly { return EReadOnly }
+	if f.Orphans!=nil && f.isOpen(ii,i) {
+		deferred,e := f.orphanize(ii,i)
+		if deferred || e!=nil { return e }
+	}
+	owned,e := f.remove(ii,i)
+	f.dropOwned(owned)
+	return e
+}
+/*
+ Decrements the reference count and releases the quota of a deleted file.
+ Returns the files owned by the deleted file; the caller must drop them.
+ */
+func (f *FileSystem) remove(ii,i uint32) ([]ods.FileRef,error){
+	sids := f.quotaSubjects(ii,i)
+	owned := f.ownedFiles(ii,i)
+	blocks,e := f.decrement(ii,i)
+	if blocks>=0 {
+		/* The file is gone, release its quota. */
+		f.Quota.charge(sids,-blocks,-1,false)
+		f.dropMDF(ii,i)
+		return owned,e
+	}
+	return nil,e
+}
+/* Returns the number of freed blocks, or -1 if the file is still alive. */
+func (f *FileSystem) decrement(ii,i uint32) (int64,error){
+	unlock := f.lockFile(ii,i)
+	defer unlock()
 	mfte_copy := new(ods.MFTE)
+	blocks := int64(-1)
+	if gec,e := f.MMFT.GetEntryChainLL(ii,i); e==nil {
+		blocks = int64(gec.TotalBLK)
+	}
 	e := f.internalDecrement(ii,i,mfte_copy)
-	if e!=nil { return e }
-	if mfte_copy.Mdf_IDX==0 { return nil } /* No Metadata File */
+	if e!=nil { return -1,e }
+	if mfte_copy.File_IDX==0 { return -1,nil } /* Not deleted. */
+	if blocks<0 { blocks = 0 }
+	if mfte_copy.Mdf_IDX==0 { return blocks,nil } /* No Metadata File */
 	
 	mfte2,e := f.MMFT.GetEntry(mfte_copy.Mdf_MFT,mfte_copy.Mdf_IDX)
 	
-	if e!=nil { return nil } /* Cannot read Metadata File. Gone? */
+	if e!=nil { return blocks,nil } /* Cannot read Metadata File. Gone? */
 	
-	if uint16(mfte2.Cookie&0xffff)!=mfte_copy.Mdf_Cookie { return nil }
+	if uint16(mfte2.Cookie&0xffff)!=mfte_copy.Mdf_Cookie { return blocks,nil }
 	
-	return f.internalDecrement(mfte_copy.Mdf_MFT,mfte_copy.Mdf_IDX,mfte_copy)
+	defer f.lockFile(mfte_copy.Mdf_MFT,mfte_copy.Mdf_IDX)()
+	return blocks,f.internalDecrement(mfte_copy.Mdf_MFT,mfte_copy.Mdf_IDX,mfte_copy)
 }
 func (f *FileSystem) internalDecrement(ii,i uint32, mfte_copy *ods.MFTE) error{
 	mfte,e := f.MMFT.GetEntry(ii,i)
 	if e!=nil { return e }
-	mfte.RefCount--
-	e = f.MMFT.PutEntry(mfte)
-	if e!=nil { return e }
+	if mfte.RefCount>0 { /* Orphans already have a reference count of 0. */
+		mfte.RefCount--
+		e = f.MMFT.PutEntry(mfte)
+		if e!=nil { return e }
+	}
 	if mfte.RefCount!=0 { return nil }
 	*mfte_copy = *mfte /* Copy MFT Entry, if Delete */
 	return f.shred(ii,i)
 }
 func (f *FileSystem) Increment(ii,i uint32) error{
-	f.MFTLck.Lock()
-	defer f.MFTLck.Unlock()
+	if f.ReadOnly { return EReadOnly }
+	defer f.lockFile(ii,i)()
 	mfte,e := f.MMFT.GetEntry(ii,i)
 	if e!=nil { return e }
 	mfte.RefCount++
@@ -360,17 +645,45 @@ func (f *FileSystem) GetMDF(ii, i uint32) (*MetaDataFile,error) {
 	}
 	return mdf,err
 }
+func (f *FileSystem) flushMDFs() {
+	f.mdfsync.Lock()
+	defer f.mdfsync.Unlock()
+	for _,key := range f.mdfcache.Keys() {
+		rawmdf,ok := f.mdfcache.Peek(key)
+		if ok { rawmdf.(*MetaDataFile).flush() }
+	}
+}
+/* Returns the metadata file, if it is in the cache. */
+func (f *FileSystem) cachedMDF(ii, i uint32) *MetaDataFile {
+	f.mdfsync.Lock()
+	defer f.mdfsync.Unlock()
+	rawmdf,ok := f.mdfcache.Peek(join32to64(ii,i))
+	if !ok { return nil }
+	return rawmdf.(*MetaDataFile)
+}
+/* Removes the metadata file of a deleted file from the cache, without flushing it. */
+func (f *FileSystem) dropMDF(ii, i uint32) {
+	f.mdfsync.Lock()
+	defer f.mdfsync.Unlock()
+	key := join32to64(ii,i)
+	rawmdf,ok := f.mdfcache.Peek(key)
+	if !ok { return }
+	mdf := rawmdf.(*MetaDataFile)
+	mdf.DirtySync.Lock()
+	mdf.Dirty = false
+	mdf.DirtySync.Unlock()
+	f.mdfcache.Remove(key)
+}
 func (f *FileSystem) getMDF(ii, i uint32) (*MetaDataFile,error) {
 	mfte,e := f.MMFT.GetEntry(ii,i)
 	if ods.MFT_IsFileNotFound(e) { return nil,Enotfound }
 	if e!=nil { return nil,e }
-	f.MMFT.GetEntry(ii,i)
 	if mfte.Mdf_IDX==0 { return nil,Enotfound }
 	mfte2,e := f.MMFT.GetEntry(mfte.Mdf_MFT,mfte.Mdf_IDX)
 	if e!=nil { return nil,e }
 	if uint16(mfte2.Cookie&0xffff)!=mfte.Mdf_Cookie { return nil,einvalidfile }
 	mdf := new(MetaDataFile)
-	e = mdf.init(f,ii,i)
+	e = mdf.init(f,mfte.Mdf_MFT,mfte.Mdf_IDX)
 	if e!=nil { return nil,e }
 	return mdf,nil
 }
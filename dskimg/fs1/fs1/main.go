@@ -0,0 +1,462 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+/*
+The fs1 command works on unmounted fs1 images, in the spirit of mtools.
+
+	fs1 -image disk.img [-slow slow.img] [-sbo 512] <command> [arguments]
+
+Paths inside the image are absolute or relative to the root directory.
+*/
+package main
+
+import "os"
+import "io"
+import "errors"
+import "fmt"
+import "flag"
+import "path"
+import "path/filepath"
+import "strings"
+import "time"
+import "github.com/maxymania/anyfs/dskimg"
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/dskimg/fs1api"
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/lcr"
+import dbgpkg "github.com/maxymania/anyfs/debug"
+
+var image = flag.String("image", "", "The file-system image")
+var slow = flag.String("slow", "", "The slow tier of a tiered image")
+var offset = flag.Int("sbo",512,"Superblock Offset")
+
+var force = flag.Bool("force", false, "Open the image even if it is in use or has not been cleanly unmounted")
+
+var trace = flag.Bool("trace", false, "print deep tracing messages")
+
+type command struct{
+	args   string
+	help   string
+	write  bool
+	min, max int /* Number of arguments; max<0 means unlimited. */
+	run    func(a *fs1api.FS, fl *flag.FlagSet) error
+	flags  func(fl *flag.FlagSet)
+}
+
+var long, recursive, parents *bool
+var output *string
+var age *time.Duration
+
+var commands = map[string]*command{
+	"ls":    {"[-l] [path...]","list directory contents",false,0,-1,cmdLs,func(fl *flag.FlagSet){ long = fl.Bool("l",false,"long listing") }},
+	"stat":  {"path...","display file status",false,1,-1,cmdStat,nil},
+	"cat":   {"path...","write files to standard output",false,1,-1,cmdCat,nil},
+	"get":   {"[-r] path [local]","copy a file out of the image",false,1,2,cmdGet,func(fl *flag.FlagSet){ recursive = fl.Bool("r",false,"copy directories recursively") }},
+	"put":   {"[-r] local [path]","copy a file into the image",true,1,2,cmdPut,func(fl *flag.FlagSet){ recursive = fl.Bool("r",false,"copy directories recursively") }},
+	"mkdir": {"[-p] path...","create directories",true,1,-1,cmdMkdir,func(fl *flag.FlagSet){ parents = fl.Bool("p",false,"create parent directories as needed") }},
+	"rm":    {"[-r] path...","remove files or directories",true,1,-1,cmdRm,func(fl *flag.FlagSet){ recursive = fl.Bool("r",false,"remove directories and their contents") }},
+	"mv":    {"old new","rename or move a file",true,2,2,cmdMv,nil},
+	"ln":    {"old new","create a hard link",true,2,2,cmdLn,nil},
+	"compact":{"[-r] path...","compact directories",true,1,-1,cmdCompact,func(fl *flag.FlagSet){ recursive = fl.Bool("r",false,"compact subdirectories too") }},
+	"tier":  {"path...","show storage policies and tier usage",false,1,-1,cmdTier,nil},
+	"policy":{"policy path...","set storage policies (hot, medium, cold, none)",true,2,-1,cmdPolicy,nil},
+	"migrate":{"[-r] [-age d] path...","move file data between tiers",true,1,-1,cmdMigrate,func(fl *flag.FlagSet){
+		recursive = fl.Bool("r",false,"migrate directories recursively")
+		age = fl.Duration("age",0,"files without policy, not accessed for this long, go to the slow tier, others to the fast one")
+	}},
+	"export":{"[-o file] [path]","write a directory tree as tar archive",false,0,1,cmdExport,func(fl *flag.FlagSet){ output = fl.String("o","-","output file (- = standard output)") }},
+}
+var order = []string{"ls","stat","cat","get","put","mkdir","rm","mv","ln","compact","tier","policy","migrate","export"}
+
+func usage() {
+	fmt.Fprintln(os.Stderr,"usage: fs1 -image <image> [flags] <command> [arguments]")
+	fmt.Fprintln(os.Stderr,"\nflags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr,"\ncommands:")
+	for _,name := range order {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr,"  %-7s %-20s %s\n",name,c.args,c.help)
+	}
+}
+
+func inUse(e error) bool {
+	if e==dskimg.ELocked { return true }
+	_,ok := e.(*fs1.InUseError)
+	return ok
+}
+
+func fail(e error) {
+	fmt.Fprintln(os.Stderr,"fs1:",e)
+	os.Exit(1)
+}
+
+func main(){
+	flag.Usage = usage
+	flag.Parse()
+	dbgpkg.TraceOn = *trace
+	if *image=="" || flag.NArg()==0 {
+		usage()
+		os.Exit(1)
+	}
+	c,ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintln(os.Stderr,"fs1: unknown command",flag.Arg(0))
+		usage()
+		os.Exit(1)
+	}
+	fl := flag.NewFlagSet(flag.Arg(0),flag.ExitOnError)
+	fl.Usage = func() {
+		fmt.Fprintf(os.Stderr,"usage: fs1 %s %s\n",flag.Arg(0),c.args)
+		fl.PrintDefaults()
+	}
+	if c.flags!=nil { c.flags(fl) }
+	fl.Parse(flag.Args()[1:])
+	if fl.NArg()<c.min || (c.max>=0 && fl.NArg()>c.max) {
+		fl.Usage()
+		os.Exit(1)
+	}
+	
+	mode := os.O_RDONLY
+	if c.write { mode = os.O_RDWR }
+	dev,e := dskimg.OpenImage(*image,*slow,mode)
+	if e!=nil { fail(e) }
+	defer dev.Close()
+	fs := new(fs1.FileSystem)
+	fs.Device = dev
+	fs.NoSync = true
+	fs.ReadOnly = !c.write
+	fs.ForceLock = *force
+	e = fs.LoadFileSystem(int64(*offset))
+	if inUse(e) { fail(fmt.Errorf("%v (use -force to open it anyway)",e)) }
+	if e!=nil { fail(e) }
+	e = fs.Mount(*force)
+	if e==fs1.EDirty || inUse(e) { fail(fmt.Errorf("%v (use -force to open it anyway)",e)) }
+	if e!=nil { fail(e) }
+	
+	e = c.run(fs1api.New(fs),fl)
+	e2 := fs.Unmount()
+	if e==nil { e = e2 }
+	if e==reported { os.Exit(1) }
+	if e!=nil { fail(e) }
+}
+
+/* Returned by each(), if the errors have already been reported. */
+var reported = errors.New("reported")
+
+/* Runs fn for every argument and reports the errors. */
+func each(args []string, fn func(string) error) error {
+	var err error
+	for _,arg := range args {
+		e := fn(arg)
+		if e!=nil {
+			fmt.Fprintln(os.Stderr,"fs1:",e)
+			err = reported
+		}
+	}
+	return err
+}
+
+func typeChar(m os.FileMode) byte {
+	switch {
+	case m.IsDir(): return 'd'
+	case m&os.ModeNamedPipe!=0: return 'p'
+	case m&os.ModeSocket!=0: return 's'
+	case m&os.ModeCharDevice!=0: return 'c'
+	case m&os.ModeDevice!=0: return 'b'
+	}
+	return '-'
+}
+
+func printEntry(fi os.FileInfo) {
+	if !*long {
+		fmt.Println(fi.Name())
+		return
+	}
+	mfte := fi.Sys().(*ods.MFTE)
+	nlink := uint64(mfte.RefCount)
+	if nlink>=fs1.REFCOUNT_PINNED { nlink = 1 }
+	fmt.Printf("%c %10d %3d %12d %s\n",typeChar(fi.Mode()),fs1.InodeNumber(mfte.File_MFT,mfte.File_IDX),nlink,fi.Size(),fi.Name())
+}
+
+func cmdLs(a *fs1api.FS, fl *flag.FlagSet) error {
+	args := fl.Args()
+	if len(args)==0 { args = []string{"/"} }
+	return each(args,func(name string) error {
+		fi,e := a.Stat(name)
+		if e!=nil { return e }
+		if !fi.IsDir() {
+			printEntry(fi)
+			return nil
+		}
+		list,e := a.ReadDir(name)
+		if e!=nil { return e }
+		if len(args)>1 { fmt.Printf("%s:\n",name) }
+		for _,cfi := range list { printEntry(cfi) }
+		return nil
+	})
+}
+
+func cmdStat(a *fs1api.FS, fl *flag.FlagSet) error {
+	return each(fl.Args(),func(name string) error {
+		fi,e := a.Stat(name)
+		if e!=nil { return e }
+		mfte := fi.Sys().(*ods.MFTE)
+		fmt.Printf("  File: %s\n",name)
+		fmt.Printf("  Type: %c  Mode: %v\n",typeChar(fi.Mode()),fi.Mode())
+		fmt.Printf("  Size: %d\n",fi.Size())
+		fmt.Printf(" Inode: %d (MFT %d, IDX %d)  Cookie: %016x\n",fs1.InodeNumber(mfte.File_MFT,mfte.File_IDX),mfte.File_MFT,mfte.File_IDX,mfte.Cookie)
+		fmt.Printf(" Links: %d\n",mfte.RefCount)
+		if mdf,e := a.FS.GetMDF(mfte.File_MFT,mfte.File_IDX); e==nil {
+			if sid,ok := mdf.Owner(); ok { fmt.Printf(" Owner: %v\n",sid) }
+			if sid,ok := mdf.Group(); ok { fmt.Printf(" Group: %v\n",sid) }
+			if rdev,ok := mdf.Rdev(); ok { fmt.Printf("  Rdev: %d,%d\n",fs1api.DevMajor(rdev),fs1api.DevMinor(rdev)) }
+			if t := mdf.Memory.BirthTime(); t!=nil { fmt.Printf(" Birth: %v\n",*t) }
+			if t := mdf.Memory.WriteTime(); t!=nil { fmt.Printf("Modify: %v\n",*t) }
+			if t := mdf.Memory.AccessTime(); t!=nil { fmt.Printf("Access: %v\n",*t) }
+		}
+		return nil
+	})
+}
+
+func cmdCat(a *fs1api.FS, fl *flag.FlagSet) error {
+	return each(fl.Args(),func(name string) error {
+		f,e := a.Open(name)
+		if e!=nil { return e }
+		defer f.Close()
+		_,e = io.Copy(os.Stdout,f)
+		return e
+	})
+}
+
+/* Copies a file out of the image. */
+func getFile(a *fs1api.FS, src, dst string) error {
+	f,e := a.Open(src)
+	if e!=nil { return e }
+	defer f.Close()
+	out,e := os.Create(dst)
+	if e!=nil { return e }
+	_,e = io.Copy(out,f)
+	e2 := out.Close()
+	if e==nil { e = e2 }
+	return e
+}
+
+func cmdGet(a *fs1api.FS, fl *flag.FlagSet) error {
+	src := fl.Arg(0)
+	dst := path.Base(path.Clean("/"+src))
+	if fl.NArg()>1 { dst = fl.Arg(1) }
+	if dst=="/" { dst = "." }
+	if fi,e := os.Stat(dst); e==nil && fi.IsDir() && fl.NArg()>1 {
+		dst = filepath.Join(dst,path.Base(path.Clean("/"+src)))
+	}
+	fi,e := a.Stat(src)
+	if e!=nil { return e }
+	if !fi.IsDir() { return getFile(a,src,dst) }
+	if !*recursive { return fmt.Errorf("%s is a directory (use -r)",src) }
+	return a.Walk(src,func(name string, fi os.FileInfo, e error) error {
+		if e!=nil { return e }
+		rel := strings.TrimPrefix(strings.TrimPrefix(name,src),"/")
+		local := filepath.Join(dst,filepath.FromSlash(rel))
+		switch {
+		case fi.IsDir(): e = os.MkdirAll(local,0777)
+		case fi.Mode().IsRegular(): e = getFile(a,name,local)
+		default: fmt.Fprintln(os.Stderr,"fs1: skipping special file",name)
+		}
+		return e
+	})
+}
+
+/* Copies a file into the image. */
+func putFile(a *fs1api.FS, src, dst string) error {
+	in,e := os.Open(src)
+	if e!=nil { return e }
+	defer in.Close()
+	f,e := a.Create(dst)
+	if e!=nil { return e }
+	_,e = io.Copy(f,in)
+	e2 := f.Close()
+	if e==nil { e = e2 }
+	return e
+}
+
+func cmdPut(a *fs1api.FS, fl *flag.FlagSet) error {
+	src := fl.Arg(0)
+	dst := "/"
+	if fl.NArg()>1 { dst = fl.Arg(1) }
+	if fi,e := a.Stat(dst); e==nil && fi.IsDir() {
+		dst = path.Join(dst,filepath.Base(src))
+	}
+	fi,e := os.Stat(src)
+	if e!=nil { return e }
+	if !fi.IsDir() { return putFile(a,src,dst) }
+	if !*recursive { return fmt.Errorf("%s is a directory (use -r)",src) }
+	return filepath.Walk(src,func(name string, fi os.FileInfo, e error) error {
+		if e!=nil { return e }
+		rel,e := filepath.Rel(src,name)
+		if e!=nil { return e }
+		target := path.Join(dst,filepath.ToSlash(rel))
+		switch {
+		case fi.IsDir(): e = a.MkdirAll(target,0777)
+		case fi.Mode().IsRegular(): e = putFile(a,name,target)
+		default: fmt.Fprintln(os.Stderr,"fs1: skipping special file",name)
+		}
+		return e
+	})
+}
+
+func cmdMkdir(a *fs1api.FS, fl *flag.FlagSet) error {
+	return each(fl.Args(),func(name string) error {
+		if *parents { return a.MkdirAll(name,0777) }
+		return a.Mkdir(name,0777)
+	})
+}
+
+func removeAll(a *fs1api.FS, name string) error {
+	fi,e := a.Stat(name)
+	if e!=nil { return e }
+	if fi.IsDir() {
+		list,e := a.ReadDir(name)
+		if e!=nil { return e }
+		for _,cfi := range list {
+			e = removeAll(a,path.Join(name,cfi.Name()))
+			if e!=nil { return e }
+		}
+	}
+	return a.Remove(name)
+}
+
+func cmdRm(a *fs1api.FS, fl *flag.FlagSet) error {
+	return each(fl.Args(),func(name string) error {
+		if *recursive { return removeAll(a,name) }
+		fi,e := a.Stat(name)
+		if e!=nil { return e }
+		if fi.IsDir() { return fmt.Errorf("%s is a directory (use -r)",name) }
+		return a.Remove(name)
+	})
+}
+
+func cmdMv(a *fs1api.FS, fl *flag.FlagSet) error {
+	src,dst := fl.Arg(0),fl.Arg(1)
+	if fi,e := a.Stat(dst); e==nil && fi.IsDir() {
+		dst = path.Join(dst,path.Base(path.Clean("/"+src)))
+	}
+	return a.Rename(src,dst)
+}
+
+func cmdLn(a *fs1api.FS, fl *flag.FlagSet) error {
+	src,dst := fl.Arg(0),fl.Arg(1)
+	if fi,e := a.Stat(dst); e==nil && fi.IsDir() {
+		dst = path.Join(dst,path.Base(path.Clean("/"+src)))
+	}
+	return a.Link(src,dst)
+}
+
+func compactAll(a *fs1api.FS, name string) error {
+	e := a.CompactDir(name)
+	if e!=nil || !*recursive { return e }
+	list,e := a.ReadDir(name)
+	if e!=nil { return e }
+	for _,cfi := range list {
+		if !cfi.IsDir() { continue }
+		e = compactAll(a,path.Join(name,cfi.Name()))
+		if e!=nil { return e }
+	}
+	return nil
+}
+func cmdCompact(a *fs1api.FS, fl *flag.FlagSet) error {
+	return each(fl.Args(),func(name string) error { return compactAll(a,name) })
+}
+
+func cmdExport(a *fs1api.FS, fl *flag.FlagSet) error {
+	src := "/"
+	if fl.NArg()>0 { src = fl.Arg(0) }
+	skipped := func(name string, reason error) { fmt.Fprintln(os.Stderr,"fs1: skipped",name+":",reason) }
+	if *output=="-" { return a.ExportTar(src,os.Stdout,skipped) }
+	out,e := os.Create(*output)
+	if e!=nil { return e }
+	e = a.ExportTar(src,out,skipped)
+	e2 := out.Close()
+	if e==nil { e = e2 }
+	return e
+}
+
+var policyNames = map[string]lcr.StoragePolicy{
+	"hot": lcr.STORE_HOT,
+	"medium": lcr.STORE_MEDIUM,
+	"cold": lcr.STORE_COLD,
+	"none": "",
+}
+func policyName(p lcr.StoragePolicy) string {
+	for n,q := range policyNames {
+		if p==q { return n }
+	}
+	return string(p)
+}
+
+func cmdTier(a *fs1api.FS, fl *flag.FlagSet) error {
+	return each(fl.Args(),func(name string) error {
+		p,e := a.StoragePolicy(name)
+		if e!=nil { return e }
+		fi,e := a.Stat(name)
+		if e!=nil { return e }
+		mfte := fi.Sys().(*ods.MFTE)
+		fast,slow,e := a.FS.GetFile(mfte.File_MFT,mfte.File_IDX).TierUsage()
+		if e!=nil { return e }
+		fmt.Printf("%-6s fast %8d  slow %8d  %s\n",policyName(p),fast,slow,name)
+		return nil
+	})
+}
+
+func cmdPolicy(a *fs1api.FS, fl *flag.FlagSet) error {
+	p,ok := policyNames[fl.Arg(0)]
+	if !ok { return fmt.Errorf("unknown policy %s",fl.Arg(0)) }
+	return each(fl.Args()[1:],func(name string) error { return a.SetStoragePolicy(name,p) })
+}
+
+func migrateAll(a *fs1api.FS, name string, now time.Time) error {
+	fi,e := a.Stat(name)
+	if e!=nil { return e }
+	p,e := a.StoragePolicy(name)
+	if e!=nil { return e }
+	if *age>0 && (p=="" || p==lcr.STORE_MEDIUM) && !fi.IsDir() {
+		p = lcr.STORE_HOT
+		if now.Sub(fi.(*fs1api.FileInfo).AccessTime())>*age { p = lcr.STORE_COLD }
+	}
+	n,e := a.Migrate(name,p)
+	if e!=nil { return e }
+	if n>0 { fmt.Printf("%s: %d blocks moved to %s tier\n",name,n,policyName(p)) }
+	if !*recursive || !fi.IsDir() { return nil }
+	list,e := a.ReadDir(name)
+	if e!=nil { return e }
+	for _,cfi := range list {
+		e = migrateAll(a,path.Join(name,cfi.Name()),now)
+		if e!=nil { return e }
+	}
+	return nil
+}
+func cmdMigrate(a *fs1api.FS, fl *flag.FlagSet) error {
+	if !a.FS.Tiered() { return errors.New("the image has only one tier") }
+	now := time.Now()
+	return each(fl.Args(),func(name string) error { return migrateAll(a,name,now) })
+}
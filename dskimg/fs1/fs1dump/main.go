@@ -0,0 +1,523 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+/*
+fs1dump prints the on-disk structures of an fs1 image.
+
+	fs1dump -image disk.img [-slow slow.img] [-json] [super|mft|bitmap|dir <path>|mdf <path>]
+
+Without a command, the superblock, the bitmap summary and the MFT are printed.
+Files can be given as path or as MFT:IDX (e.g. 12345:6).
+*/
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "sort"
+import "strings"
+import "time"
+import "encoding/binary"
+import "encoding/json"
+import "github.com/maxymania/anyfs/dskimg"
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/dskimg/fs1api"
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/security"
+import dbgpkg "github.com/maxymania/anyfs/debug"
+
+var image = flag.String("image", "", "The file-system image")
+var slow = flag.String("slow", "", "The slow tier of a tiered image")
+var offset = flag.Int("sbo",512,"Superblock Offset")
+
+var asJSON = flag.Bool("json", false, "JSON output")
+var force = flag.Bool("force", false, "Open the image even if it is in use")
+
+var trace = flag.Bool("trace", false, "print deep tracing messages")
+
+func fail(e error) {
+	fmt.Fprintln(os.Stderr,"fs1dump:",e)
+	os.Exit(1)
+}
+
+func ftName(ft uint8) string {
+	switch ft {
+	case 0: return "none"
+	case ods.FT_FILE: return "file"
+	case ods.FT_DIR: return "dir"
+	case ods.FT_FIFO: return "fifo"
+	case ods.FT_SOCK: return "sock"
+	case ods.FT_CHR: return "chr"
+	case ods.FT_BLK: return "blk"
+	case ods.FT_METADATA: return "metadata"
+	case ods.FT_QUOTA: return "quota"
+	case ods.FT_ORPHANS: return "orphans"
+	case ods.FT_PROPS: return "properties"
+	case ods.FT_BLOB: return "blob"
+	}
+	return fmt.Sprintf("0x%02x",ft)
+}
+
+/* ---------------- Superblock ---------------- */
+
+type mftReport struct{
+	ods.MFTH
+	EntriesPerBlock uint32
+	Entries         uint32
+}
+type superReport struct{
+	Offset      int64
+	MagicNumber uint32
+	MagicOK     bool
+	BlockSize   uint32
+	DiskSerial  uint64
+	Block_Len   uint64
+	Bitmap_BLK  uint64
+	Bitmap_LEN  uint64
+	FirstMFT    uint64
+	DirSegSize  uint32
+	NameFlags   []string
+	Tier_BLK    uint64
+	State       string
+	MountPID    uint32
+	MountHost   string
+	MFT         []mftReport
+}
+
+func mfts(fs *fs1.FileSystem) []*ods.MFT {
+	var list []*ods.MFT
+	for _,m := range fs.MMFT.MftByID { list = append(list,m) }
+	sort.Slice(list,func(i,j int) bool { return list[i].Head.MFT_ID<list[j].Head.MFT_ID })
+	return list
+}
+
+func dumpSuper(fs *fs1.FileSystem) *superReport {
+	sb := fs.SB
+	r := &superReport{
+		Offset: int64(*offset),
+		MagicNumber: sb.MagicNumber,
+		MagicOK: sb.MagicNumber==ods.Superblock_MagicNumber,
+		BlockSize: sb.BlockSize,
+		DiskSerial: sb.DiskSerial,
+		Block_Len: sb.Block_Len,
+		Bitmap_BLK: sb.Bitmap_BLK,
+		Bitmap_LEN: sb.Bitmap_LEN,
+		FirstMFT: sb.FirstMFT,
+		DirSegSize: sb.DirSegSize,
+		NameFlags: nameFlags(ods.NamePolicy(sb.NameFlags)),
+		Tier_BLK: sb.Tier_BLK,
+		State: "clean",
+		MountPID: sb.MountPID,
+		MountHost: sb.GetMountHost(),
+	}
+	if !fs.IsClean() { r.State = "mounted" }
+	for _,m := range mfts(fs) {
+		r.MFT = append(r.MFT,mftReport{*m.Head,m.EntriesPerBlock,m.Size})
+	}
+	return r
+}
+func nameFlags(p ods.NamePolicy) (list []string) {
+	if p&ods.NAME_CASEFOLD!=0 { list = append(list,"casefold") }
+	if p&ods.NAME_NFC!=0 { list = append(list,"nfc") }
+	if p&ods.NAME_UTF8!=0 { list = append(list,"utf8") }
+	if p&ods.NAME_LONG!=0 { list = append(list,"longnames") }
+	return
+}
+func (r *superReport) print() {
+	fmt.Println("Superblock (offset",r.Offset,")")
+	magic := "ok"
+	if !r.MagicOK { magic = "BAD" }
+	fmt.Printf("  MagicNumber  0x%08x (%s)\n",r.MagicNumber,magic)
+	fmt.Printf("  BlockSize    %d\n",r.BlockSize)
+	fmt.Printf("  DiskSerial   0x%016x\n",r.DiskSerial)
+	fmt.Printf("  Block_Len    %d\n",r.Block_Len)
+	fmt.Printf("  Bitmap       %d +%d blocks\n",r.Bitmap_BLK,r.Bitmap_LEN)
+	fmt.Printf("  FirstMFT     %d\n",r.FirstMFT)
+	fmt.Printf("  DirSegSize   %d\n",r.DirSegSize)
+	if len(r.NameFlags)>0 {
+		fmt.Printf("  NameFlags    %s\n",strings.Join(r.NameFlags,","))
+	}
+	if r.Tier_BLK!=0 {
+		fmt.Printf("  Tiers        fast 0..%d, slow %d..%d\n",r.Tier_BLK,r.Tier_BLK,r.Block_Len)
+	}
+	fmt.Printf("  State        %s\n",r.State)
+	if r.MountHost!="" || r.MountPID!=0 {
+		fmt.Printf("  MountedBy    %s pid %d\n",r.MountHost,r.MountPID)
+	}
+	for _,m := range r.MFT {
+		fmt.Printf("MFTH  MFT_ID %d  Num_BLK %d  NextMFT %d  (%d entries, %d per block)\n",m.MFT_ID,m.Num_BLK,m.NextMFT,m.Entries,m.EntriesPerBlock)
+	}
+}
+
+/* ---------------- MFT ---------------- */
+
+type segment struct{
+	IDX       uint32
+	Begin_BLK uint64
+	End_BLK   uint64
+}
+type mfteReport struct{
+	ods.MFTE
+	Type     string
+	Chain    []segment
+	TotalBLK uint64
+	Error    string `json:",omitempty"`
+}
+type mftDump struct{
+	Entries []*mfteReport
+	Orphans []segment /* Allocated segments, that are not in the chain of any file. */
+}
+
+/* Returns the allocated entries of an MFT, bypassing the caches. */
+func allocated(m *ods.MFT) map[uint32]*ods.MFTE {
+	ents := make(map[uint32]*ods.MFTE)
+	for i := uint32(1); i<m.Size; i++ {
+		mfte,e := m.GetEntryLLL(i)
+		if e!=nil || mfte.File_IDX!=i || mfte.File_MFT!=m.Head.MFT_ID { continue }
+		ents[i] = mfte
+	}
+	return ents
+}
+
+func dumpMFT(fs *fs1.FileSystem) *mftDump {
+	r := new(mftDump)
+	for _,m := range mfts(fs) {
+		ents := allocated(m)
+		seen := make(map[uint32]bool)
+		var idxs []uint32
+		for i,mfte := range ents {
+			if mfte.First_IDX==i { idxs = append(idxs,i) }
+		}
+		sort.Slice(idxs,func(i,j int) bool { return idxs[i]<idxs[j] })
+		for _,i := range idxs {
+			head := ents[i]
+			rep := &mfteReport{MFTE:*head,Type:ftName(head.FileType)}
+			for cur := head; cur!=nil; {
+				if seen[cur.File_IDX] { rep.Error = "loop in chain"; break }
+				seen[cur.File_IDX] = true
+				rep.Chain = append(rep.Chain,segment{cur.File_IDX,cur.Begin_BLK,cur.End_BLK})
+				if cur.End_BLK>cur.Begin_BLK { rep.TotalBLK += cur.End_BLK-cur.Begin_BLK }
+				if cur.Next_IDX==0 { break }
+				next,ok := ents[cur.Next_IDX]
+				if !ok { rep.Error = fmt.Sprint("chain continues at free entry ",cur.Next_IDX); break }
+				if next.First_IDX!=i { rep.Error = fmt.Sprint("entry ",cur.Next_IDX," belongs to chain ",next.First_IDX); break }
+				cur = next
+			}
+			r.Entries = append(r.Entries,rep)
+		}
+		for i,mfte := range ents {
+			if !seen[i] { r.Orphans = append(r.Orphans,segment{i,mfte.Begin_BLK,mfte.End_BLK}) }
+		}
+		sort.Slice(r.Orphans,func(i,j int) bool { return r.Orphans[i].IDX<r.Orphans[j].IDX })
+	}
+	return r
+}
+func (r *mftDump) print() {
+	fmt.Printf("MFT: %d files\n",len(r.Entries))
+	for _,e := range r.Entries {
+		fmt.Printf("%d:%d %-8s size %d refs %d cookie %016x mdf %d:%d/%04x blocks %d\n",
+			e.File_MFT,e.File_IDX,e.Type,e.FileSize,e.RefCount,e.Cookie,e.Mdf_MFT,e.Mdf_IDX,e.Mdf_Cookie,e.TotalBLK)
+		for _,s := range e.Chain {
+			if s.End_BLK<=s.Begin_BLK { continue }
+			fmt.Printf("    [%d] blocks %d-%d\n",s.IDX,s.Begin_BLK,s.End_BLK-1)
+		}
+		if e.Error!="" { fmt.Println("    ERROR:",e.Error) }
+	}
+	for _,s := range r.Orphans {
+		fmt.Printf("orphaned segment [%d] blocks %d-%d\n",s.IDX,s.Begin_BLK,s.End_BLK)
+	}
+}
+
+/* ---------------- Bitmap ---------------- */
+
+type blockRun struct{
+	Begin uint64
+	End   uint64 /* exclusive */
+}
+type bitmapDump struct{
+	Blocks         uint64
+	Used           uint64
+	Free           uint64
+	LargestFreeRun uint64
+	UsedRuns       []blockRun
+	Leaked         []blockRun /* Marked as used, but not referenced. */
+	Missing        []blockRun /* Referenced, but marked as free. */
+}
+
+func bit(buf []byte, i uint64) bool { return (buf[i>>3]&(1<<(i&7)))!=0 }
+
+/* Collects the runs, where 'pred' holds. */
+func runs(n uint64, pred func(uint64) bool) []blockRun {
+	var r []blockRun
+	for i := uint64(0); i<n; {
+		if !pred(i) { i++; continue }
+		j := i
+		for j<n && pred(j) { j++ }
+		r = append(r,blockRun{i,j})
+		i = j
+	}
+	return r
+}
+
+func dumpBitmap(fs *fs1.FileSystem, md *mftDump) (*bitmapDump,error) {
+	sb := fs.SB
+	n := sb.Block_Len
+	buf := make([]byte,(n+7)/8)
+	_,e := fs.BitMap.Image.ReadAt(buf,0)
+	if e!=nil { return nil,e }
+	
+	/* Blocks referenced by the file system: the head area, the bitmap, the MFTs and all extents. */
+	ref := make([]byte,len(buf))
+	mark := func(b, e uint64) {
+		if e>n { e = n }
+		for i := b; i<e; i++ { ref[i>>3] |= 1<<(i&7) }
+	}
+	mark(0,sb.FirstMFT)
+	for _,m := range mfts(fs) { mark(sb.FirstMFT,sb.FirstMFT+uint64(m.Head.Num_BLK)) }
+	for _,f := range md.Entries {
+		for _,s := range f.Chain { mark(s.Begin_BLK,s.End_BLK) }
+	}
+	
+	r := &bitmapDump{Blocks:n}
+	for i := uint64(0); i<n; i++ {
+		if bit(buf,i) { r.Used++ }
+	}
+	r.Free = n-r.Used
+	r.UsedRuns = runs(n,func(i uint64) bool { return bit(buf,i) })
+	for _,fr := range runs(n,func(i uint64) bool { return !bit(buf,i) }) {
+		if fr.End-fr.Begin>r.LargestFreeRun { r.LargestFreeRun = fr.End-fr.Begin }
+	}
+	r.Leaked = runs(n,func(i uint64) bool { return bit(buf,i) && !bit(ref,i) })
+	r.Missing = runs(n,func(i uint64) bool { return !bit(buf,i) && bit(ref,i) })
+	return r,nil
+}
+func printRuns(title string, rs []blockRun) {
+	if len(rs)==0 { return }
+	fmt.Printf("  %s:",title)
+	for i,br := range rs {
+		if i%8==0 { fmt.Print("\n   ") }
+		fmt.Printf(" %d-%d",br.Begin,br.End-1)
+	}
+	fmt.Println()
+}
+func (r *bitmapDump) print() {
+	fmt.Printf("Bitmap: %d blocks, %d used, %d free (%.1f%% used), largest free run %d\n",
+		r.Blocks,r.Used,r.Free,float64(r.Used)*100/float64(r.Blocks),r.LargestFreeRun)
+	printRuns("used",r.UsedRuns)
+	printRuns("LEAKED (used but unreferenced)",r.Leaked)
+	printRuns("MISSING (referenced but free)",r.Missing)
+}
+
+/* ---------------- Files ---------------- */
+
+func resolve(fs *fs1.FileSystem, name string) (*ods.MFTE,error) {
+	var ii,i uint32
+	if _,e := fmt.Sscanf(name,"%d:%d",&ii,&i); e==nil && !strings.Contains(name,"/") {
+		return fs.MMFT.GetEntry(ii,i)
+	}
+	fi,e := fs1api.New(fs).Stat(name)
+	if e!=nil { return nil,e }
+	return fi.Sys().(*ods.MFTE),nil
+}
+
+type dirEntry struct{
+	Name     string
+	File_MFT uint32
+	File_IDX uint32
+	Cookie   uint64
+	Type     string
+}
+type dirSegment struct{
+	Index   int64
+	Used    int
+	Entries []dirEntry
+}
+type dirDump struct{
+	File     string
+	SegSize  uint32
+	Segments []dirSegment
+}
+
+func dumpDir(fs *fs1.FileSystem, name string) (*dirDump,error) {
+	mfte,e := resolve(fs,name)
+	if e!=nil { return nil,e }
+	d := fs.GetFile(mfte.File_MFT,mfte.File_IDX).AsDirectoryLite()
+	r := &dirDump{File:name,SegSize:fs.SB.DirSegSize}
+	for i := int64(0); true; i++ {
+		ents,e := d.ReadDir(i)
+		if e!=nil { break }
+		seg := dirSegment{Index:i,Used:1}
+		for _,ent := range ents {
+			seg.Used += d.Names.EntrySize(ent.Name)
+			v := ent.Value
+			seg.Entries = append(seg.Entries,dirEntry{ent.Name,v.File_MFT,v.File_IDX,v.Cookie,ftName(v.FileType)})
+		}
+		r.Segments = append(r.Segments,seg)
+	}
+	return r,nil
+}
+func (r *dirDump) print() {
+	fmt.Printf("Directory %s: %d segments of %d bytes\n",r.File,len(r.Segments),r.SegSize)
+	for _,seg := range r.Segments {
+		fmt.Printf("  segment %d: %d entries, %d bytes used\n",seg.Index,len(seg.Entries),seg.Used)
+		for _,ent := range seg.Entries {
+			fmt.Printf("    %-24s %d:%d cookie %016x %s\n",ent.Name,ent.File_MFT,ent.File_IDX,ent.Cookie,ent.Type)
+		}
+	}
+}
+
+type mdeRecord struct{
+	Index int64
+	ods.MetaDataEntry
+	TypeName string
+	Value    string
+}
+type mdfDump struct{
+	File    string
+	Mdf_MFT uint32
+	Mdf_IDX uint32
+	Records []mdeRecord
+}
+
+func decodeMDE(mde *ods.MetaDataEntry) (string,string) {
+	switch mde.Type {
+	case 0: return "unused",""
+	case ods.MDE_Free: return "free",""
+	case ods.MDE_BirthTime: return "birth-time",mdeTime(mde)
+	case ods.MDE_WriteTime: return "write-time",mdeTime(mde)
+	case ods.MDE_AccessTime: return "access-time",mdeTime(mde)
+	case ods.MDE_ACE: return "ace",fmt.Sprintf("%v rights 0x%08x",security.SID(mde.Data4),mde.Data3)
+	case ods.MDE_Owner: return "owner",security.SID(mde.Data4).String()
+	case ods.MDE_Group: return "group",security.SID(mde.Data4).String()
+	case ods.MDE_Rdev: return "rdev",fmt.Sprintf("%d,%d",fs1api.DevMajor(mde.Data4),fs1api.DevMinor(mde.Data4))
+	}
+	return fmt.Sprintf("0x%02x",mde.Type),""
+}
+func mdeTime(mde *ods.MetaDataEntry) string {
+	return time.Unix(int64(mde.Data4),int64(mde.Data3)).String()
+}
+
+func dumpMDF(fs *fs1.FileSystem, name string) (*mdfDump,error) {
+	mfte,e := resolve(fs,name)
+	if e!=nil { return nil,e }
+	if mfte.Mdf_IDX==0 { return nil,fmt.Errorf("%s has no metadata file",name) }
+	mdf := fs.GetFile(mfte.Mdf_MFT,mfte.Mdf_IDX)
+	size,e := mdf.Size()
+	if e!=nil { return nil,e }
+	r := &mdfDump{File:name,Mdf_MFT:mfte.Mdf_MFT,Mdf_IDX:mfte.Mdf_IDX}
+	buf := &dskimg.FixedIO{make([]byte,16),0}
+	for i := int64(0); i<size/16; i++ {
+		e = buf.ReadIndex(i,mdf)
+		if e!=nil { return nil,e }
+		rec := mdeRecord{Index:i}
+		e = binary.Read(buf,binary.BigEndian,&rec.MetaDataEntry)
+		if e!=nil { return nil,e }
+		rec.TypeName,rec.Value = decodeMDE(&rec.MetaDataEntry)
+		r.Records = append(r.Records,rec)
+	}
+	return r,nil
+}
+func (r *mdfDump) print() {
+	fmt.Printf("Metadata of %s (file %d:%d): %d records\n",r.File,r.Mdf_MFT,r.Mdf_IDX,len(r.Records))
+	for _,rec := range r.Records {
+		fmt.Printf("  [%3d] %-12s %s\n",rec.Index,rec.TypeName,rec.Value)
+	}
+}
+
+/* ---------------- main ---------------- */
+
+type printer interface{ print() }
+
+type allDump struct{
+	Superblock *superReport
+	Bitmap     *bitmapDump
+	MFT        *mftDump
+}
+func (r *allDump) print() {
+	r.Superblock.print()
+	r.Bitmap.print()
+	r.MFT.print()
+}
+
+func main(){
+	flag.Parse()
+	dbgpkg.TraceOn = *trace
+	if *image=="" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	f,e := dskimg.OpenImage(*image,*slow,os.O_RDONLY)
+	if e!=nil { fail(e) }
+	defer f.Close()
+	fs := new(fs1.FileSystem)
+	fs.Device = f
+	fs.NoSync = true
+	fs.ReadOnly = true
+	fs.ForceLock = *force
+	e = fs.LoadFileSystem(int64(*offset))
+	if e!=nil { fail(e) }
+	
+	var out []printer
+	cmd := flag.Arg(0)
+	switch cmd {
+	case "","all":
+		md := dumpMFT(fs)
+		bm,e := dumpBitmap(fs,md)
+		if e!=nil { fail(e) }
+		out = []printer{&allDump{dumpSuper(fs),bm,md}}
+	case "super":
+		out = []printer{dumpSuper(fs)}
+	case "mft":
+		out = []printer{dumpMFT(fs)}
+	case "bitmap":
+		bm,e := dumpBitmap(fs,dumpMFT(fs))
+		if e!=nil { fail(e) }
+		out = []printer{bm}
+	case "dir","mdf":
+		if flag.NArg()<2 { fail(fmt.Errorf("usage: fs1dump %s <path|MFT:IDX>",cmd)) }
+		for _,name := range flag.Args()[1:] {
+			var p printer
+			if cmd=="dir" {
+				p,e = dumpDir(fs,name)
+			} else {
+				p,e = dumpMDF(fs,name)
+			}
+			if e!=nil { fail(e) }
+			out = append(out,p)
+		}
+	default:
+		fail(fmt.Errorf("unknown command %s (super, mft, bitmap, dir, mdf)",cmd))
+	}
+	
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("","  ")
+		var v interface{} = out
+		if len(out)==1 { v = out[0] }
+		e = enc.Encode(v)
+		if e!=nil { fail(e) }
+		return
+	}
+	for _,p := range out { p.print() }
+}
@@ -25,9 +25,14 @@
 package main
 
 import "os"
+import "io"
+import "strings"
+import "compress/gzip"
+import "github.com/maxymania/anyfs/dskimg/fs1api"
 //import "github.com/maxymania/anyfs/dskimg/bitmap"
+import "github.com/maxymania/anyfs/dskimg"
 import "github.com/maxymania/anyfs/dskimg/fs1"
-//import _ "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/dskimg/ods"
 import "fmt"
 import "flag"
 import dbgpkg "github.com/maxymania/anyfs/debug"
@@ -46,6 +51,8 @@ const (
 )
 
 var image = flag.String("image", "", "The file-system image to be formatted")
+var slow = flag.String("slow", "", "An image for the slow tier; -image becomes the fast tier")
+var mirror = flag.String("mirror", "", "Comma separated images, that mirror -image (RAID1); their content is overwritten")
 var bzk = flag.Int("bsize", 4, fmt.Sprint("block size (in kb) (valid is ",BZ_0,BZ_1,BZ_2,BZ_3,BZ_4,BZ_5,BZ_6,BZ_7,BZ_8,BZ_9,")"))
 var bom = flag.String("bsord", "K", "M = 'block size in MB instead of KB';  * = 'block size in byte instead of KB'")
 
@@ -54,6 +61,12 @@ var mom = flag.String("mftord", "K", "M = 'mft size in MB instead of KB';  * = '
 
 var offset = flag.Int("sbo",512,"Superblock Offset")
 
+var populate = flag.String("populate", "", "Populate the new file system from a directory or a tar archive (.tar, .tar.gz, .tgz or - for stdin)")
+
+var names = flag.String("names", "", "Filename policy, comma separated: casefold, nfc, utf8, longnames")
+
+var force = flag.Bool("force", false, "Format even if the image is in use")
+
 var trace = flag.Bool("trace", false, "print deep tracing messages")
 
 func main(){
@@ -63,7 +76,7 @@ func main(){
 		flag.PrintDefaults()
 		return
 	}
-	f,e := os.OpenFile(*image,os.O_RDWR,0666) // 
+	f,e := openImage()
 	if e!=nil {
 		fmt.Println("Error: ",e)
 		flag.PrintDefaults()
@@ -97,14 +110,77 @@ func main(){
 	}
 	mkfs.MftBlocks += mkfs.BlockSize-1
 	mkfs.MftBlocks /= mkfs.BlockSize
+	if *names!="" {
+		for _,n := range strings.Split(*names,",") {
+			switch n {
+			case "casefold": mkfs.NameFlags |= ods.NAME_CASEFOLD
+			case "nfc": mkfs.NameFlags |= ods.NAME_NFC
+			case "utf8": mkfs.NameFlags |= ods.NAME_UTF8
+			case "longnames": mkfs.NameFlags |= ods.NAME_LONG
+			default:
+				fmt.Println("Error: unknown filename policy",n)
+				flag.PrintDefaults()
+				return
+			}
+		}
+	}
+	if c,ok := f.(*dskimg.Concat); ok {
+		_,base := c.Part(1)
+		mkfs.FastBlocks = uint64(base)/uint64(mkfs.BlockSize)
+	}
 	fs := new(fs1.FileSystem)
 	fs.Device = f
 	fs.NoSync = true /* We don't need auto-FSYNC */
+	fs.ForceLock = *force
 	err := fs.Mkfs(int64(*offset),mkfs)
 	if err!=nil {
 		fmt.Println("Error: ",err)
 		flag.PrintDefaults()
 		return
 	}
+	if *populate=="" { return }
+	err = fs.Mount(false)
+	if err==nil { err = populateFrom(fs1api.New(fs),*populate) }
+	err2 := fs.Unmount()
+	if err==nil { err = err2 }
+	if err!=nil {
+		fmt.Println("Error: ",err)
+		os.Exit(1)
+	}
+}
+
+/* Opens the image, or creates a mirror on it and the -mirror images. */
+func openImage() (dskimg.DeviceCloser,error) {
+	if *mirror=="" { return dskimg.OpenImage(*image,*slow,os.O_RDWR) }
+	if *slow!="" { return nil,fmt.Errorf("-mirror can not be combined with -slow") }
+	m,e := dskimg.OpenMirror(append([]string{*image},strings.Split(*mirror,",")...),os.O_RDWR,true)
+	if e!=nil { return nil,e }
+	return m,nil
+}
+
+func skipped(name string, reason error) {
+	fmt.Println("Skipped",name+":",reason)
+}
+
+func populateFrom(a *fs1api.FS, src string) error {
+	if src!="-" {
+		fi,e := os.Stat(src)
+		if e!=nil { return e }
+		if fi.IsDir() { return a.ImportDir("/",src,skipped) }
+	}
+	var r io.Reader = os.Stdin
+	if src!="-" {
+		f,e := os.Open(src)
+		if e!=nil { return e }
+		defer f.Close()
+		r = f
+	}
+	if strings.HasSuffix(src,".gz") || strings.HasSuffix(src,".tgz") {
+		z,e := gzip.NewReader(r)
+		if e!=nil { return e }
+		defer z.Close()
+		r = z
+	}
+	return a.ImportTar("/",r,skipped)
 }
 
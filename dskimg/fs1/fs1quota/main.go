@@ -0,0 +1,122 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import "os"
+import "github.com/maxymania/anyfs/dskimg"
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/security"
+import "fmt"
+import "flag"
+import "sort"
+import dbgpkg "github.com/maxymania/anyfs/debug"
+
+var image = flag.String("image", "", "The file-system image")
+var slow = flag.String("slow", "", "The slow tier of a tiered image")
+var offset = flag.Int("sbo",512,"Superblock Offset")
+
+var sid = flag.String("sid", "", "The SID to operate on (uid:N, gid:N, type:N or SID:N-N)")
+var set = flag.Bool("set", false, "Set the limits of -sid to -blocks and -files")
+var blocks = flag.Uint64("blocks", 0, "Block limit (0 = unlimited)")
+var files = flag.Uint64("files", 0, "File limit (0 = unlimited)")
+var check = flag.Bool("check", false, "Recompute the usage of all SIDs from the files on the image")
+
+var force = flag.Bool("force", false, "Open the image even if it is in use")
+
+var trace = flag.Bool("trace", false, "print deep tracing messages")
+
+func limit(u uint64) string {
+	if u==0 { return "-" }
+	return fmt.Sprint(u)
+}
+
+func main(){
+	flag.Parse()
+	dbgpkg.TraceOn = *trace
+	if *image=="" || (*set && *sid=="") {
+		flag.PrintDefaults()
+		return
+	}
+	mode := os.O_RDONLY
+	if *set || *check { mode = os.O_RDWR }
+	f,e := dskimg.OpenImage(*image,*slow,mode)
+	if e!=nil {
+		fmt.Println("Error: ",e)
+		os.Exit(1)
+	}
+	defer f.Close()
+	fs := new(fs1.FileSystem)
+	fs.Device = f
+	fs.NoSync = true
+	fs.ReadOnly = !(*set || *check)
+	fs.ForceLock = *force
+	e = fs.LoadFileSystem(int64(*offset))
+	if e!=nil {
+		fmt.Println("Error: ",e)
+		os.Exit(1)
+	}
+	if fs.Quota==nil {
+		fmt.Println("Error: the image has no quota file")
+		os.Exit(1)
+	}
+	if *check {
+		e = fs.QuotaCheck()
+		if e==nil { e = fs.Sync() }
+		if e!=nil {
+			fmt.Println("Error: ",e)
+			os.Exit(1)
+		}
+	}
+	if *set {
+		s,e := security.ParseSID(*sid)
+		if e!=nil {
+			fmt.Println("Error: bad SID",*sid)
+			os.Exit(1)
+		}
+		e = fs.Quota.SetLimits(s,*blocks,*files)
+		if e!=nil {
+			fmt.Println("Error: ",e)
+			os.Exit(1)
+		}
+		return
+	}
+	list := fs.Quota.List()
+	if *sid!="" {
+		s,e := security.ParseSID(*sid)
+		if e!=nil {
+			fmt.Println("Error: bad SID",*sid)
+			os.Exit(1)
+		}
+		qe,_ := fs.Quota.Get(s)
+		list = list[:0]
+		list = append(list,qe)
+	}
+	sort.Slice(list,func(i,j int) bool { return list[i].Subject<list[j].Subject })
+	fmt.Printf("%-24s %12s %12s %10s %10s\n","SID","blocks","limit","files","limit")
+	for _,qe := range list {
+		fmt.Printf("%-24s %12d %12s %10d %10s\n",qe.Subject,qe.Blocks,limit(qe.BlockLimit),qe.Files,limit(qe.FileLimit))
+	}
+	fmt.Println("Block size:",fs.SB.BlockSize)
+}
@@ -30,14 +30,14 @@ import "github.com/maxymania/anyfs/security"
 import "time"
 
 type MetaDataFile struct{
-	Backing *File
+	Backing *AutoGrowingFile
 	Memory  *ods.MetaDataMemory
 	Dirty   bool
 	DirtySync sync.Mutex
 }
 
 func (m *MetaDataFile) init(fs *FileSystem, ii, i uint32) error{
-	m.Backing = &File{fs,ii,i}
+	m.Backing = &AutoGrowingFile{&File{fs,ii,i}}
 	m.Memory  = new(ods.MetaDataMemory)
 	m.Memory.Init()
 	sz,err := m.Backing.Size()
@@ -50,6 +50,7 @@ func (m *MetaDataFile) flush() {
 	m.DirtySync.Lock()
 	defer m.DirtySync.Unlock()
 	if !m.Dirty { return }
+	if m.Backing.FS.ReadOnly { return }
 	m.Memory.SerializeTime(m.Backing)
 	m.Dirty = false
 }
@@ -66,5 +67,50 @@ func (m *MetaDataFile) initialContent() {
 func (m *MetaDataFile) PutAcl(ace security.AccessControlEntry) {
 	m.Memory.PutAcl(ace,m.Backing)
 }
+func (m *MetaDataFile) Owner() (security.SID,bool) {
+	return m.Memory.Owner()
+}
+func (m *MetaDataFile) SetOwner(sid security.SID) error {
+	return m.Memory.PutOwner(sid,m.Backing)
+}
+func (m *MetaDataFile) Group() (security.SID,bool) {
+	return m.Memory.Group()
+}
+func (m *MetaDataFile) SetGroup(sid security.SID) error {
+	return m.Memory.PutGroup(sid,m.Backing)
+}
+func (m *MetaDataFile) Rdev() (uint64,bool) {
+	return m.Memory.Rdev()
+}
+func (m *MetaDataFile) SetRdev(rdev uint64) error {
+	return m.Memory.PutRdev(rdev,m.Backing)
+}
+/* Sets the time stamps of the file; zero times are left unchanged. */
+func (m *MetaDataFile) SetTimes(birth, write, access time.Time) error {
+	if m.Backing.FS.ReadOnly { return EReadOnly }
+	if !birth.IsZero() { m.Memory.BirthTimeSet(birth) }
+	if !write.IsZero() { m.Memory.WriteTimeSet(write) }
+	if !access.IsZero() { m.Memory.AccessTimeSet(access) }
+	m.Memory.SerializeTime(m.Backing)
+	return nil
+}
 
+/* The access time is rewritten at most once per relatime, unless the file has been written since. */
+const relatime = 24*time.Hour
 
+/*
+ Records a read of the file at 'now', in the manner of relatime: the access
+ time is only updated, if it is not later than the write time or older than a
+ day. It is written back with the other cached metadata.
+ */
+func (m *MetaDataFile) Accessed(now time.Time) {
+	if m.Backing.FS.ReadOnly { return }
+	if at := m.Memory.AccessTime(); at!=nil {
+		wt := m.Memory.WriteTime()
+		if (wt==nil || at.After(*wt)) && now.Sub(*at)<relatime { return }
+	}
+	m.DirtySync.Lock()
+	defer m.DirtySync.Unlock()
+	m.Memory.AccessTimeSet(now)
+	m.Dirty = true
+}
@@ -0,0 +1,139 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1
+
+import "github.com/maxymania/anyfs/dskimg/ods"
+
+/*
+ Files, that have lost their last link while they were open, are kept on
+ the orphan list (the special file FS_SPECIAL_ORPHANS) with a reference
+ count of 0 until they are released. Orphans left behind by a crash are
+ deleted by Mount.
+ */
+type Orphans struct{
+	List    ods.OrphanList
+	Backing *AutoGrowingFile
+}
+
+func (f *FileSystem) loadOrphans() error {
+	f.opens = make(map[uint64]int)
+	mfte,e := f.MMFT.GetEntry(f.Temp,FS_SPECIAL_ORPHANS)
+	if e!=nil || mfte.FileType!=ods.FT_ORPHANS {
+		f.Orphans = nil /* Old image: files are deleted on their last unlink. */
+		return nil
+	}
+	o := new(Orphans)
+	o.Backing = &AutoGrowingFile{f.GetFile(f.Temp,FS_SPECIAL_ORPHANS)}
+	o.List.Init()
+	o.List.LoadMax(o.Backing,mfte.FileSize)
+	f.Orphans = o
+	return nil
+}
+
+/* Marks a file as open. Every Hold must be followed by a Release. */
+func (f *FileSystem) Hold(ii, i uint32) {
+	f.openLck.Lock()
+	defer f.openLck.Unlock()
+	f.opens[join32to64(ii,i)]++
+}
+
+/* Drops an open reference of a file. Deletes the file, if it was the last one of an orphan. */
+func (f *FileSystem) Release(ii, i uint32) error {
+	f.openLck.Lock()
+	key := join32to64(ii,i)
+	n := f.opens[key]-1
+	if n>0 {
+		f.opens[key] = n
+	} else {
+		delete(f.opens,key)
+	}
+	f.openLck.Unlock()
+	if n>0 || f.Orphans==nil || f.ReadOnly { return nil }
+	if _,ok := f.Orphans.List.Get(ii,i); !ok { return nil }
+	return f.purgeOrphan(ii,i)
+}
+func (f *FileSystem) isOpen(ii, i uint32) bool {
+	f.openLck.Lock()
+	defer f.openLck.Unlock()
+	return f.opens[join32to64(ii,i)]>0
+}
+
+/*
+ Called by Decrement for open files. If this is the last link, the file is
+ put on the orphan list and its reference count is set to 0; then true is
+ returned. Otherwise, the caller has to decrement as usual.
+ */
+func (f *FileSystem) orphanize(ii, i uint32) (bool,error) {
+	f.orphanLck.Lock()
+	defer f.orphanLck.Unlock()
+	if !f.isOpen(ii,i) { return false,nil } /* Released in the meantime. */
+	mfte,e := f.MMFT.GetEntry(ii,i)
+	if e!=nil || mfte.RefCount!=1 { return false,e }
+	
+	/* Record the orphan first, so a crash can not leak the file. */
+	oe := ods.OrphanEntry{mfte.File_MFT,mfte.File_IDX,mfte.Cookie}
+	e = f.Orphans.List.Add(oe,f.Orphans.Backing)
+	if e!=nil { return false,e }
+	
+	unlock := f.lockFile(ii,i)
+	mfte,e = f.MMFT.GetEntry(ii,i)
+	if e==nil && mfte.RefCount==1 {
+		mfte.RefCount = 0
+		e = f.MMFT.PutEntry(mfte)
+		unlock()
+		return e==nil,e
+	}
+	unlock()
+	f.Orphans.List.Remove(ii,i,f.Orphans.Backing)
+	return false,e
+}
+
+/* Deletes an orphan, unless it has been linked again. */
+func (f *FileSystem) purgeOrphan(ii, i uint32) error {
+	var owned []ods.FileRef
+	defer func() { f.dropOwned(owned) }() /* After orphanLck is released. */
+	f.orphanLck.Lock()
+	defer f.orphanLck.Unlock()
+	oe,ok := f.Orphans.List.Get(ii,i)
+	if !ok { return nil }
+	mfte,e := f.MMFT.GetEntry(ii,i)
+	if e==nil && mfte.Cookie==oe.Cookie && mfte.RefCount==0 {
+		owned,e = f.remove(ii,i)
+		if e!=nil { return e }
+	}
+	return f.Orphans.List.Remove(ii,i,f.Orphans.Backing)
+}
+
+/* Deletes the orphans left behind by a crash or an unclean unmount. */
+func (f *FileSystem) purgeOrphans() error {
+	if f.Orphans==nil { return nil }
+	var err error
+	for _,oe := range f.Orphans.List.List() {
+		if f.isOpen(oe.File_MFT,oe.File_IDX) { continue }
+		e := f.purgeOrphan(oe.File_MFT,oe.File_IDX)
+		if e!=nil { err = e }
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1
+
+import "io"
+import "bytes"
+import "errors"
+import "encoding/binary"
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/security"
+
+var EStale = errors.New("Stale file reference")
+
+/*
+ Properties: the typed properties of a file (see package lcr) are stored in a
+ property file (FT_PROPS), which is referenced by its metadata file. Every BLOB
+ value is a file of its own (FT_BLOB). Both are owned by the file; they are
+ charged to its owner and group and deleted along with it.
+ 
+ Access to the properties of a file must be synchronized by the caller.
+ */
+
+func refOf(mfte *ods.MFTE) ods.FileRef {
+	return ods.FileRef{mfte.File_MFT,mfte.File_IDX,uint16(mfte.Cookie&0xffff)}
+}
+
+// Returns the reference to the file.
+func (f *File) Ref() (ods.FileRef,error) {
+	mfte,e := f.GetMFTE()
+	if e!=nil { return ods.FileRef{},e }
+	return refOf(mfte),nil
+}
+
+/* Returns the file of a reference, if it is still valid and of type 'ft'. */
+func (f *FileSystem) Deref(r ods.FileRef, ft uint8) (*File,error) {
+	mfte,e := f.MMFT.GetEntry(r.File_MFT,r.File_IDX)
+	if e!=nil { return nil,e }
+	if refOf(mfte)!=r || mfte.FileType!=ft { return nil,EStale }
+	return f.GetFile(r.File_MFT,r.File_IDX),nil
+}
+
+func readProperties(pf *File) ([]ods.Property,error) {
+	size,e := pf.Size()
+	if e!=nil { return nil,e }
+	return ods.ReadProperties(io.NewSectionReader(pf,0,size))
+}
+
+func (f *File) propertyFile() (*File,bool,error) {
+	mdf,e := f.GetMDF()
+	if e!=nil { return nil,false,e }
+	r,ok := mdf.Memory.PropertyFile()
+	if !ok { return nil,false,nil }
+	pf,e := f.FS.Deref(r,ods.FT_PROPS)
+	return pf,true,e
+}
+
+// Returns the properties of the file.
+func (f *File) Properties() ([]ods.Property,error) {
+	pf,ok,e := f.propertyFile()
+	if !ok || e!=nil { return nil,e }
+	return readProperties(pf)
+}
+
+/*
+ Returns a stamp of the properties of the file: the MFT entry and the full
+ cookie of the property file, or "" if there is none. As SetProperties always
+ writes a new property file, the stamp changes with every update.
+ */
+func (f *File) PropertyStamp() (string,error) {
+	mdf,e := f.GetMDF()
+	if e!=nil { return "",e }
+	r,ok := mdf.Memory.PropertyFile()
+	if !ok { return "",nil }
+	mfte,e := f.FS.MMFT.GetEntry(r.File_MFT,r.File_IDX)
+	if e!=nil { return "",e }
+	if refOf(mfte)!=r { return "",EStale }
+	var b [16]byte
+	binary.BigEndian.PutUint32(b[0:],r.File_MFT)
+	binary.BigEndian.PutUint32(b[4:],r.File_IDX)
+	binary.BigEndian.PutUint64(b[8:],mfte.Cookie)
+	return string(b[:]),nil
+}
+
+/*
+ Replaces the properties of the file. Blobs, that are no longer referenced,
+ are deleted.
+
+ The properties are written to a new property file, which replaces the old
+ one once it is durable, so a crash leaves either the old or the new
+ properties.
+ */
+func (f *File) SetProperties(props []ods.Property) error {
+	if f.FS.ReadOnly { return EReadOnly }
+	buf := new(bytes.Buffer)
+	e := ods.WriteProperties(props,buf)
+	if e!=nil { return e }
+	pf,ok,e := f.propertyFile()
+	if e!=nil { return e }
+	var old []ods.Property
+	var drop []ods.FileRef
+	if ok {
+		old,e = readProperties(pf)
+		if e!=nil { return e }
+		r,e := pf.Ref()
+		if e!=nil { return e }
+		drop = append(drop,r)
+	}
+	npf,e := f.createOwned(ods.FT_PROPS)
+	if e!=nil { return e }
+	_,e = (&AutoGrowingFile{npf}).WriteAt(buf.Bytes(),0)
+	if e==nil { e = npf.Sync(true) }
+	if e==nil { e = f.setPropertyFile(npf) }
+	if e!=nil {
+		f.FS.Decrement(npf.MFT,npf.FID)
+		return e
+	}
+	/* The old file must survive, until the switch is durable. */
+	e = npf.Sync(true)
+	if e!=nil { return e }
+	keep := make(map[ods.FileRef]bool)
+	for _,r := range blobRefs(props) { keep[r] = true }
+	for _,r := range blobRefs(old) {
+		if !keep[r] { drop = append(drop,r) }
+	}
+	f.FS.dropOwned(drop)
+	return nil
+}
+func (f *File) setPropertyFile(pf *File) error {
+	mdf,e := f.GetMDF()
+	if e!=nil { return e }
+	r,e := pf.Ref()
+	if e!=nil { return e }
+	return mdf.Memory.PutPropertyFile(r,mdf.Backing)
+}
+
+/*
+ Creates an empty blob for a property of the file. Once it is stored with
+ SetProperties, it is owned by the file; until then, the caller has to delete
+ it with DropBlobs on failure.
+ */
+func (f *File) CreateBlob() (*File,ods.FileRef,error) {
+	if f.FS.ReadOnly { return nil,ods.FileRef{},EReadOnly }
+	b,e := f.createOwned(ods.FT_BLOB)
+	if e!=nil { return nil,ods.FileRef{},e }
+	r,e := b.Ref()
+	if e!=nil {
+		f.FS.Decrement(b.MFT,b.FID)
+		return nil,r,e
+	}
+	return b,r,nil
+}
+
+/* Creates a file, that is charged to the owner and group of f and inherits its storage policy. */
+func (f *File) createOwned(ft uint8) (*File,error) {
+	var owner,group security.SID
+	policy := uint8(ods.POLICY_NONE)
+	mdf,e := f.GetMDF()
+	if e==nil {
+		owner,_ = mdf.Owner()
+		group,_ = mdf.Group()
+		policy = mdf.Memory.Policy()
+	}
+	nf,e := f.FS.CreateFileOwned(ft,owner,group)
+	if e!=nil { return nil,e }
+	if policy!=ods.POLICY_NONE {
+		if nmdf,e := nf.GetMDF(); e==nil { nmdf.Memory.PutPolicy(policy,nmdf.Backing) }
+	}
+	return nf,nil
+}
+
+func blobRefs(props []ods.Property) (refs []ods.FileRef) {
+	for _,p := range props {
+		for _,v := range p.Values {
+			if v.Type==ods.PROP_BLOB { refs = append(refs,v.Blob) }
+		}
+	}
+	return
+}
+
+/* Returns the files owned by a file, that is about to lose its last link. */
+func (f *FileSystem) ownedFiles(ii, i uint32) []ods.FileRef {
+	mfte,e := f.MMFT.GetEntry(ii,i)
+	if e!=nil || mfte.RefCount>1 || mfte.Mdf_IDX==0 { return nil }
+	pf,ok,e := f.GetFile(ii,i).propertyFile()
+	if !ok || e!=nil { return nil }
+	r,_ := pf.Ref()
+	props,_ := readProperties(pf)
+	return append(blobRefs(props),r)
+}
+/* Deletes owned files. Open blobs become orphans. */
+func (f *FileSystem) dropOwned(refs []ods.FileRef) {
+	for _,r := range refs {
+		mfte,e := f.MMFT.GetEntry(r.File_MFT,r.File_IDX)
+		if e!=nil || refOf(mfte)!=r { continue }
+		f.Decrement(r.File_MFT,r.File_IDX)
+	}
+}
+
+/* Deletes blobs, that have been created by CreateBlob, but are not stored with SetProperties. */
+func (f *FileSystem) DropBlobs(refs []ods.FileRef) {
+	f.dropOwned(refs)
+}
@@ -0,0 +1,174 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1
+
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/security"
+
+/*
+ Per-SID quota accounting. The quota records are stored in the special
+ file FS_SPECIAL_QUOTA, which is created by Mkfs.
+ */
+type Quota struct{
+	Table   ods.QuotaTable
+	Backing *AutoGrowingFile
+}
+
+func (f *FileSystem) loadQuota() error {
+	mfte,e := f.MMFT.GetEntry(f.Temp,FS_SPECIAL_QUOTA)
+	if e!=nil || mfte.FileType!=ods.FT_QUOTA {
+		f.Quota = nil /* Old image, no quota support. */
+		return nil
+	}
+	q := new(Quota)
+	q.Backing = &AutoGrowingFile{f.GetFile(f.Temp,FS_SPECIAL_QUOTA)}
+	q.Table.Init()
+	q.Table.LoadMax(q.Backing,mfte.FileSize)
+	f.Quota = q
+	return nil
+}
+
+// The nil-Quota accepts everything.
+func (q *Quota) charge(sids []security.SID, blocks, files int64, enforce bool) error {
+	if q==nil { return nil }
+	return q.Table.Charge(sids,blocks,files,enforce,q.Backing)
+}
+
+func (q *Quota) SetLimits(sid security.SID, blocks, files uint64) error {
+	if q.Backing.FS.ReadOnly { return EReadOnly }
+	return q.Table.SetLimits(sid,blocks,files,q.Backing)
+}
+func (q *Quota) SetUsage(sid security.SID, blocks, files uint64) error {
+	if q.Backing.FS.ReadOnly { return EReadOnly }
+	return q.Table.SetUsage(sid,blocks,files,q.Backing)
+}
+func (q *Quota) Get(sid security.SID) (ods.QuotaEntry,bool) {
+	return q.Table.Get(sid)
+}
+func (q *Quota) List() []ods.QuotaEntry {
+	return q.Table.List()
+}
+
+/* Returns the SIDs, the file (given by the head of its MFT chain) is accounted to. */
+func (f *FileSystem) quotaSubjects(ii, i uint32) []security.SID {
+	if f.Quota==nil { return nil }
+	mfte,e := f.MMFT.GetEntry(ii,i)
+	if e!=nil || mfte.Mdf_IDX==0 { return nil }
+	mdf,e := f.GetMDF(ii,i)
+	if e!=nil { return nil }
+	sids := make([]security.SID,0,2)
+	if sid,ok := mdf.Owner(); ok { sids = append(sids,sid) }
+	if sid,ok := mdf.Group(); ok { sids = append(sids,sid) }
+	if len(sids)==0 { return nil }
+	return sids
+}
+func (f *FileSystem) chainBlocks(ii, i uint32) uint64 {
+	gec,e := f.MMFT.GetEntryChainLL(ii,i)
+	if e!=nil { return 0 }
+	return gec.TotalBLK
+}
+
+/* Returns the SIDs of 'a', that are not in 'b'. */
+func sidsMinus(a, b []security.SID) []security.SID {
+	var r []security.SID
+	outer:
+	for _,s := range a {
+		if s==0 { continue }
+		for _,t := range b { if s==t { continue outer } }
+		r = append(r,s)
+	}
+	return r
+}
+
+/*
+ Changes the owner and the group of a file and moves its quota charge to
+ them. A SID of 0 leaves the owner or the group unchanged.
+ */
+func (f *FileSystem) Chown(ii, i uint32, owner, group security.SID) error {
+	if f.ReadOnly { return EReadOnly }
+	mdf,e := f.GetMDF(ii,i)
+	if e!=nil { return e }
+	oldOwner,_ := mdf.Owner()
+	oldGroup,_ := mdf.Group()
+	if owner==0 { owner = oldOwner }
+	if group==0 { group = oldGroup }
+	if owner==oldOwner && group==oldGroup { return nil }
+	
+	olds := []security.SID{oldOwner,oldGroup}
+	news := []security.SID{owner,group}
+	blocks := int64(f.chainBlocks(ii,i))
+	gain := sidsMinus(news,olds)
+	e = f.Quota.charge(gain,blocks,1,true)
+	if e!=nil { return e }
+	f.Quota.charge(sidsMinus(olds,news),-blocks,-1,false)
+	
+	if owner!=oldOwner { e = mdf.SetOwner(owner) }
+	if e==nil && group!=oldGroup { e = mdf.SetGroup(group) }
+	return e
+}
+
+/*
+ Recomputes the usage of all SIDs from the files on the image, like
+ quotacheck. This accounts files, that were created before the image had a
+ quota file, and repairs charges lost in a crash. Every MFT entry is read, and
+ the metadata file of every file is loaded. The image must not be modified
+ concurrently.
+ */
+func (f *FileSystem) QuotaCheck() error {
+	if f.Quota==nil { return nil }
+	if f.ReadOnly { return EReadOnly }
+	type usage struct{ blocks,files uint64 }
+	use := make(map[security.SID]*usage)
+	
+	f.MMFT.Mutex.Lock()
+	mfts := make([]*ods.MFT,0,len(f.MMFT.MftByID))
+	for _,m := range f.MMFT.MftByID { mfts = append(mfts,m) }
+	f.MMFT.Mutex.Unlock()
+	
+	for _,m := range mfts {
+		ii := m.Head.MFT_ID
+		for i := uint32(1); i<m.Size; i++ {
+			mfte,e := m.GetEntry(i)
+			/* Only heads of chains, that have a metadata file. */
+			if e!=nil || mfte.First_IDX!=i || mfte.Mdf_IDX==0 { continue }
+			blocks := f.chainBlocks(ii,i)
+			for _,sid := range f.quotaSubjects(ii,i) {
+				u := use[sid]
+				if u==nil { u = new(usage); use[sid] = u }
+				u.blocks += blocks
+				u.files++
+			}
+		}
+	}
+	/* SIDs, that own nothing anymore. */
+	for _,qe := range f.Quota.List() {
+		if _,ok := use[qe.Subject]; !ok { use[qe.Subject] = new(usage) }
+	}
+	for sid,u := range use {
+		e := f.Quota.SetUsage(sid,u.blocks,u.files)
+		if e!=nil { return e }
+	}
+	return nil
+}
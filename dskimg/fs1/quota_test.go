@@ -0,0 +1,92 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1
+
+import "testing"
+
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/security"
+
+func usageOf(t *testing.T, fs *FileSystem, sid security.SID) (uint64,uint64) {
+	qe,_ := fs.Quota.Get(sid)
+	return qe.Blocks,qe.Files
+}
+
+func TestQuotaCharge(t *testing.T) {
+	fs := newTestFS(t)
+	u,g := security.UidSID(1000),security.GidSID(100)
+	if e := fs.Quota.SetLimits(u,4,2); e!=nil { t.Fatal(e) }
+	f,e := fs.CreateFileOwned(ods.FT_FILE,u,g)
+	if e!=nil { t.Fatal(e) }
+	_,e = (&AutoGrowingFile{f}).WriteAt(make([]byte,8*4096),0)
+	if e!=ods.EQuota { t.Fatal("expected EQuota, got ",e) }
+	blocks,files := usageOf(t,fs,u)
+	if blocks>4 || blocks!=fs.chainBlocks(f.MFT,f.FID) || files!=1 { t.Fatalf("usage %d blocks %d files",blocks,files) }
+	if gb,gf := usageOf(t,fs,g); gb!=blocks || gf!=1 { t.Fatal("group not charged") }
+	
+	if _,e := fs.CreateFileOwned(ods.FT_FILE,u,0); e!=nil { t.Fatal(e) }
+	if _,e := fs.CreateFileOwned(ods.FT_FILE,u,0); e!=ods.EQuota { t.Fatal("expected EQuota, got ",e) }
+	
+	fs.Decrement(f.MFT,f.FID)
+	if blocks,files := usageOf(t,fs,u); blocks!=0 || files!=1 { t.Fatalf("after delete: %d blocks %d files",blocks,files) }
+}
+
+func TestChownTransfersQuota(t *testing.T) {
+	fs := newTestFS(t)
+	u,v,g := security.UidSID(1000),security.UidSID(1001),security.GidSID(100)
+	f,e := fs.CreateFileOwned(ods.FT_FILE,u,g)
+	if e!=nil { t.Fatal(e) }
+	if _,e := (&AutoGrowingFile{f}).WriteAt(make([]byte,3*4096),0); e!=nil { t.Fatal(e) }
+	blocks := fs.chainBlocks(f.MFT,f.FID)
+	
+	fs.Quota.SetLimits(v,blocks-1,0)
+	if e := fs.Chown(f.MFT,f.FID,v,0); e!=ods.EQuota { t.Fatal("expected EQuota, got ",e) }
+	if b,n := usageOf(t,fs,u); b!=blocks || n!=1 { t.Fatal("charge moved on failure") }
+	
+	fs.Quota.SetLimits(v,0,0)
+	if e := fs.Chown(f.MFT,f.FID,v,0); e!=nil { t.Fatal(e) }
+	if b,n := usageOf(t,fs,u); b!=0 || n!=0 { t.Fatalf("old owner: %d blocks %d files",b,n) }
+	if b,n := usageOf(t,fs,v); b!=blocks || n!=1 { t.Fatalf("new owner: %d blocks %d files",b,n) }
+	if b,n := usageOf(t,fs,g); b!=blocks || n!=1 { t.Fatal("group charge changed") }
+	mdf,_ := f.GetMDF()
+	if o,_ := mdf.Owner(); o!=v { t.Fatal("owner not changed") }
+}
+
+func TestQuotaCheck(t *testing.T) {
+	fs := newTestFS(t)
+	u,v := security.UidSID(1000),security.UidSID(1001)
+	var want uint64
+	for i := 0; i<3; i++ {
+		f,e := fs.CreateFileOwned(ods.FT_FILE,u,0)
+		if e!=nil { t.Fatal(e) }
+		(&AutoGrowingFile{f}).WriteAt(make([]byte,(i+1)*4096),0)
+		want += fs.chainBlocks(f.MFT,f.FID)
+	}
+	fs.Quota.SetUsage(u,1,1)
+	fs.Quota.SetUsage(v,7,7)
+	if e := fs.QuotaCheck(); e!=nil { t.Fatal(e) }
+	if b,n := usageOf(t,fs,u); b!=want || n!=3 { t.Fatalf("recomputed %d blocks %d files, want %d blocks 3 files",b,n,want) }
+	if b,n := usageOf(t,fs,v); b!=0 || n!=0 { t.Fatal("stale usage kept") }
+}
@@ -0,0 +1,185 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1
+
+import "errors"
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/lcr"
+
+var EPolicy = errors.New("Unknown storage policy")
+
+/*
+ Storage tiering: a volume may span a fast and a slow device (see
+ dskimg.Concat). The blocks below SB.Tier_BLK live on the fast device, the
+ others on the slow one. Files with the policy lcr.STORE_HOT are placed on the
+ fast tier, files with lcr.STORE_COLD on the slow tier; if a tier is full,
+ the other one is used. Files with lcr.STORE_MEDIUM or without a policy are
+ placed anywhere, except directories and metadata files, which prefer the fast
+ tier.
+ */
+
+/* Returns the POLICY_* code of a storage policy. "" means no policy. */
+func PolicyCode(p lcr.StoragePolicy) (uint8,error) {
+	switch p {
+	case "": return ods.POLICY_NONE,nil
+	case lcr.STORE_HOT: return ods.POLICY_HOT,nil
+	case lcr.STORE_MEDIUM: return ods.POLICY_MEDIUM,nil
+	case lcr.STORE_COLD: return ods.POLICY_COLD,nil
+	}
+	return 0,EPolicy
+}
+/* Returns the storage policy of a POLICY_* code. */
+func PolicyOf(code uint8) lcr.StoragePolicy {
+	switch code {
+	case ods.POLICY_HOT: return lcr.STORE_HOT
+	case ods.POLICY_MEDIUM: return lcr.STORE_MEDIUM
+	case ods.POLICY_COLD: return lcr.STORE_COLD
+	}
+	return ""
+}
+
+func (m *MetaDataFile) StoragePolicy() lcr.StoragePolicy {
+	return PolicyOf(m.Memory.Policy())
+}
+/* Sets the storage policy. It affects new allocations; existing data is moved by File.Migrate. */
+func (m *MetaDataFile) SetStoragePolicy(p lcr.StoragePolicy) error {
+	if m.Backing.FS.ReadOnly { return EReadOnly }
+	c,e := PolicyCode(p)
+	if e!=nil { return e }
+	return m.Memory.PutPolicy(c,m.Backing)
+}
+
+// Returns true, if the volume has a fast and a slow tier.
+func (f *FileSystem) Tiered() bool {
+	return f.SB.Tier_BLK!=0
+}
+/* Returns the blocks of the tier, files with the policy (POLICY_*) are placed on. */
+func (f *FileSystem) TierRange(policy uint8) AllocRange {
+	if f.Tiered() {
+		switch policy {
+		case ods.POLICY_HOT: return AllocRange{0,f.SB.Tier_BLK}
+		case ods.POLICY_COLD: return AllocRange{f.SB.Tier_BLK,f.SB.Block_Len}
+		}
+	}
+	return AllocRange{0,f.SB.Block_Len}
+}
+func (f *FileSystem) wholeRange(r AllocRange) bool {
+	return r.Begin==0 && r.End>=f.SB.Block_Len
+}
+/* Returns the preferred blocks for the data of a file. */
+func (f *FileSystem) placement(ii, i uint32) AllocRange {
+	if !f.Tiered() { return f.TierRange(ods.POLICY_NONE) }
+	mfte,e := f.MMFT.GetEntry(ii,i)
+	if e!=nil { return f.TierRange(ods.POLICY_NONE) }
+	/* Metadata files have no metadata file. Don't call GetMDF, it might be locked by a flush. */
+	if mfte.FileType==ods.FT_METADATA { return f.TierRange(ods.POLICY_HOT) }
+	policy := uint8(ods.POLICY_NONE)
+	if mfte.Mdf_IDX!=0 {
+		if mdf,e := f.GetMDF(ii,i); e==nil { policy = mdf.Memory.Policy() }
+	}
+	if policy==ods.POLICY_NONE && mfte.FileType==ods.FT_DIR { policy = ods.POLICY_HOT }
+	return f.TierRange(policy)
+}
+/* Limits an append at pos, so that the extent does not cross the tier boundary. */
+func (f *FileSystem) clipTier(pos, n uint64) uint64 {
+	t := f.SB.Tier_BLK
+	if t!=0 && pos<t && pos+n>t { return t-pos }
+	return n
+}
+
+/*
+ Moves the data of the file to the tier of the policy (POLICY_*). Extents, that
+ are already there, stay. Returns the number of blocks moved. If the tier runs
+ out of space, the extents moved so far stay moved.
+ 
+ The old blocks are freed under the file lock, so ranges from Franges must
+ not be used after the lock is released.
+ */
+func (f *File) Migrate(policy uint8) (uint64,error) {
+	if f.FS.ReadOnly { return 0,EReadOnly }
+	fs := f.FS
+	if !fs.Tiered() { return 0,nil }
+	tr := fs.TierRange(policy)
+	if fs.wholeRange(tr) { return 0,nil }
+	defer fs.lockFile(f.MFT,f.FID)()
+	gec,e := fs.MMFT.GetEntryChain(f.MFT,f.FID)
+	if e!=nil { return 0,e }
+	defer fs.MMFT.ResetEntryChain(f.MFT,f.FID)
+	moved := uint64(0)
+	for _,j := range gec.Indeces {
+		mfte,e := fs.MMFT.GetEntry(f.MFT,j)
+		if e!=nil { return moved,e }
+		if mfte.Begin_BLK==0 || mfte.End_BLK<=mfte.Begin_BLK { continue }
+		if mfte.Begin_BLK>=tr.Begin && mfte.End_BLK<=tr.End { continue }
+		old := AllocRange{mfte.Begin_BLK,mfte.End_BLK}
+		n := old.End-old.Begin
+		ar,e := fs.allocateStrict(n,tr.Begin,tr)
+		if e!=nil { return moved,e }
+		/*
+		 Copy and sync, then switch the entry and sync, then free. A crash
+		 leaves the entry pointing at either copy, both complete.
+		 */
+		e = fs.copyBlocks(old,*ar)
+		if e==nil { e = f.Sync(true) }
+		if e!=nil {
+			fs.FreeRange(ar.Begin,ar.End)
+			return moved,e
+		}
+		mfte.Begin_BLK = ar.Begin
+		mfte.End_BLK   = ar.End
+		e = fs.MMFT.PutEntry(mfte)
+		if e!=nil {
+			fs.FreeRange(ar.Begin,ar.End)
+			return moved,e
+		}
+		/* Until the entry is durable, the old blocks must not be reused. */
+		e = f.Sync(true)
+		if e!=nil { return moved,e }
+		_,e = fs.FreeRange(old.Begin,old.End)
+		if e!=nil { return moved,e }
+		moved += n
+	}
+	return moved,nil
+}
+/* Returns the number of blocks of the file on the fast and on the slow tier. */
+func (f *File) TierUsage() (fast, slow uint64, err error) {
+	gec,e := f.FS.MMFT.GetEntryChain(f.MFT,f.FID)
+	if e!=nil { return 0,0,e }
+	t := f.FS.SB.Tier_BLK
+	for _,j := range gec.Indeces {
+		mfte,e := f.FS.MMFT.GetEntry(f.MFT,j)
+		if e!=nil { return 0,0,e }
+		b,en := mfte.Begin_BLK,mfte.End_BLK
+		if b==0 || en<=b { continue }
+		switch {
+		case t==0 || en<=t: fast += en-b
+		case b>=t: slow += en-b
+		default:
+			fast += t-b
+			slow += en-t
+		}
+	}
+	return
+}
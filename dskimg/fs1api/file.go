@@ -0,0 +1,204 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "io"
+import "os"
+import "sync"
+
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/dskimg/ods"
+
+/*
+An open file. It implements io.ReadWriteSeeker, io.ReaderAt, io.WriterAt and io.Closer.
+*/
+type File struct{
+	fs   *FS
+	name string
+	ent  ods.DirectoryEntryValue
+	file *fs1.AutoGrowingFile
+	flag int
+	
+	lock   sync.Mutex
+	pos    int64
+	closed bool
+	
+	held    bool /* Regular files are held open, see fs1.FileSystem.Hold. */
+	dirents []os.FileInfo /* Remaining entries of Readdir. */
+	dirread bool
+}
+
+// Name returns the name of the file as presented to Open.
+func (f *File) Name() string { return f.name }
+
+func (f *File) check(op string, write bool) error {
+	if f.closed { return perr(op,f.name,os.ErrClosed) }
+	if write && (f.flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND))==0 { return perr(op,f.name,EBadFD) }
+	if !write && (f.flag&os.O_WRONLY)!=0 { return perr(op,f.name,EBadFD) }
+	if f.ent.FileType==ods.FT_DIR { return perr(op,f.name,EIsDir) }
+	if f.ent.FileType!=ods.FT_FILE { return perr(op,f.name,os.ErrInvalid) }
+	return nil
+}
+
+func (f *File) readAt(p []byte, off int64) (int,error) {
+	if len(p)==0 { return 0,nil }
+	f.file.Accessed()
+	n,e := f.file.ReadAt(p,off)
+	if e!=nil && e!=io.EOF { return n,perr("read",f.name,e) }
+	return n,e
+}
+func (f *File) writeAt(p []byte, off int64) (int,error) {
+	if len(p)==0 { return 0,nil }
+	n,e := f.file.WriteAt(p,off)
+	if e!=nil { return n,perr("write",f.name,e) }
+	return n,nil
+}
+
+func (f *File) Read(p []byte) (int,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if e := f.check("read",false); e!=nil { return 0,e }
+	n,e := f.readAt(p,f.pos)
+	f.pos += int64(n)
+	if n>0 && e==io.EOF { e = nil }
+	return n,e
+}
+func (f *File) ReadAt(p []byte, off int64) (int,error) {
+	if off<0 { return 0,perr("readat",f.name,os.ErrInvalid) }
+	f.lock.Lock()
+	e := f.check("read",false)
+	f.lock.Unlock()
+	if e!=nil { return 0,e }
+	return f.readAt(p,off)
+}
+func (f *File) Write(p []byte) (int,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if e := f.check("write",true); e!=nil { return 0,e }
+	if (f.flag&os.O_APPEND)!=0 {
+		size,e := f.file.Size()
+		if e!=nil { return 0,perr("write",f.name,e) }
+		f.pos = size
+	}
+	n,e := f.writeAt(p,f.pos)
+	f.pos += int64(n)
+	return n,e
+}
+func (f *File) WriteAt(p []byte, off int64) (int,error) {
+	if off<0 { return 0,perr("writeat",f.name,os.ErrInvalid) }
+	f.lock.Lock()
+	e := f.check("write",true)
+	f.lock.Unlock()
+	if e!=nil { return 0,e }
+	return f.writeAt(p,off)
+}
+func (f *File) Seek(offset int64, whence int) (int64,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed { return 0,perr("seek",f.name,os.ErrClosed) }
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent: offset += f.pos
+	case io.SeekEnd:
+		size,e := f.file.Size()
+		if e!=nil { return 0,perr("seek",f.name,e) }
+		offset += size
+	default: return 0,perr("seek",f.name,os.ErrInvalid)
+	}
+	if offset<0 { return 0,perr("seek",f.name,os.ErrInvalid) }
+	f.pos = offset
+	return offset,nil
+}
+
+// Truncate changes the size of the file.
+func (f *File) Truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if e := f.check("truncate",true); e!=nil { return e }
+	if size<0 { return perr("truncate",f.name,os.ErrInvalid) }
+	e := f.file.Resize(size)
+	if e!=nil { return perr("truncate",f.name,e) }
+	return nil
+}
+
+// Stat returns a FileInfo describing the file.
+func (f *File) Stat() (os.FileInfo,error) {
+	if f.closed { return nil,perr("stat",f.name,os.ErrClosed) }
+	fi,e := f.fs.stat(f.name,f.ent)
+	if e!=nil { return nil,perr("stat",f.name,e) }
+	fi.name = baseName(f.name)
+	return fi,nil
+}
+
+// Sync commits the file, its metadata and the file system structures to the device.
+func (f *File) Sync() error {
+	if f.closed { return perr("sync",f.name,os.ErrClosed) }
+	if f.fs.FS.ReadOnly { return nil }
+	e := f.file.Sync(false)
+	if e!=nil { return perr("sync",f.name,e) }
+	return nil
+}
+
+/*
+Readdir reads the contents of the directory, sorted by name, like os.File.Readdir.
+If n > 0, it returns at most n entries and io.EOF at the end of the directory.
+*/
+func (f *File) Readdir(n int) ([]os.FileInfo,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed { return nil,perr("readdir",f.name,os.ErrClosed) }
+	if f.ent.FileType!=ods.FT_DIR { return nil,perr("readdir",f.name,ENotDir) }
+	if !f.dirread {
+		f.fs.lock.Lock()
+		list,e := f.fs.readdir(f.ent)
+		f.fs.lock.Unlock()
+		if e!=nil { return nil,perr("readdir",f.name,e) }
+		f.dirents = list
+		f.dirread = true
+	}
+	if n<=0 {
+		list := f.dirents
+		f.dirents = nil
+		return list,nil
+	}
+	if len(f.dirents)==0 { return nil,io.EOF }
+	if n>len(f.dirents) { n = len(f.dirents) }
+	list := f.dirents[:n]
+	f.dirents = f.dirents[n:]
+	return list,nil
+}
+
+// Close flushes the metadata of the file and closes it. Removed files are deleted on their last Close.
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed { return perr("close",f.name,os.ErrClosed) }
+	f.closed = true
+	if !f.fs.FS.ReadOnly { f.file.FlushMetadata() }
+	if !f.held { return nil }
+	e := f.fs.FS.Release(f.ent.File_MFT,f.ent.File_IDX)
+	if e!=nil { return perr("close",f.name,e) }
+	return nil
+}
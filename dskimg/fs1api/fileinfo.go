@@ -0,0 +1,69 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "os"
+import "time"
+
+import "github.com/maxymania/anyfs/dskimg/ods"
+
+/* Maps a file type to the type bits of an os.FileMode. */
+func FileMode(ft uint8) os.FileMode {
+	switch ft {
+	case ods.FT_FILE: return 0666
+	case ods.FT_DIR: return os.ModeDir|0777
+	case ods.FT_FIFO: return os.ModeNamedPipe|0666
+	case ods.FT_SOCK: return os.ModeSocket|0666
+	case ods.FT_CHR: return os.ModeDevice|os.ModeCharDevice|0666
+	case ods.FT_BLK: return os.ModeDevice|0666
+	}
+	return os.ModeIrregular
+}
+
+/* Implements os.FileInfo. Sys() returns the *ods.MFTE of the file. */
+type FileInfo struct{
+	name  string
+	mfte  ods.MFTE
+	mtime time.Time
+	atime time.Time
+}
+func (fi *FileInfo) Name() string { return fi.name }
+func (fi *FileInfo) Size() int64 { return fi.mfte.FileSize }
+func (fi *FileInfo) Mode() os.FileMode { return FileMode(fi.mfte.FileType) }
+func (fi *FileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *FileInfo) IsDir() bool { return fi.mfte.FileType==ods.FT_DIR }
+func (fi *FileInfo) Sys() interface{} { return &fi.mfte }
+func (fi *FileInfo) AccessTime() time.Time { return fi.atime }
+
+func (f *FS) stat(name string, ent ods.DirectoryEntryValue) (*FileInfo,error) {
+	mfte,e := f.mfte(ent)
+	if e!=nil { return nil,e }
+	fi := &FileInfo{name:name,mfte:*mfte}
+	if mdf,e := f.FS.GetMDF(ent.File_MFT,ent.File_IDX); e==nil {
+		if t := mdf.Memory.WriteTime(); t!=nil { fi.mtime = *t }
+		if t := mdf.Memory.AccessTime(); t!=nil { fi.atime = *t }
+	}
+	return fi,nil
+}
@@ -0,0 +1,518 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+/*
+A path based API to fs1 images, that works in-process without FUSE.
+
+The functions resemble those of package os; errors are reported as
+*os.PathError or *os.LinkError.
+*/
+package fs1api
+
+import "errors"
+import "io"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/security"
+import "github.com/hashicorp/golang-lru"
+
+var ENotDir   = errors.New("Not a directory")
+var EIsDir    = errors.New("Is a directory")
+var ENotEmpty = errors.New("Directory not empty")
+var EStale    = errors.New("Stale directory entry")
+var EBadFD    = errors.New("Bad file descriptor")
+
+/*
+An FS gives path based access to a fs1.FileSystem.
+All directory operations of an FS are serialized.
+*/
+type FS struct{
+	FS    *fs1.FileSystem
+	
+	/* Owner and group of newly created files. 0 means "none". */
+	Owner security.SID
+	Group security.SID
+	
+	lock  sync.Mutex
+	dirs  *lru.Cache
+}
+func New(fs *fs1.FileSystem) *FS {
+	return &FS{FS:fs}
+}
+
+func perr(op, name string, e error) error {
+	if e==io.EOF { e = os.ErrNotExist }
+	return &os.PathError{Op:op,Path:name,Err:e}
+}
+
+func baseName(name string) string {
+	return path.Base(path.Clean("/"+name))
+}
+
+/* Splits a slash-separated path into its elements. */
+func split(name string) []string {
+	name = strings.Trim(path.Clean("/"+name),"/")
+	if name=="" { return nil }
+	return strings.Split(name,"/")
+}
+
+func (f *FS) root() (ods.DirectoryEntryValue,error) {
+	mfte,e := f.FS.GetRootDir().GetMFTE()
+	if e!=nil { return ods.DirectoryEntryValue{},e }
+	return direntOf(mfte),nil
+}
+func direntOf(mfte *ods.MFTE) (ent ods.DirectoryEntryValue) {
+	ent.File_MFT = mfte.File_MFT
+	ent.File_IDX = mfte.File_IDX
+	ent.Cookie   = mfte.Cookie
+	ent.FileType = mfte.FileType
+	return
+}
+
+/* Returns the MFT entry of a directory entry, if the cookie matches. */
+func (f *FS) mfte(ent ods.DirectoryEntryValue) (*ods.MFTE,error) {
+	mfte,e := f.FS.GetFile(ent.File_MFT,ent.File_IDX).GetMFTE()
+	if e!=nil { return nil,e }
+	if mfte.Cookie!=ent.Cookie { return nil,EStale }
+	return mfte,nil
+}
+
+type dirKey struct{
+	ino    uint64
+	cookie uint64
+}
+
+/*
+ Directories are kept open across operations, so that their name caches
+ and their auto compaction state survive.
+ */
+func (f *FS) opendir(ent ods.DirectoryEntryValue) (*ods.Directory,error) {
+	if ent.FileType!=ods.FT_DIR { return nil,ENotDir }
+	if f.dirs==nil {
+		c,e := lru.New(64)
+		if e!=nil { return nil,e }
+		f.dirs = c
+	}
+	key := dirKey{fs1.InodeNumber(ent.File_MFT,ent.File_IDX),ent.Cookie}
+	if d,ok := f.dirs.Get(key); ok { return d.(*ods.Directory),nil }
+	d,e := f.FS.GetFile(ent.File_MFT,ent.File_IDX).AsDirectory()
+	if e!=nil { return nil,e }
+	f.dirs.Add(key,d)
+	return d,nil
+}
+
+/* Resolves a list of path elements. */
+func (f *FS) lookup(elems []string) (ods.DirectoryEntryValue,error) {
+	ent,e := f.root()
+	if e!=nil { return ent,e }
+	for _,elem := range elems {
+		d,e := f.opendir(ent)
+		if e!=nil { return ent,e }
+		_,ent,e = d.Search(elem)
+		if e!=nil { return ent,e }
+	}
+	_,e = f.mfte(ent)
+	return ent,e
+}
+
+/* Resolves the parent directory of a path. The path must not be the root directory. */
+func (f *FS) parent(elems []string) (*ods.Directory,ods.DirectoryEntryValue,string,error) {
+	if len(elems)==0 { return nil,ods.DirectoryEntryValue{},"",os.ErrInvalid }
+	pent,e := f.lookup(elems[:len(elems)-1])
+	if e!=nil { return nil,pent,"",e }
+	d,e := f.opendir(pent)
+	return d,pent,elems[len(elems)-1],e
+}
+
+/* Drops a reference from a file, if the directory entry still refers to it. */
+func (f *FS) release(ent ods.DirectoryEntryValue) error {
+	_,e := f.mfte(ent)
+	if e!=nil { return nil }
+	return f.FS.Decrement(ent.File_MFT,ent.File_IDX)
+}
+
+/* Creates a file of type 'ft' named 'name' in 'd'. */
+func (f *FS) create(d *ods.Directory, name string, ft uint8) (ods.DirectoryEntryValue,error) {
+	fl,e := f.FS.CreateFileOwned(ft,f.Owner,f.Group)
+	if e!=nil { return ods.DirectoryEntryValue{},e }
+	mfte,e := fl.GetMFTE()
+	if e!=nil { return ods.DirectoryEntryValue{},e }
+	ent := direntOf(mfte)
+	e = d.Add(ods.DirectoryEntry{name,ent})
+	if e!=nil {
+		f.FS.Decrement(ent.File_MFT,ent.File_IDX)
+		return ent,e
+	}
+	return ent,nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (f *FS) Stat(name string) (os.FileInfo,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	elems := split(name)
+	ent,e := f.lookup(elems)
+	if e!=nil { return nil,perr("stat",name,e) }
+	fi,e := f.stat(baseName(name),ent)
+	if e!=nil { return nil,perr("stat",name,e) }
+	return fi,nil
+}
+
+// Mkdir creates a new directory. The permission bits are ignored.
+func (f *FS) Mkdir(name string, perm os.FileMode) error {
+	if f.FS.ReadOnly { return perr("mkdir",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	d,_,base,e := f.parent(split(name))
+	if e!=nil { return perr("mkdir",name,e) }
+	_,_,e = d.Search(base)
+	if e==nil { return perr("mkdir",name,os.ErrExist) }
+	if e!=io.EOF { return perr("mkdir",name,e) }
+	_,e = f.create(d,base,ods.FT_DIR)
+	if e!=nil { return perr("mkdir",name,e) }
+	return nil
+}
+
+// MkdirAll creates a directory along with any necessary parents.
+func (f *FS) MkdirAll(name string, perm os.FileMode) error {
+	elems := split(name)
+	for i := range elems {
+		e := f.Mkdir(path.Join(elems[:i+1]...),perm)
+		if e==nil || os.IsExist(e) { continue }
+		return e
+	}
+	fi,e := f.Stat(name)
+	if e!=nil { return e }
+	if !fi.IsDir() { return perr("mkdir",name,ENotDir) }
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (f *FS) Remove(name string) error {
+	if f.FS.ReadOnly { return perr("remove",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	d,_,base,e := f.parent(split(name))
+	if e!=nil { return perr("remove",name,e) }
+	_,ent,e := d.Search(base)
+	if e!=nil { return perr("remove",name,e) }
+	if ent.FileType==ods.FT_DIR {
+		dir := f.FS.GetFile(ent.File_MFT,ent.File_IDX).AsDirectoryLite()
+		if !dir.IsEmpty() { return perr("remove",name,ENotEmpty) }
+	}
+	_,e = d.Delete(base)
+	if e!=nil { return perr("remove",name,e) }
+	e = f.release(ent)
+	if e!=nil { return perr("remove",name,e) }
+	return nil
+}
+
+/* Reports whether the path 'inner' is 'outer' or lies below it. */
+func isBelow(inner, outer []string) bool {
+	if len(inner)<len(outer) { return false }
+	for i,elem := range outer {
+		if inner[i]!=elem { return false }
+	}
+	return true
+}
+
+// Rename renames (moves) oldpath to newpath. An existing file at newpath is replaced;
+// an existing directory is not.
+func (f *FS) Rename(oldpath, newpath string) error {
+	lerr := func(e error) error {
+		if e==io.EOF { e = os.ErrNotExist }
+		return &os.LinkError{Op:"rename",Old:oldpath,New:newpath,Err:e}
+	}
+	if f.FS.ReadOnly { return lerr(fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	oelems,nelems := split(oldpath),split(newpath)
+	od,opent,obase,e := f.parent(oelems)
+	if e!=nil { return lerr(e) }
+	nd,npent,nbase,e := f.parent(nelems)
+	if e!=nil { return lerr(e) }
+	sent,e := od.Lookup(obase)
+	if e!=nil { return lerr(e) }
+	ent := sent.Value
+	if path.Join(oelems...)==path.Join(nelems...) { return nil }
+	if opent==npent && od.Names.Key(obase)==od.Names.Key(nbase) {
+		/* Only the spelling changes (case or normalization). */
+		nbase,e = od.Names.Normalize(nbase)
+		if e!=nil { return lerr(e) }
+		if nbase==sent.Name { return nil }
+		_,e = od.Delete(obase)
+		if e!=nil { return lerr(e) }
+		e = od.Add(ods.DirectoryEntry{nbase,ent})
+		if e!=nil {
+			od.Add(sent)
+			return lerr(e)
+		}
+		return nil
+	}
+	if ent.FileType==ods.FT_DIR && isBelow(nelems,oelems) { return lerr(os.ErrInvalid) }
+	
+	_,oent,oerr := nd.Search(nbase)
+	if oerr==nil && oent==ent { return nil } /* Both are links to the same file. */
+	if oerr==nil && oent.FileType==ods.FT_DIR { return lerr(EIsDir) }
+	if oerr==nil {
+		_,e = nd.Delete(nbase)
+		if e!=nil { return lerr(e) }
+	}
+	/* Puts the replaced entry back. */
+	restore := func() {
+		if oerr==nil { nd.Add(ods.DirectoryEntry{nbase,oent}) }
+	}
+	e = nd.Add(ods.DirectoryEntry{nbase,ent})
+	if e!=nil {
+		restore()
+		return lerr(e)
+	}
+	_,e = od.Delete(obase)
+	if e!=nil {
+		/* Otherwise, the file had two entries, but only one reference. */
+		nd.Delete(nbase)
+		restore()
+		return lerr(e)
+	}
+	if oerr==nil { f.release(oent) }
+	return nil
+}
+
+// CompactDir repacks the entries of the named directory and releases unused segments.
+func (f *FS) CompactDir(name string) error {
+	if f.FS.ReadOnly { return perr("compact",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return perr("compact",name,e) }
+	d,e := f.opendir(ent)
+	if e!=nil { return perr("compact",name,e) }
+	e = d.Compact()
+	if e!=nil { return perr("compact",name,e) }
+	return nil
+}
+
+// Link creates newname as a hard link to the oldname file.
+func (f *FS) Link(oldname, newname string) error {
+	lerr := func(e error) error {
+		if e==io.EOF { e = os.ErrNotExist }
+		return &os.LinkError{Op:"link",Old:oldname,New:newname,Err:e}
+	}
+	if f.FS.ReadOnly { return lerr(fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(oldname))
+	if e!=nil { return lerr(e) }
+	d,_,base,e := f.parent(split(newname))
+	if e!=nil { return lerr(e) }
+	_,_,e = d.Search(base)
+	if e==nil { return lerr(os.ErrExist) }
+	if e!=io.EOF { return lerr(e) }
+	e = f.FS.Increment(ent.File_MFT,ent.File_IDX)
+	if e!=nil { return lerr(e) }
+	e = d.Add(ods.DirectoryEntry{base,ent})
+	if e!=nil {
+		f.FS.Decrement(ent.File_MFT,ent.File_IDX)
+		return lerr(e)
+	}
+	return nil
+}
+
+/* Lists a directory. Stale entries are skipped. */
+func (f *FS) readdir(ent ods.DirectoryEntryValue) ([]os.FileInfo,error) {
+	d,e := f.opendir(ent)
+	if e!=nil { return nil,e }
+	var list []os.FileInfo
+	for i := int64(0); true; i++ {
+		ents,e := d.ReadDir(i)
+		if e!=nil { break }
+		for _,de := range ents {
+			fi,e := f.stat(de.Name,de.Value)
+			if e!=nil { continue }
+			list = append(list,fi)
+		}
+	}
+	sort.Slice(list,func(i,j int) bool { return list[i].Name()<list[j].Name() })
+	return list,nil
+}
+
+// ReadDir reads the named directory and returns its entries, sorted by name.
+func (f *FS) ReadDir(name string) ([]os.FileInfo,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return nil,perr("readdir",name,e) }
+	list,e := f.readdir(ent)
+	if e!=nil { return nil,perr("readdir",name,e) }
+	return list,nil
+}
+
+// Walk walks the file tree rooted at root like filepath.Walk, in lexical order.
+func (f *FS) Walk(root string, fn filepath.WalkFunc) error {
+	fi,e := f.Stat(root)
+	if e!=nil {
+		e = fn(root,nil,e)
+	} else {
+		e = f.walk(root,fi,fn)
+	}
+	if e==filepath.SkipDir { return nil }
+	return e
+}
+func (f *FS) walk(name string, fi os.FileInfo, fn filepath.WalkFunc) error {
+	if !fi.IsDir() { return fn(name,fi,nil) }
+	list,e := f.ReadDir(name)
+	e1 := fn(name,fi,e)
+	if e!=nil || e1!=nil { return e1 }
+	for _,cfi := range list {
+		e = f.walk(path.Join(name,cfi.Name()),cfi,fn)
+		if e!=nil {
+			if !cfi.IsDir() || e!=filepath.SkipDir { return e }
+		}
+	}
+	return nil
+}
+
+// Open opens the named file for reading.
+func (f *FS) Open(name string) (*File,error) {
+	return f.OpenFile(name,os.O_RDONLY,0)
+}
+
+// Create creates or truncates the named file and opens it for reading and writing.
+func (f *FS) Create(name string) (*File,error) {
+	return f.OpenFile(name,os.O_RDWR|os.O_CREATE|os.O_TRUNC,0666)
+}
+
+/*
+OpenFile opens the named file with the specified flags (O_RDONLY etc.).
+If O_CREATE is given, a missing file is created. The permission bits are ignored.
+Directories can only be opened read-only.
+*/
+func (f *FS) OpenFile(name string, flag int, perm os.FileMode) (*File,error) {
+	write := (flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND))!=0
+	if f.FS.ReadOnly && (write || (flag&(os.O_CREATE|os.O_TRUNC))!=0) {
+		return nil,perr("open",name,fs1.EReadOnly)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	elems := split(name)
+	ent,e := f.lookup(elems)
+	if e==io.EOF && (flag&os.O_CREATE)!=0 {
+		var d *ods.Directory
+		var base string
+		d,_,base,e = f.parent(elems)
+		if e!=nil { return nil,perr("open",name,e) }
+		ent,e = f.create(d,base,ods.FT_FILE)
+	} else if e==nil && (flag&(os.O_CREATE|os.O_EXCL))==(os.O_CREATE|os.O_EXCL) {
+		return nil,perr("open",name,os.ErrExist)
+	}
+	if e!=nil { return nil,perr("open",name,e) }
+	
+	fl := &File{fs:f,name:name,ent:ent,flag:flag}
+	fl.file = &fs1.AutoGrowingFile{f.FS.GetFile(ent.File_MFT,ent.File_IDX)}
+	switch ent.FileType {
+	case ods.FT_DIR:
+		if write { return nil,perr("open",name,EIsDir) }
+		return fl,nil
+	case ods.FT_FILE:
+	default:
+		if write || (flag&os.O_TRUNC)!=0 { return nil,perr("open",name,os.ErrInvalid) }
+		return fl,nil
+	}
+	if (flag&os.O_TRUNC)!=0 && write {
+		e = fl.file.Resize(0)
+		if e!=nil { return nil,perr("open",name,e) }
+	}
+	f.FS.Hold(ent.File_MFT,ent.File_IDX)
+	fl.held = true
+	return fl,nil
+}
+
+/*
+Mknod creates a regular file, a named pipe, a socket or a device node, depending
+on the type bits of 'mode'. 'dev' is the device number of device nodes.
+*/
+func (f *FS) Mknod(name string, mode os.FileMode, dev uint64) error {
+	var ft uint8
+	switch mode&os.ModeType {
+	case 0: ft = ods.FT_FILE
+	case os.ModeNamedPipe: ft = ods.FT_FIFO
+	case os.ModeSocket: ft = ods.FT_SOCK
+	case os.ModeDevice|os.ModeCharDevice: ft = ods.FT_CHR
+	case os.ModeDevice: ft = ods.FT_BLK
+	default: return perr("mknod",name,os.ErrInvalid)
+	}
+	if f.FS.ReadOnly { return perr("mknod",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	d,_,base,e := f.parent(split(name))
+	if e!=nil { return perr("mknod",name,e) }
+	_,_,e = d.Search(base)
+	if e==nil { return perr("mknod",name,os.ErrExist) }
+	if e!=io.EOF { return perr("mknod",name,e) }
+	ent,e := f.create(d,base,ft)
+	if e!=nil { return perr("mknod",name,e) }
+	if ft==ods.FT_CHR || ft==ods.FT_BLK {
+		mdf,e := f.FS.GetMDF(ent.File_MFT,ent.File_IDX)
+		if e==nil { e = mdf.SetRdev(dev) }
+		if e!=nil {
+			d.Delete(base)
+			f.FS.Decrement(ent.File_MFT,ent.File_IDX)
+			return perr("mknod",name,e)
+		}
+	}
+	return nil
+}
+
+// Chown changes the owner and the group of the named file. A SID of 0 leaves it unchanged.
+func (f *FS) Chown(name string, owner, group security.SID) error {
+	if f.FS.ReadOnly { return perr("chown",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return perr("chown",name,e) }
+	e = f.FS.Chown(ent.File_MFT,ent.File_IDX,owner,group)
+	if e!=nil { return perr("chown",name,e) }
+	return nil
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (f *FS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if f.FS.ReadOnly { return perr("chtimes",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return perr("chtimes",name,e) }
+	mdf,e := f.FS.GetMDF(ent.File_MFT,ent.File_IDX)
+	if e==nil { e = mdf.SetTimes(time.Time{},mtime,atime) }
+	if e!=nil { return perr("chtimes",name,e) }
+	return nil
+}
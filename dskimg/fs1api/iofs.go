@@ -0,0 +1,113 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "io"
+import "io/fs"
+import "os"
+
+import "github.com/maxymania/anyfs/dskimg/ods"
+
+/*
+IOFS adapts an FS to the interfaces of package io/fs: fs.FS, fs.ReadDirFS,
+fs.StatFS and fs.ReadFileFS. Files are opened read-only. Named pipes, sockets
+and device nodes read as empty files.
+*/
+type IOFS struct{
+	FS *FS
+}
+
+// IOFS returns an io/fs view of the file system.
+func (f *FS) IOFS() *IOFS {
+	return &IOFS{f}
+}
+
+func (f *IOFS) Open(name string) (fs.File,error) {
+	if !fs.ValidPath(name) { return nil,&fs.PathError{Op:"open",Path:name,Err:fs.ErrInvalid} }
+	fl,e := f.FS.Open(name)
+	if e!=nil { return nil,e }
+	switch fl.ent.FileType {
+	case ods.FT_FILE,ods.FT_DIR: return fl,nil
+	}
+	return specialFile{fl},nil
+}
+func (f *IOFS) Stat(name string) (fs.FileInfo,error) {
+	if !fs.ValidPath(name) { return nil,&fs.PathError{Op:"stat",Path:name,Err:fs.ErrInvalid} }
+	fi,e := f.FS.Stat(name)
+	if e!=nil { return nil,e }
+	if name=="." { fi.(*FileInfo).name = "." }
+	return fi,nil
+}
+func (f *IOFS) ReadDir(name string) ([]fs.DirEntry,error) {
+	if !fs.ValidPath(name) { return nil,&fs.PathError{Op:"readdir",Path:name,Err:fs.ErrInvalid} }
+	list,e := f.FS.ReadDir(name)
+	if e!=nil { return nil,e }
+	return dirEntries(list),nil
+}
+func (f *IOFS) ReadFile(name string) ([]byte,error) {
+	if !fs.ValidPath(name) { return nil,&fs.PathError{Op:"readfile",Path:name,Err:fs.ErrInvalid} }
+	fl,e := f.Open(name)
+	if e!=nil { return nil,e }
+	defer fl.Close()
+	fi,e := fl.Stat()
+	if e!=nil { return nil,e }
+	if fi.IsDir() { return nil,&fs.PathError{Op:"readfile",Path:name,Err:EIsDir} }
+	data := make([]byte,fi.Size())
+	n,e := fl.(io.ReaderAt).ReadAt(data,0)
+	if e==io.EOF { e = nil }
+	return data[:n],e
+}
+
+func dirEntries(list []fs.FileInfo) []fs.DirEntry {
+	ents := make([]fs.DirEntry,len(list))
+	for i,fi := range list { ents[i] = fs.FileInfoToDirEntry(fi) }
+	return ents
+}
+
+/*
+ReadDir reads the contents of the directory like fs.ReadDirFile.
+If n > 0, it returns at most n entries and io.EOF at the end of the directory.
+*/
+func (f *File) ReadDir(n int) ([]fs.DirEntry,error) {
+	list,e := f.Readdir(n)
+	if e!=nil { return nil,e }
+	return dirEntries(list),nil
+}
+
+/* A named pipe, socket or device node, opened through IOFS. It has no content. */
+type specialFile struct{
+	*File
+}
+func (f specialFile) Read(p []byte) (int,error) {
+	return f.ReadAt(p,0)
+}
+func (f specialFile) ReadAt(p []byte, off int64) (int,error) {
+	if off<0 { return 0,perr("readat",f.name,os.ErrInvalid) }
+	f.lock.Lock()
+	closed := f.closed
+	f.lock.Unlock()
+	if closed { return 0,perr("read",f.name,os.ErrClosed) }
+	return 0,io.EOF
+}
@@ -0,0 +1,59 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "testing"
+import "testing/fstest"
+import "os"
+
+import "github.com/maxymania/anyfs/dskimg"
+import "github.com/maxymania/anyfs/dskimg/fs1"
+
+/* Creates a fresh file system on a MemDevice. */
+func newTestFS(t *testing.T) *FS {
+	dev := dskimg.NewMemDevice(16<<20)
+	fs := new(fs1.FileSystem)
+	fs.Device = dev
+	fs.NoSync = true
+	e := fs.Mkfs(512,&fs1.MkfsInfo{BlockSize:4096,MftBlocks:16})
+	if e!=nil { t.Fatal("mkfs: ",e) }
+	return New(fs)
+}
+
+func TestIOFS(t *testing.T) {
+	a := newTestFS(t)
+	if e := a.MkdirAll("/a/b",0755); e!=nil { t.Fatal(e) }
+	if e := a.Mkdir("/e",0755); e!=nil { t.Fatal(e) }
+	files := []string{"a/x","a/b/y","z"}
+	for _,n := range files {
+		f,e := a.Create("/"+n)
+		if e!=nil { t.Fatal(e) }
+		f.Write([]byte("content of "+n))
+		f.Close()
+	}
+	if e := a.Mknod("/a/c",os.ModeDevice|os.ModeCharDevice,0x0501); e!=nil { t.Fatal(e) }
+	if e := a.Mknod("/fifo",os.ModeNamedPipe,0); e!=nil { t.Fatal(e) }
+	if e := fstest.TestFS(a.IOFS(),append(files,"e","a/c","fifo")...); e!=nil { t.Fatal(e) }
+}
@@ -0,0 +1,290 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "io"
+import "os"
+import "sync"
+import "time"
+
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/lcr"
+
+/*
+A Node implements lcr.Node. Nodes are the directories of the file system;
+Lookup and Create work on their entries. Regular files are nodes without
+children. The properties are stored by fs1.File.SetProperties.
+*/
+type Node struct{
+	fs  *FS
+	ent ods.DirectoryEntryValue
+}
+
+// Root returns the root directory as node.
+func (f *FS) Root() (*Node,error) {
+	return f.Node("/")
+}
+
+// Node returns the named file as node.
+func (f *FS) Node(name string) (*Node,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return nil,perr("node",name,e) }
+	return &Node{f,ent},nil
+}
+
+func (n *Node) file() *fs1.File {
+	return n.fs.FS.GetFile(n.ent.File_MFT,n.ent.File_IDX)
+}
+/* Loads the properties; the caller must hold n.fs.lock. */
+func (n *Node) properties() ([]ods.Property,error) {
+	_,e := n.fs.mfte(n.ent)
+	if e!=nil { return nil,e }
+	return n.file().Properties()
+}
+
+func (n *Node) GetProperty(name string) lcr.Values {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	props,e := n.properties()
+	if e!=nil { return nil }
+	for _,p := range props {
+		if p.Name==name { return &values{n.fs,p.Values} }
+	}
+	return nil
+}
+
+func (n *Node) PutProperties(name string, overwrite bool, i ...interface{}) lcr.Values {
+	if n.fs.FS.ReadOnly || name=="" { return nil }
+	vals := make([]interface{},len(i))
+	for j,v := range i {
+		c,_,ok := lcr.Canonical(v)
+		if !ok { return nil }
+		vals[j] = c
+	}
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	props,e := n.properties()
+	if e!=nil { return nil }
+	pi := len(props)
+	for j,p := range props {
+		if p.Name==name { pi = j; break }
+	}
+	if pi==len(props) { props = append(props,ods.Property{Name:name}) }
+	nv,blobs,e := n.newValues(vals)
+	if e!=nil { return nil }
+	if overwrite {
+		props[pi].Values = nv
+	} else {
+		props[pi].Values = append(props[pi].Values,nv...)
+	}
+	result := props[pi].Values
+	if len(result)==0 { props = append(props[:pi],props[pi+1:]...) }
+	e = n.file().SetProperties(props)
+	if e!=nil {
+		n.fs.FS.DropBlobs(blobs)
+		return nil
+	}
+	return &values{n.fs,result}
+}
+/* Converts canonical values. BLOBs are created and filled. */
+func (n *Node) newValues(vals []interface{}) ([]ods.PropertyValue,[]ods.FileRef,error) {
+	nv := make([]ods.PropertyValue,len(vals))
+	var blobs []ods.FileRef
+	for j,v := range vals {
+		switch x := v.(type) {
+		case []byte:
+			b,r,e := n.file().CreateBlob()
+			if e==nil && len(x)>0 {
+				_,e = (&fs1.AutoGrowingFile{b}).WriteAt(x,0)
+				if e!=nil { n.fs.FS.DropBlobs([]ods.FileRef{r}) }
+			}
+			if e!=nil {
+				n.fs.FS.DropBlobs(blobs)
+				return nil,nil,e
+			}
+			blobs = append(blobs,r)
+			nv[j] = ods.PropertyValue{Type:ods.PROP_BLOB,Blob:r}
+		case string: nv[j] = ods.PropertyValue{Type:ods.PROP_STRING,Str:x}
+		case int64: nv[j] = ods.PropertyValue{Type:ods.PROP_INTEGER,Int:x}
+		case time.Time: nv[j] = ods.PropertyValue{Type:ods.PROP_DATETIME,Int:x.Unix(),Nsec:uint32(x.Nanosecond())}
+		}
+	}
+	return nv,blobs,nil
+}
+
+func (n *Node) Lookup(name string) lcr.Node {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	d,e := n.fs.opendir(n.ent)
+	if e!=nil { return nil }
+	_,ent,e := d.Search(name)
+	if e!=nil { return nil }
+	if _,e = n.fs.mfte(ent); e!=nil { return nil }
+	return &Node{n.fs,ent}
+}
+
+func (n *Node) Create(name string) lcr.Node {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	d,e := n.fs.opendir(n.ent)
+	if e!=nil { return nil }
+	_,ent,e := d.Search(name)
+	if e==nil {
+		if _,e = n.fs.mfte(ent); e!=nil { return nil }
+		return &Node{n.fs,ent}
+	}
+	if e!=io.EOF || n.fs.FS.ReadOnly { return nil }
+	ent,e = n.fs.create(d,name,ods.FT_DIR)
+	if e!=nil { return nil }
+	return &Node{n.fs,ent}
+}
+
+// Children returns the names of the entries of a directory node. It implements lcr.Lister.
+func (n *Node) Children() []string {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	if n.ent.FileType!=ods.FT_DIR { return nil }
+	list,e := n.fs.readdir(n.ent)
+	if e!=nil { return nil }
+	names := make([]string,len(list))
+	for i,fi := range list { names[i] = fi.Name() }
+	return names
+}
+func (n *Node) PropertyNames() []string {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	props,e := n.properties()
+	if e!=nil { return nil }
+	names := make([]string,len(props))
+	for i,p := range props { names[i] = p.Name }
+	return names
+}
+
+// PropertyStamp implements lcr.Stamper; see fs1.File.PropertyStamp.
+func (n *Node) PropertyStamp() (string,bool) {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	if _,e := n.fs.mfte(n.ent); e!=nil { return "",false }
+	s,e := n.file().PropertyStamp()
+	return s,e==nil
+}
+
+/* A snapshot of the values of a property. */
+type values struct{
+	fs   *FS
+	vals []ods.PropertyValue
+}
+func (v *values) get(i int, t uint8) *ods.PropertyValue {
+	if i<0 || i>=len(v.vals) || v.vals[i].Type!=t { return nil }
+	return &v.vals[i]
+}
+func (v *values) GetBlob(i int) lcr.Blob {
+	pv := v.get(i,ods.PROP_BLOB)
+	if pv==nil { return nil }
+	v.fs.lock.Lock()
+	defer v.fs.lock.Unlock()
+	fl,e := v.fs.FS.Deref(pv.Blob,ods.FT_BLOB)
+	if e!=nil { return nil }
+	v.fs.FS.Hold(fl.MFT,fl.FID)
+	return &Blob{fs:v.fs,file:&fs1.AutoGrowingFile{fl}}
+}
+func (v *values) GetString(i int) string {
+	pv := v.get(i,ods.PROP_STRING)
+	if pv==nil { return "" }
+	return pv.Str
+}
+func (v *values) GetInt(i int) int64 {
+	pv := v.get(i,ods.PROP_INTEGER)
+	if pv==nil { return 0 }
+	return pv.Int
+}
+func (v *values) GetDate(i int) time.Time {
+	pv := v.get(i,ods.PROP_DATETIME)
+	if pv==nil { return time.Time{} }
+	return time.Unix(pv.Int,int64(pv.Nsec))
+}
+func (v *values) GetTypeID(i int) lcr.TypeID {
+	if i<0 || i>=len(v.vals) { return lcr.INVALID }
+	return lcr.TypeID(v.vals[i].Type)
+}
+func (v *values) Length() int { return len(v.vals) }
+
+/*
+A Blob is an open BLOB value; it implements lcr.Blob. Like an open File, it
+keeps the blob alive, if the property is overwritten or the node is removed.
+*/
+type Blob struct{
+	fs   *FS
+	file *fs1.AutoGrowingFile
+	
+	lock   sync.Mutex
+	closed bool
+}
+func (b *Blob) check() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed { return os.ErrClosed }
+	return nil
+}
+func (b *Blob) ReadAt(p []byte, off int64) (int,error) {
+	if e := b.check(); e!=nil { return 0,e }
+	if off<0 { return 0,os.ErrInvalid }
+	if len(p)==0 { return 0,nil }
+	return b.file.ReadAt(p,off)
+}
+func (b *Blob) WriteAt(p []byte, off int64) (int,error) {
+	if e := b.check(); e!=nil { return 0,e }
+	if off<0 { return 0,os.ErrInvalid }
+	if len(p)==0 { return 0,nil }
+	return b.file.WriteAt(p,off)
+}
+// Truncate changes the size of the blob and releases the blocks beyond it.
+func (b *Blob) Truncate(i int64) error {
+	if e := b.check(); e!=nil { return e }
+	if i<0 { return os.ErrInvalid }
+	return b.file.Truncate(i)
+}
+func (b *Blob) Length() int64 {
+	size,_ := b.file.Size()
+	return size
+}
+// Sync writes the content of the blob to the device.
+func (b *Blob) Sync() error {
+	if e := b.check(); e!=nil { return e }
+	return b.file.Sync(true)
+}
+// UnderlyingObject returns the *fs1.AutoGrowingFile of the blob.
+func (b *Blob) UnderlyingObject() interface{} { return b.file }
+func (b *Blob) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed { return os.ErrClosed }
+	b.closed = true
+	if !b.fs.FS.ReadOnly { b.file.FlushMetadata() }
+	return b.fs.FS.Release(b.file.MFT,b.file.FID)
+}
@@ -0,0 +1,76 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "testing"
+import "fmt"
+
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/lcr"
+import "github.com/maxymania/anyfs/lcr/lcrindex"
+import "github.com/maxymania/anyfs/lcr/lcrtest"
+
+func TestNode(t *testing.T) {
+	root,e := newTestFS(t).Root()
+	if e!=nil { t.Fatal(e) }
+	if e := lcrtest.TestNode(root); e!=nil { t.Fatal(e) }
+}
+
+func TestQuery(t *testing.T) {
+	root,e := newTestFS(t).Root()
+	if e!=nil { t.Fatal(e) }
+	ix,e := lcrindex.New(root)
+	if e!=nil { t.Fatal(e) }
+	if e := lcrtest.TestQuery(ix); e!=nil { t.Fatal(e) }
+	if e := lcrtest.TestNode(ix); e!=nil { t.Fatal(e) }
+}
+
+func TestIndexLog(t *testing.T) {
+	a := newTestFS(t)
+	root,e := a.Root()
+	if e!=nil { t.Fatal(e) }
+	ix,e := lcrindex.New(root,"n")
+	if e!=nil { t.Fatal(e) }
+	for i := 0; i<100; i++ { ix.Create(fmt.Sprint("x",i)).PutProperties("n",true,i%10) }
+	if e := ix.Close(); e!=nil { t.Fatal(e) }
+	if e := a.FS.Unmount(); e!=nil { t.Fatal(e) }
+	
+	fs := new(fs1.FileSystem)
+	fs.Device = a.FS.Device
+	fs.NoSync = true
+	if e := fs.LoadFileSystem(512); e!=nil { t.Fatal(e) }
+	if e := fs.Mount(false); e!=nil { t.Fatal(e) }
+	a = New(fs)
+	root,e = a.Root()
+	if e!=nil { t.Fatal(e) }
+	/* A property set bypassing the index changes the stamp of the node, so the log is corrected. */
+	root.Lookup("x3").PutProperties("n",true,42)
+	ix,e = lcrindex.New(root,"n")
+	if e!=nil { t.Fatal(e) }
+	p,e := ix.Query([]lcr.Predicate{lcr.Equal("n",3)},"",0)
+	if e!=nil || len(p.Matches)!=9 { t.Fatal("stale index: ",len(p.Matches),e) }
+	p,e = ix.Query([]lcr.Predicate{lcr.Equal("n",42)},"",0)
+	if e!=nil || len(p.Matches)!=1 || p.Matches[0].Path!="x3" { t.Fatal("change not seen: ",p.Matches,e) }
+}
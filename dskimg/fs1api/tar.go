@@ -0,0 +1,277 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "archive/tar"
+import "errors"
+import "io"
+import "os"
+import "path"
+import "path/filepath"
+import "strings"
+import "time"
+
+import "github.com/maxymania/anyfs/dskimg"
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/security"
+
+var EUnsupported = errors.New("File type not supported by fs1")
+
+/* Called for entries, that can not be represented and are skipped (symbolic links, for example). */
+type SkipFunc func(name string, reason error)
+
+/* Device numbers use the Linux dev_t encoding. */
+func DevMajor(dev uint64) uint32 { return uint32(((dev>>8)&0xfff)|((dev>>32)&^0xfff)) }
+func DevMinor(dev uint64) uint32 { return uint32((dev&0xff)|((dev>>12)&^0xff)) }
+func Mkdev(major, minor uint32) uint64 {
+	ma,mi := uint64(major),uint64(minor)
+	return (mi&0xff)|((ma&0xfff)<<8)|((mi&^0xff)<<12)|((ma&^0xfff)<<32)
+}
+
+/* Removes an existing non-directory at 'name', as tar does before extracting. */
+func (f *FS) replace(name string) error {
+	fi,e := f.Stat(name)
+	if e!=nil || fi.IsDir() { return nil }
+	return f.Remove(name)
+}
+
+/* Copies 'src' into the new regular file 'name'. */
+func (f *FS) copyIn(name string, src io.Reader) error {
+	e := f.replace(name)
+	if e!=nil { return e }
+	fl,e := f.OpenFile(name,os.O_WRONLY|os.O_CREATE|os.O_TRUNC,0666)
+	if e!=nil { return e }
+	_,e = io.Copy(fl,src)
+	e2 := fl.Close()
+	if e==nil { e = e2 }
+	return e
+}
+
+/* Sets the metadata, that fs1 can store. */
+func (f *FS) setMeta(name string, uid, gid int, atime, mtime time.Time) error {
+	if uid>=0 || gid>=0 {
+		var owner,group security.SID
+		if uid>=0 { owner = security.UidSID(uint32(uid)) }
+		if gid>=0 { group = security.GidSID(uint32(gid)) }
+		e := f.Chown(name,owner,group)
+		if e!=nil { return e }
+	}
+	if atime.IsZero() { atime = mtime }
+	return f.Chtimes(name,atime,mtime)
+}
+
+/*
+ImportDir copies the host directory tree 'src' into the directory 'dst' of the
+image. Names, file types, hard links, owners, device numbers and modification
+times are preserved, as far as the platform reports them.
+*/
+func (f *FS) ImportDir(dst, src string, skip SkipFunc) error {
+	type hostID struct{ dev, ino uint64 }
+	links := make(map[hostID]string)
+	e := f.MkdirAll(dst,0777)
+	if e!=nil { return e }
+	return filepath.Walk(src,func(name string, fi os.FileInfo, e error) error {
+		if e!=nil { return e }
+		rel,e := filepath.Rel(src,name)
+		if e!=nil { return e }
+		target := path.Join(dst,filepath.ToSlash(rel))
+		hs,ok := dskimg.HostStat(fi)
+		if ok && !fi.IsDir() && hs.Nlink>1 {
+			id := hostID{hs.Dev,hs.Ino}
+			if first,ok := links[id]; ok {
+				e = f.replace(target)
+				if e!=nil { return e }
+				return f.Link(first,target)
+			}
+			links[id] = target
+		}
+		mode := fi.Mode()
+		switch {
+		case mode.IsDir():
+			e = f.MkdirAll(target,0777)
+		case mode.IsRegular():
+			var in *os.File
+			in,e = os.Open(name)
+			if e!=nil { return e }
+			e = f.copyIn(target,in)
+			in.Close()
+		case mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice)!=0:
+			var rdev uint64
+			if ok { rdev = hs.Rdev }
+			e = f.replace(target)
+			if e==nil { e = f.Mknod(target,mode,rdev) }
+		default:
+			if skip!=nil { skip(name,EUnsupported) }
+			return nil
+		}
+		if e!=nil { return e }
+		uid,gid := -1,-1
+		if ok { uid,gid = int(hs.Uid),int(hs.Gid) }
+		return f.setMeta(target,uid,gid,time.Time{},fi.ModTime())
+	})
+}
+
+/* A hard link, whose target has not been extracted yet. */
+type tarLink struct{
+	oldname, newname string
+}
+
+/*
+Creates the deferred hard links. Links to links are resolved by repeating,
+until no more links can be created.
+*/
+func (f *FS) tarLinks(links []tarLink) error {
+	for len(links)>0 {
+		var rest []tarLink
+		var err error
+		for _,l := range links {
+			e := f.Link(l.oldname,l.newname)
+			if os.IsNotExist(e) {
+				rest = append(rest,l)
+				if err==nil { err = e }
+				continue
+			}
+			if e!=nil { return e }
+		}
+		if len(rest)==len(links) { return err }
+		links = rest
+	}
+	return nil
+}
+
+/*
+ImportTar extracts the tar stream 'r' into the directory 'dst' of the image.
+Names, file types, hard links, owners, device numbers and access and modification
+times are preserved. Hard links, whose target comes later in the stream, are
+created at the end.
+*/
+func (f *FS) ImportTar(dst string, r io.Reader, skip SkipFunc) error {
+	e := f.MkdirAll(dst,0777)
+	if e!=nil { return e }
+	var links []tarLink
+	tr := tar.NewReader(r)
+	for {
+		hdr,e := tr.Next()
+		if e==io.EOF { return f.tarLinks(links) }
+		if e!=nil { return e }
+		target := path.Join(dst,path.Clean("/"+hdr.Name))
+		e = f.MkdirAll(path.Dir(target),0777)
+		if e!=nil { return e }
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e = f.MkdirAll(target,0777)
+		case tar.TypeReg,tar.TypeRegA:
+			e = f.copyIn(target,tr)
+		case tar.TypeLink:
+			oldname := path.Join(dst,path.Clean("/"+hdr.Linkname))
+			e = f.replace(target)
+			if e==nil { e = f.Link(oldname,target) }
+			if os.IsNotExist(e) {
+				links = append(links,tarLink{oldname,target})
+				continue
+			}
+			if e!=nil { return e }
+			continue /* The link shares the metadata of its target. */
+		case tar.TypeChar:
+			e = f.replace(target)
+			if e==nil { e = f.Mknod(target,os.ModeDevice|os.ModeCharDevice,Mkdev(uint32(hdr.Devmajor),uint32(hdr.Devminor))) }
+		case tar.TypeBlock:
+			e = f.replace(target)
+			if e==nil { e = f.Mknod(target,os.ModeDevice,Mkdev(uint32(hdr.Devmajor),uint32(hdr.Devminor))) }
+		case tar.TypeFifo:
+			e = f.replace(target)
+			if e==nil { e = f.Mknod(target,os.ModeNamedPipe,0) }
+		default:
+			if skip!=nil { skip(hdr.Name,EUnsupported) }
+			continue
+		}
+		if e!=nil { return e }
+		e = f.setMeta(target,hdr.Uid,hdr.Gid,hdr.AccessTime,hdr.ModTime)
+		if e!=nil { return e }
+	}
+}
+
+/*
+ExportTar writes the tree below 'src' as a tar stream to 'w'. Names are relative
+to 'src'; hard links are written as tar hard links. Sockets are skipped.
+*/
+func (f *FS) ExportTar(src string, w io.Writer, skip SkipFunc) error {
+	tw := tar.NewWriter(w)
+	links := make(map[uint64]string)
+	root := path.Clean("/"+src)
+	e := f.Walk(root,func(name string, fi os.FileInfo, e error) error {
+		if e!=nil { return e }
+		rel := strings.TrimPrefix(strings.TrimPrefix(name,root),"/")
+		if rel=="" { rel = "." }
+		mfte := fi.Sys().(*ods.MFTE)
+		hdr := &tar.Header{Name:rel,Mode:int64(fi.Mode().Perm()),ModTime:fi.ModTime()}
+		if hdr.ModTime.IsZero() { hdr.ModTime = time.Unix(0,0) }
+		if mdf,e := f.FS.GetMDF(mfte.File_MFT,mfte.File_IDX); e==nil {
+			if sid,ok := mdf.Owner(); ok && sid.Uid()!=^uint32(0) { hdr.Uid = int(sid.Uid()) }
+			if sid,ok := mdf.Group(); ok && sid.Gid()!=^uint32(0) { hdr.Gid = int(sid.Gid()) }
+			if rdev,ok := mdf.Rdev(); ok {
+				hdr.Devmajor = int64(DevMajor(rdev))
+				hdr.Devminor = int64(DevMinor(rdev))
+			}
+		}
+		if !fi.IsDir() && mfte.RefCount>1 && mfte.RefCount<fs1.REFCOUNT_PINNED {
+			ino := fs1.InodeNumber(mfte.File_MFT,mfte.File_IDX)
+			if first,ok := links[ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Devmajor,hdr.Devminor = 0,0
+				return tw.WriteHeader(hdr)
+			}
+			links[ino] = rel
+		}
+		switch mfte.FileType {
+		case ods.FT_DIR:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case ods.FT_FILE:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = fi.Size()
+		case ods.FT_FIFO:
+			hdr.Typeflag = tar.TypeFifo
+		case ods.FT_CHR:
+			hdr.Typeflag = tar.TypeChar
+		case ods.FT_BLK:
+			hdr.Typeflag = tar.TypeBlock
+		default:
+			if skip!=nil { skip(name,EUnsupported) }
+			return nil
+		}
+		e = tw.WriteHeader(hdr)
+		if e!=nil || hdr.Typeflag!=tar.TypeReg { return e }
+		fl,e := f.Open(name)
+		if e!=nil { return e }
+		defer fl.Close()
+		_,e = io.CopyN(tw,fl,hdr.Size)
+		return e
+	})
+	if e!=nil { return e }
+	return tw.Close()
+}
@@ -0,0 +1,84 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "testing"
+import "archive/tar"
+import "bytes"
+import "fmt"
+import "io/ioutil"
+
+import "github.com/maxymania/anyfs/dskimg/ods"
+
+/* Sets the type flag of the tar header at 'off' to the old-style regular file. */
+func setRegA(b []byte, off int) {
+	hdr := b[off:off+512]
+	hdr[156] = 0
+	for i := 148; i<156; i++ { hdr[i] = ' ' }
+	sum := 0
+	for _,c := range hdr { sum += int(c) }
+	copy(hdr[148:],fmt.Sprintf("%06o\x00 ",sum))
+}
+
+func TestImportTar(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	write := func(hdr *tar.Header, data string) {
+		hdr.Mode = 0644
+		hdr.Size = int64(len(data))
+		hdr.Format = tar.FormatUSTAR
+		if e := tw.WriteHeader(hdr); e!=nil { t.Fatal(e) }
+		tw.Write([]byte(data))
+	}
+	write(&tar.Header{Name:"old",Typeflag:tar.TypeReg},"regA")
+	/* Links to targets, that follow later, even to another link. */
+	write(&tar.Header{Name:"l1",Typeflag:tar.TypeLink,Linkname:"l2"},"")
+	write(&tar.Header{Name:"l2",Typeflag:tar.TypeLink,Linkname:"d/f"},"")
+	write(&tar.Header{Name:"d/f",Typeflag:tar.TypeReg},"data")
+	tw.Close()
+	b := buf.Bytes()
+	setRegA(b,0)
+	
+	a := newTestFS(t)
+	if e := a.ImportTar("/x",bytes.NewReader(b),nil); e!=nil { t.Fatal(e) }
+	for name,want := range map[string]string{"/x/old":"regA","/x/d/f":"data","/x/l1":"data","/x/l2":"data"} {
+		f,e := a.Open(name)
+		if e!=nil { t.Fatal(e) }
+		got,_ := ioutil.ReadAll(f)
+		f.Close()
+		if string(got)!=want { t.Errorf("%s: %q, want %q",name,got,want) }
+	}
+	fi,_ := a.Stat("/x/d/f")
+	f1,_ := a.Stat("/x/l1")
+	m,m1 := fi.Sys().(*ods.MFTE),f1.Sys().(*ods.MFTE)
+	if m.File_MFT!=m1.File_MFT || m.File_IDX!=m1.File_IDX || m.RefCount!=3 { t.Error("l1 is no hard link of d/f") }
+	
+	/* A link to a missing target fails. */
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	write(&tar.Header{Name:"l",Typeflag:tar.TypeLink,Linkname:"missing"},"")
+	tw.Close()
+	if e := a.ImportTar("/y",buf,nil); e==nil { t.Error("missing link target accepted") }
+}
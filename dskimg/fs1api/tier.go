@@ -0,0 +1,74 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1api
+
+import "github.com/maxymania/anyfs/dskimg/fs1"
+import "github.com/maxymania/anyfs/lcr"
+
+// StoragePolicy returns the storage policy of the named file; "" if it has none.
+func (f *FS) StoragePolicy(name string) (lcr.StoragePolicy,error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return "",perr("policy",name,e) }
+	mdf,e := f.FS.GetMDF(ent.File_MFT,ent.File_IDX)
+	if e!=nil { return "",perr("policy",name,e) }
+	return mdf.StoragePolicy(),nil
+}
+
+// SetStoragePolicy sets the storage policy of the named file. Existing data is moved by Migrate.
+func (f *FS) SetStoragePolicy(name string, p lcr.StoragePolicy) error {
+	if f.FS.ReadOnly { return perr("policy",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return perr("policy",name,e) }
+	mdf,e := f.FS.GetMDF(ent.File_MFT,ent.File_IDX)
+	if e==nil { e = mdf.SetStoragePolicy(p) }
+	if e!=nil { return perr("policy",name,e) }
+	return nil
+}
+
+/*
+ Migrate moves the data of the named file to the tier of the policy p. If p is
+ "", the policy of the file is used. It returns the number of blocks moved.
+ */
+func (f *FS) Migrate(name string, p lcr.StoragePolicy) (uint64,error) {
+	if f.FS.ReadOnly { return 0,perr("migrate",name,fs1.EReadOnly) }
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ent,e := f.lookup(split(name))
+	if e!=nil { return 0,perr("migrate",name,e) }
+	if p=="" {
+		mdf,e := f.FS.GetMDF(ent.File_MFT,ent.File_IDX)
+		if e!=nil { return 0,perr("migrate",name,e) }
+		p = mdf.StoragePolicy()
+	}
+	c,e := fs1.PolicyCode(p)
+	if e!=nil { return 0,perr("migrate",name,e) }
+	n,e := f.FS.GetFile(ent.File_MFT,ent.File_IDX).Migrate(c)
+	if e!=nil { return n,perr("migrate",name,e) }
+	return n,nil
+}
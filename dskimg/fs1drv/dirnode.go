@@ -31,6 +31,7 @@ import "github.com/hanwen/go-fuse/fuse/nodefs"
 
 import "github.com/maxymania/anyfs/dskimg/fs1"
 import "github.com/maxymania/anyfs/dskimg/ods"
+import "github.com/maxymania/anyfs/security"
 //import "time"
 
 import "syscall"
@@ -61,14 +62,70 @@ type DirNode struct{
 	Backing *fs1.File
 	Dir     *ods.Directory
 	Lock    sync.Mutex
+	tab     *dirTable
+}
+
+/* The DirNodes of a tree, by inode number. Used by RawFS to find them. */
+type dirTable struct{
+	lock sync.Mutex
+	m    map[uint64]*DirNode
+}
+func (t *dirTable) add(d *DirNode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.m[fs1.InodeNumber(d.Backing.MFT,d.Backing.FID)] = d
+}
+func (t *dirTable) get(ino uint64) *DirNode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.m[ino]
+}
+func (t *dirTable) remove(d *DirNode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ino := fs1.InodeNumber(d.Backing.MFT,d.Backing.FID)
+	if t.m[ino]==d { delete(t.m,ino) }
+}
+
+/* Creates the root node of the file system. */
+func NewRoot(fs *fs1.FileSystem) (*DirNode,error) {
+	rd := fs.GetRootDir()
+	rdir,e := rd.AsDirectory()
+	if e!=nil { return nil,e }
+	root := new(DirNode)
+	root.Node = nodefs.NewDefaultNode()
+	root.Backing = rd
+	root.Dir = rdir
+	root.tab = &dirTable{m:make(map[uint64]*DirNode)}
+	root.tab.add(root)
+	return root,nil
+}
+func (d *DirNode) OnForget() {
+	d.tab.remove(d)
 }
 func (d *DirNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	mfte,e := d.Backing.GetMFTE()
+	if e!=nil { return fuse.EIO }
 	out.Mode = fuse.S_IFDIR | 0777
+	out.Size = uint64(mfte.FileSize)
+	mfteattr(out,mfte)
 	return fuse.OK
 }
+/*
+ Returns the name of the entry as stored in the directory, or the normalized
+ name, if there is none. Children are kept under the stored names, so that names
+ differing in case or normalization share them. The lock must be held.
+ */
+func (d *DirNode) stored(name string) string {
+	if d.Dir.Names==0 { return name }
+	if ent,e := d.Dir.Lookup(name); e==nil { return ent.Name }
+	if n,e := d.Dir.Names.Normalize(name); e==nil { return n }
+	return name
+}
 func (d *DirNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	name = d.stored(name)
 	ino := d.Inode()
 	c := ino.GetChild(name)
 	if c!=nil {
@@ -80,7 +137,7 @@ func (d *DirNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*n
 	if e==io.EOF { return nil,fuse.ENOENT }
 	if e!=nil { return nil,fuse.ENOENT }
 	
-	dir,nd,st := opennode(d.Backing.FS,ent)
+	dir,nd,st := opennode(d,ent)
 	if !st.Ok() { return nil,st }
 	st = nd.GetAttr(out,nil,context)
 	
@@ -89,57 +146,69 @@ func (d *DirNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*n
 	if !st.Ok() { cld = nil }
 	return cld,st
 }
+/*
+ Lists the whole directory, as required by nodefs. The lock is only held while
+ a segment is read. Servers using RawFS stream the listing instead.
+ */
 func (d *DirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	d.Lock.Lock()
-	defer d.Lock.Unlock()
 	arr := []fuse.DirEntry{}
-	
-	cho := make(chan ods.DirectoryEntry,10)
-	go d.Dir.ListUp(cho)
-	
-	for rdi := range cho {
+	cur := d.openCursor()
+	defer d.closeCursor(cur)
+	for {
+		rdi,_,e := cur.Peek()
+		if e!=nil { break }
+		cur.Skip()
 		var ent fuse.DirEntry
 		ent.Name = rdi.Name
-		switch rdi.Value.FileType {
-		case ods.FT_FILE:
-			ent.Mode = fuse.S_IFREG
-		case ods.FT_DIR:
-			ent.Mode = fuse.S_IFDIR
-		case ods.FT_FIFO:
-			ent.Mode = fuse.S_IFIFO
-		default: continue
-		}
+		ent.Mode = filemode(rdi.Value.FileType)
+		if ent.Mode==0 { continue }
 		arr = append(extendArray(arr),ent)
 	}
 	return arr,fuse.OK
 }
-func (d *DirNode) mkobj(name string, ft uint8) (ent ods.DirectoryEntryValue, code fuse.Status) {
+func (d *DirNode) openCursor() *ods.DirCursor {
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+	cur := d.Dir.OpenCursor()
+	cur.Lock = &d.Lock
+	return cur
+}
+func (d *DirNode) closeCursor(cur *ods.DirCursor) {
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+	cur.Close()
+}
+func (d *DirNode) mkobj(name string, ft uint8, context *fuse.Context) (ent ods.DirectoryEntryValue, stored string, code fuse.Status) {
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
 	_,_,e := d.Dir.Search(name)
 	if e!= io.EOF { code = fuse.Status(syscall.EEXIST); return }
-	f,e := d.Backing.FS.CreateFile(ft)
-	if e!=nil { code = fuse.EIO; return }
+	stored,e = d.Dir.Names.Normalize(name)
+	if e!=nil { code = errstatus(e); return }
+	f,e := d.Backing.FS.CreateFileOwned(ft,security.UidSID(context.Uid),security.GidSID(context.Gid))
+	if e!=nil { code = errstatus(e); return }
 	mfte,e := f.GetMFTE()
 	if e!=nil { code = fuse.EIO; return }
 	ent.File_MFT = mfte.File_MFT
 	ent.File_IDX = mfte.File_IDX
 	ent.Cookie   = mfte.Cookie
 	ent.FileType = mfte.FileType
-	e = d.Dir.Add(ods.DirectoryEntry{name,ent})
-	if e!=nil { code = fuse.EIO; return }
+	e = d.Dir.Add(ods.DirectoryEntry{stored,ent})
+	if e!=nil { code = errstatus(e); return }
 	code = fuse.OK
 	return
 }
 func (d *DirNode) Mkdir(name string, mode uint32, context *fuse.Context) (*nodefs.Inode,fuse.Status) {
+	if d.Backing.FS.ReadOnly { return nil,erofs }
 	ino := d.Inode()
-	ent,st := d.mkobj(name,ods.FT_DIR)
+	ent,name,st := d.mkobj(name,ods.FT_DIR,context)
 	if !st.Ok() { return nil,st }
-	dir,nd,st := opennode(d.Backing.FS,ent)
+	dir,nd,st := opennode(d,ent)
 	if !st.Ok() { return nil,st }
 	return ino.NewChild(name,dir,nd),fuse.OK
 }
 func (d *DirNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if d.Backing.FS.ReadOnly { return nil,erofs }
 	ino := d.Inode()
 	ft := uint8(0)
 	uft := mode & syscall.S_IFMT
@@ -149,26 +218,37 @@ func (d *DirNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Cont
 	case fuse.S_IFIFO:
 		ft = ods.FT_FIFO
 	case syscall.S_IFSOCK:
-		mm := new(ModeNode)
-		mm.Node = nodefs.NewDefaultNode()
-		mm.Attr.Mode = mode
-		ci := ino.GetChild(name)
-		if ci!=nil { return nil,fuse.Status(syscall.EEXIST) }
-		return ino.NewChild(name,false,mm),fuse.OK
+		ft = ods.FT_SOCK
+	case syscall.S_IFCHR:
+		ft = ods.FT_CHR
+	case syscall.S_IFBLK:
+		ft = ods.FT_BLK
 	default:
 		return nil,fuse.EINVAL
 	}
-	ent,st := d.mkobj(name,ft)
+	ent,name,st := d.mkobj(name,ft,context)
 	if !st.Ok() { return nil,st }
-	dir,nd,st := opennode(d.Backing.FS,ent)
+	if ft==ods.FT_CHR || ft==ods.FT_BLK {
+		mdf,e := d.Backing.FS.GetFile(ent.File_MFT,ent.File_IDX).GetMDF()
+		if e==nil { e = mdf.SetRdev(uint64(dev)) }
+		if e!=nil {
+			d.Lock.Lock()
+			d.Dir.Delete(name)
+			d.Lock.Unlock()
+			d.Backing.FS.Decrement(ent.File_MFT,ent.File_IDX)
+			return nil,fuse.EIO
+		}
+	}
+	dir,nd,st := opennode(d,ent)
 	if !st.Ok() { return nil,st }
 	return ino.NewChild(name,dir,nd),fuse.OK
 }
 func (d *DirNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File,*nodefs.Inode,fuse.Status) {
+	if d.Backing.FS.ReadOnly { return nil,nil,erofs }
 	ino := d.Inode()
-	ent,st := d.mkobj(name,ods.FT_FILE)
+	ent,name,st := d.mkobj(name,ods.FT_FILE,context)
 	if !st.Ok() { return nil,nil,st }
-	dir,nd,st := opennode(d.Backing.FS,ent)
+	dir,nd,st := opennode(d,ent)
 	if !st.Ok() { return nil,nil,st }
 	fobj,st := nd.Open(flags,context)
 	if !st.Ok() {
@@ -178,9 +258,11 @@ func (d *DirNode) Create(name string, flags uint32, mode uint32, context *fuse.C
 	return fobj,ino.NewChild(name,dir,nd),fuse.OK
 }
 func (d *DirNode) Unlink(name string, context *fuse.Context) fuse.Status {
+	if d.Backing.FS.ReadOnly { return erofs }
 	ino := d.Inode()
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	name = d.stored(name)
 	_,ent,err := d.Dir.Search(name)
 	if err!=nil {
 		if ino.RmChild(name)!=nil { return fuse.OK } /* Transient Entries return OK. */
@@ -200,9 +282,11 @@ func (d *DirNode) Unlink(name string, context *fuse.Context) fuse.Status {
 	return fuse.OK
 }
 func (d *DirNode) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if d.Backing.FS.ReadOnly { return erofs }
 	ino := d.Inode()
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	name = d.stored(name)
 	_,ent,err := d.Dir.Search(name)
 	if err!=nil { return fuse.ENOENT }
 	if ent.FileType!=ods.FT_DIR { return fuse.ENOTDIR }
@@ -227,6 +311,11 @@ func (d *DirNode) rename_in(oldName string, newName string, context *fuse.Contex
 	ino := d.Inode()
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	oldName = d.stored(oldName)
+	if d.Dir.Names!=0 && d.Dir.Names.Key(oldName)==d.Dir.Names.Key(newName) {
+		return d.respell(oldName,newName)
+	}
+	newName = d.stored(newName)
 	{
 		_,oent,oerr := d.Dir.Search(newName)
 		if oerr!=nil && oent.FileType == ods.FT_DIR {
@@ -257,10 +346,28 @@ func (d *DirNode) rename_in(oldName string, newName string, context *fuse.Contex
 	}
 	return fuse.ENOENT
 }
+/* Renames an entry to a name, that differs only in case or normalization. The lock must be held. */
+func (d *DirNode) respell(oldName string, newName string) fuse.Status {
+	ino := d.Inode()
+	newName,e := d.Dir.Names.Normalize(newName)
+	if e!=nil { return errstatus(e) }
+	if newName==oldName { return fuse.OK }
+	ent,e := d.Dir.Delete(oldName)
+	if e!=nil { return fuse.ENOENT }
+	e = d.Dir.Add(ods.DirectoryEntry{newName,ent})
+	if e!=nil {
+		d.Dir.Add(ods.DirectoryEntry{oldName,ent})
+		return errstatus(e)
+	}
+	on := ino.RmChild(oldName)
+	if on!=nil { ino.AddChild(newName,on) }
+	return fuse.OK
+}
 func (d *DirNode) move_into(name string,ent ods.DirectoryEntryValue,nch *nodefs.Inode, context *fuse.Context) fuse.Status {
 	ino := d.Inode()
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	name = d.stored(name)
 	_,oent,oerr := d.Dir.Search(name)
 	if oerr!=nil && oent.FileType == ods.FT_DIR {
 		return fuse.Status(syscall.EISDIR)
@@ -284,6 +391,7 @@ func (d *DirNode) move_out_1(name string) (nch *nodefs.Inode,ent ods.DirectoryEn
 	ino := d.Inode()
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	name = d.stored(name)
 	
 	_,ent,err = d.Dir.Search(name)
 	if err!=nil { return }
@@ -295,6 +403,7 @@ func (d *DirNode) move_out_2(name string) (err error) {
 	ino := d.Inode()
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	name = d.stored(name)
 	_,err = d.Dir.Delete(name)
 	if err!=nil { ino.RmChild(name) }
 	return
@@ -303,10 +412,12 @@ func (d *DirNode) move_out_rollback(name string,nch *nodefs.Inode) {
 	ino := d.Inode()
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
+	name = d.stored(name)
 	ino.RmChild(name)
 	ino.AddChild(name,nch)
 }
 func (d *DirNode) Rename(oldName string, newParent nodefs.Node, newName string, context *fuse.Context) fuse.Status {
+	if d.Backing.FS.ReadOnly { return erofs }
 	target,ok := newParent.(*DirNode)
 	if !ok { return fuse.EINVAL }
 	if d==target { return d.rename_in(oldName,newName,context) }
@@ -327,16 +438,19 @@ func (d *DirNode) Rename(oldName string, newParent nodefs.Node, newName string,
 		return st
 	}
 }
-func (d *DirNode) link_ll(name string, ent ods.DirectoryEntryValue) (ok bool,err error){
+func (d *DirNode) link_ll(name string, ent ods.DirectoryEntryValue) (stored string,ok bool,err error){
 	d.Lock.Lock()
 	defer d.Lock.Unlock()
 	_,_,oerr := d.Dir.Search(name)
-	if oerr==io.EOF { return false,nil }
-	err = d.Dir.Add(ods.DirectoryEntry{name,ent})
+	if oerr==io.EOF { return name,false,nil }
+	stored,err = d.Dir.Names.Normalize(name)
+	if err!=nil { return }
+	err = d.Dir.Add(ods.DirectoryEntry{stored,ent})
 	ok = true
 	return
 }
 func (d *DirNode) Link(name string, existing nodefs.Node, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if d.Backing.FS.ReadOnly { return nil,erofs }
 	var ent ods.DirectoryEntryValue
 	var mfte *ods.MFTE = nil
 	var e error
@@ -366,11 +480,11 @@ func (d *DirNode) Link(name string, existing nodefs.Node, context *fuse.Context)
 		ent.File_IDX = mfte.File_IDX
 		ent.Cookie   = mfte.Cookie
 		ent.FileType = mfte.FileType
-		ok,err := d.link_ll(name,ent)
-		if err!=nil { return nil,fuse.EIO }
+		name,ok,err := d.link_ll(name,ent)
+		if err!=nil { return nil,errstatus(err) }
 		if !ok { return nil,fuse.Status(syscall.EEXIST) }
 		d.Backing.FS.Increment(mfte.File_MFT,mfte.File_IDX)
-		dir,nd,st := opennode(d.Backing.FS,ent)
+		dir,nd,st := opennode(d,ent)
 		if !st.Ok() { return nil,st }
 		return d.Inode().NewChild(name,dir,nd),fuse.OK
 	}
@@ -29,29 +29,43 @@ import "github.com/hanwen/go-fuse/fuse/nodefs"
 
 //import "github.com/maxymania/anyfs/debug"
 
+import "github.com/maxymania/anyfs/dskimg"
 import "github.com/maxymania/anyfs/dskimg/fs1"
 import "os"
+import "io"
 
 import "fmt"
 
 const ANYWRITE = uint32(os.O_WRONLY | os.O_RDWR | os.O_APPEND)
 
+/* FUSE_FSYNC_FDATASYNC */
+const FSYNC_DATASYNC = 1
+
 func read(f* fs1.AutoGrowingFile,dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	if len(dest)==0 { return fuse.ReadResultData([]byte{}),fuse.OK }
+	f.Accessed()
 	l,_ := f.Franges(off,len(dest))
 	if len(l)==0 { return nil,fuse.EIO }
-	if len(l)==1 {
+	/*
+	 The kernel reads the fd after we returned, without the file lock, and
+	 go-fuse does not report, when it is done. On a tiered volume, Migrate may
+	 free the blocks at any time, so they could be reused before the read.
+	 */
+	if len(l)==1 && !f.FS.Tiered() {
 		ll := l[0]
-		return fuse.ReadResultFd(ll.Device.Fd(),ll.Pos,int(ll.Len)),fuse.OK
+		if fd,ok := dskimg.DeviceFd(ll.Device); ok {
+			return fuse.ReadResultFd(fd,ll.Pos,int(ll.Len)),fuse.OK
+		}
 	}
-	n,e := fs1.ReadFileRanges(l,dest)
-	if e!=nil { return nil,fuse.ToStatus(e) }
+	/* Read under the file lock, the ranges may have moved in the meantime. */
+	n,e := f.ReadAt(dest,off)
+	if e!=nil && e!=io.EOF { return nil,fuse.ToStatus(e) }
 	return fuse.ReadResultData(dest[:n]),fuse.OK
 }
 func write(f* fs1.AutoGrowingFile,data []byte, off int64) (uint32, fuse.Status) {
 	if len(data)==0 { return 0,fuse.OK }
-	n,_ := f.WriteAt(data,off)
-	if n==0 { return 0,fuse.EIO }
+	n,e := f.WriteAt(data,off)
+	if n==0 { if e==nil { e = fs1.EIO }; return 0,errstatus(e) }
 	return uint32(n),fuse.OK
 }
 
@@ -65,12 +79,15 @@ func (f *FileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Conte
 	if e!=nil { return fuse.EIO }
 	out.Mode = fuse.S_IFREG | 0666
 	out.Size = uint64(mfte.FileSize)
+	mfteattr(out,mfte)
 	return fuse.OK
 }
 func (f *FileNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if f.Backing.FS.ReadOnly && (flags&(ANYWRITE|uint32(os.O_TRUNC)))!=0 { return nil,erofs }
 	if (flags&uint32(os.O_TRUNC))!=0 {
 		f.Backing.Resize(0)
 	}
+	f.Backing.FS.Hold(f.Backing.MFT,f.Backing.FID)
 	var fobj nodefs.File = &FileFile{nodefs.NewDefaultFile(),f.Backing}
 	if (flags&ANYWRITE)==0 {
 		fobj = nodefs.NewReadOnlyFile(fobj)
@@ -95,7 +112,7 @@ func (f *FileNode) Write(file nodefs.File, data []byte, off int64, context *fuse
 func (f *FileNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) (fuse.Status) {
 	if file!=nil { return f.Node.Truncate(file,size,context) }
 	e := f.Backing.Resize(int64(size))
-	if e!=nil { return fuse.EIO }
+	if e!=nil { return errstatus(e) }
 	return fuse.OK
 }
 
@@ -114,7 +131,7 @@ func (f* FileFile) Write(data []byte, off int64) (uint32, fuse.Status) {
 }
 func (f* FileFile) Truncate(size uint64) fuse.Status {
 	e := f.Backing.Resize(int64(size))
-	if e!=nil { return fuse.EIO }
+	if e!=nil { return errstatus(e) }
 	return fuse.OK
 }
 func (f* FileFile) GetAttr(out *fuse.Attr) fuse.Status {
@@ -122,9 +139,22 @@ func (f* FileFile) GetAttr(out *fuse.Attr) fuse.Status {
 	if e!=nil { return fuse.EIO }
 	out.Mode = fuse.S_IFREG | 0666
 	out.Size = uint64(mfte.FileSize)
+	mfteattr(out,mfte)
+	return fuse.OK
+}
+func (f *FileFile) Flush() fuse.Status {
+	f.Backing.FlushMetadata()
+	return fuse.OK
+}
+/* Drops the open reference; deletes the file, if it has been unlinked. */
+func (f *FileFile) Release() {
+	f.Backing.FlushMetadata()
+	f.Backing.FS.Release(f.Backing.MFT,f.Backing.FID)
+}
+func (f *FileFile) Fsync(flags int) fuse.Status {
+	e := f.Backing.Sync((flags&FSYNC_DATASYNC)!=0)
+	if e!=nil { return errstatus(e) }
 	return fuse.OK
 }
-func (f *FileFile) Flush() fuse.Status { return fuse.OK }
-func (f *FileFile) Fsync(flags int) fuse.Status { return fuse.OK }
 
 
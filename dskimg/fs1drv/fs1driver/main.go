@@ -28,10 +28,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	
+	"github.com/maxymania/anyfs/dskimg"
 	"github.com/maxymania/anyfs/dskimg/fs1"
 	"github.com/maxymania/anyfs/dskimg/fs1drv"
 	
@@ -41,10 +45,17 @@ import (
 
 var debug = flag.Bool("debug", false, "print debugging messages.")
 var image = flag.String("image", "", "The file-system image to be formatted")
+var slow = flag.String("slow", "", "The slow tier of a tiered image")
+var mirror = flag.String("mirror", "", "Comma separated images, that mirror -image (RAID1)")
 var mount = flag.String("mount", "", "Mount-Point")
 var offset = flag.Int("sbo",512,"Superblock Offset")
 
-var nosync = flag.Bool("nosync", false, "Deactivates synchronous writes")
+var nosync = flag.Bool("nosync", false, "Write-back mode: only fsync and unmount synchronize the image")
+var cache = flag.Int("cache", 0, "Number of blocks to cache MFT, Bitmap and directory I/O in (0 = no cache)")
+var cachewb = flag.Bool("cachewb", false, "Write-back cache: cached blocks are only written on eviction, fsync and unmount")
+
+var force = flag.Bool("force", false, "Mount even if the image is in use or has not been cleanly unmounted")
+var readonly = flag.Bool("ro", false, "Mount read-only; the image is opened O_RDONLY")
 
 var trace = flag.Bool("trace", false, "print deep tracing messages")
 
@@ -56,7 +67,9 @@ func main() {
 		flag.PrintDefaults()
 		return
 	}
-	f,e := os.OpenFile(*image,os.O_RDWR,0666) // 
+	mode := os.O_RDWR
+	if *readonly { mode = os.O_RDONLY }
+	f,e := openImage(mode)
 	if e!=nil {
 		fmt.Println("Error: ",e)
 		flag.PrintDefaults()
@@ -66,34 +79,99 @@ func main() {
 	fs := new(fs1.FileSystem)
 	fs.Device = f
 	fs.NoSync = *nosync
+	fs.ReadOnly = *readonly
+	fs.CacheBlocks = *cache
+	fs.CacheWriteBack = *cachewb
+	fs.ForceLock = *force
 	e = fs.LoadFileSystem(int64(*offset))
+	if inUse(e) {
+		fmt.Println("Error: ",e,"(use -force to mount anyway)")
+		os.Exit(1)
+	}
 	if e!=nil {
 		fmt.Println("Error: ",e)
 		flag.PrintDefaults()
 		return
 	}
-	rd := fs.GetRootDir()
-	rdir,e := rd.AsDirectory()
+	e = fs.Mount(*force)
+	if e==fs1.EDirty || inUse(e) {
+		fmt.Println("Error: ",e,"(use -force to mount anyway)")
+		os.Exit(1)
+	}
+	if e!=nil {
+		fmt.Println("Error: ",e)
+		os.Exit(1)
+	}
+	if *readonly && !fs.IsClean() {
+		fmt.Println("Warning: the image has not been cleanly unmounted")
+	}
+	root,e := fs1drv.NewRoot(fs)
 	if e!=nil {
 		fmt.Println("Error: ",e)
 		flag.PrintDefaults()
 		return
 	}
 	
-	root := new(fs1drv.DirNode)
-	root.Node = nodefs.NewDefaultNode()
-	root.Backing = rd
-	root.Dir = rdir
+	mopts := &fuse.MountOptions{
+		Debug: *debug,
+	}
+	if *readonly { mopts.Options = append(mopts.Options,"ro") }
 	
 	conn := nodefs.NewFileSystemConnector(root, nil)
-	server, err := fuse.NewServer(conn.RawFS(), *mount, &fuse.MountOptions{
-		Debug: *debug,
-	})
+	server, err := fuse.NewServer(fs1drv.NewRawFS(conn,root), *mount, mopts)
 	if err != nil {
 		fmt.Printf("Mount fail: %v\n", err)
+		fs.Unmount()
 		os.Exit(1)
 	}
+	go unmountOnSignal(server)
 	fmt.Println("Mounted!")
 	server.Serve()
+	e = fs.Unmount()
+	if e!=nil {
+		fmt.Println("Unmount failed: ",e)
+		os.Exit(1)
+	}
+}
+
+/* Opens the image, or the mirror and resynchronizes its stale replicas in the background. */
+func openImage(mode int) (dskimg.DeviceCloser,error) {
+	if *mirror=="" { return dskimg.OpenImage(*image,*slow,mode) }
+	if *slow!="" { return nil,fmt.Errorf("-mirror can not be combined with -slow") }
+	names := append([]string{*image},strings.Split(*mirror,",")...)
+	m,e := dskimg.OpenMirror(names,mode,false)
+	if e!=nil { return nil,e }
+	for i,st := range m.Status() {
+		if st.State!=dskimg.REPLICA_DEGRADED { continue }
+		fmt.Println("Warning: replica",names[i],"is out of date")
+		if *readonly { continue }
+		go func(i int) {
+			e := <-m.Resync(i)
+			if e!=nil {
+				fmt.Println("Resynchronizing",names[i],"failed: ",e)
+			} else {
+				fmt.Println("Resynchronized",names[i])
+			}
+		}(i)
+	}
+	return m,nil
+}
+
+func inUse(e error) bool {
+	if e==dskimg.ELocked { return true }
+	_,ok := e.(*fs1.InUseError)
+	return ok
+}
+
+/* Unmounts on SIGINT/SIGTERM; server.Serve() returns afterwards. */
+func unmountOnSignal(server *fuse.Server) {
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,os.Interrupt,syscall.SIGTERM)
+	for s := range sig {
+		fmt.Println("Got",s,"- unmounting")
+		err := server.Unmount()
+		if err==nil { return }
+		fmt.Println("Unmount failed: ",err)
+	}
 }
 
@@ -0,0 +1,383 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+/*
+Mount helper for fs1 images.
+
+	mount.fs1 <image> <mountpoint> [-sfnv] [-o option[,option...]]
+
+Install it as /sbin/mount.fuse.fs1 (or /sbin/mount.fs1) to use fs1 images with
+"mount -t fuse.fs1" and in /etc/fstab:
+
+	/srv/disk.img  /mnt/disk  fuse.fs1  sbo=512,allow_other,uid=1000,gid=1000  0 0
+
+Options:
+
+	ro, rw            read-only or read-write mount (default rw)
+	sync, async       write-through (default) or write-back mode
+	discard           release freed blocks on the image (punch holes)
+	sbo=N             superblock offset (default 512)
+	slow=PATH         the slow tier of a tiered image
+	mirror=PATH[:PATH...]
+	                  images, that mirror the image (RAID1); stale ones are
+	                  resynchronized in the background
+	cache=N           number of blocks to cache MFT, Bitmap and directory I/O in
+	cache_writeback   write cached blocks only on eviction, fsync and unmount
+	allow_other       allow access to other users
+	default_permissions
+	                  let the kernel check permissions
+	uid=N, gid=N      report every file as owned by uid/gid
+	force             mount even if the image is in use or unclean
+	debug             print FUSE debugging messages (implies foreground)
+	trace             print deep tracing messages (implies foreground)
+	foreground        do not daemonize
+
+The generic options (defaults, auto, noauto, user, nofail, _netdev, x-*, ...)
+are ignored. The program daemonizes after a successful mount. Exit codes follow
+mount(8): 1 for incorrect invocation, 2 for system errors, 32 for mount failures.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	
+	"github.com/maxymania/anyfs/dskimg"
+	"github.com/maxymania/anyfs/dskimg/fs1"
+	"github.com/maxymania/anyfs/dskimg/fs1drv"
+	
+	dbgpkg "github.com/maxymania/anyfs/debug"
+)
+
+/* Exit codes, as defined by mount(8). */
+const (
+	EX_SUCCESS = 0
+	EX_USAGE   = 1
+	EX_SYSERR  = 2
+	EX_FAIL    = 32
+)
+
+/* Set in the environment of the daemon; the status pipe is fd 3. */
+const daemonEnv = "MOUNT_FS1_DAEMON"
+
+type exitError struct{
+	Code int
+	Msg  string
+}
+func (e *exitError) Error() string { return e.Msg }
+func fail(code int, format string, args ...interface{}) error {
+	return &exitError{code,fmt.Sprintf(format,args...)}
+}
+
+type options struct{
+	image, mount, slow, mirror string
+	readonly, nosync, force, discard bool
+	sbo, cache int
+	cacheWriteBack bool
+	allowOther, defaultPermissions bool
+	uid, gid int
+	debug, trace, foreground bool
+	sloppy, fake, verbose bool
+}
+
+func usage() error {
+	return fail(EX_USAGE,"usage: mount.fs1 <image> <mountpoint> [-sfnv] [-o option[,option...]]")
+}
+
+func parseArgs(args []string) (*options,error) {
+	o := &options{sbo:512,uid:-1,gid:-1}
+	var pos []string
+	var opts []string
+	for i := 0 ; i<len(args) ; i++ {
+		a := args[i]
+		switch {
+		case a=="-o":
+			i++
+			if i>=len(args) { return nil,usage() }
+			opts = append(opts,args[i])
+		case strings.HasPrefix(a,"-o"):
+			opts = append(opts,a[2:])
+		case a=="-t" || a=="-N":
+			i++ // type or namespace: not used.
+		case len(a)>1 && a[0]=='-':
+			for _,c := range a[1:] {
+				switch c {
+				case 's': o.sloppy = true
+				case 'f': o.fake = true
+				case 'v': o.verbose = true
+				case 'n': // no mtab
+				default: return nil,usage()
+				}
+			}
+		default:
+			pos = append(pos,a)
+		}
+	}
+	if len(pos)!=2 { return nil,usage() }
+	o.image,o.mount = pos[0],pos[1]
+	for _,s := range opts {
+		for _,opt := range strings.Split(s,",") {
+			e := o.parseOption(opt)
+			if e!=nil { return nil,e }
+		}
+	}
+	return o,nil
+}
+
+func (o *options) parseOption(opt string) error {
+	key,val := opt,""
+	if i := strings.IndexByte(opt,'='); i>=0 { key,val = opt[:i],opt[i+1:] }
+	num := func(min int) (int,error) {
+		n,e := strconv.Atoi(val)
+		if e!=nil || n<min { return 0,fail(EX_USAGE,"invalid value for option %s",opt) }
+		return n,nil
+	}
+	var e error
+	switch key {
+	case "ro": o.readonly = true
+	case "rw": o.readonly = false
+	case "sync": o.nosync = false
+	case "async": o.nosync = true
+	case "discard": o.discard = true
+	case "nodiscard": o.discard = false
+	case "sbo": o.sbo,e = num(0)
+	case "slow": o.slow = val
+	case "mirror": o.mirror = val
+	case "cache": o.cache,e = num(0)
+	case "cache_writeback": o.cacheWriteBack = true
+	case "allow_other": o.allowOther = true
+	case "default_permissions": o.defaultPermissions = true
+	case "uid": o.uid,e = num(0)
+	case "gid": o.gid,e = num(0)
+	case "force": o.force = true
+	case "debug": o.debug = true
+	case "trace": o.trace = true
+	case "foreground": o.foreground = true
+	case "","defaults","auto","noauto","user","nouser","users","owner","group","nofail","_netdev",
+		"dev","nodev","suid","nosuid","exec","noexec","atime","noatime","relatime","diratime","nodiratime":
+	default:
+		if strings.HasPrefix(key,"x-") || strings.HasPrefix(key,"comment") || o.sloppy { break }
+		return fail(EX_USAGE,"unknown option %s",opt)
+	}
+	return e
+}
+
+func inUse(e error) bool {
+	if e==dskimg.ELocked { return true }
+	_,ok := e.(*fs1.InUseError)
+	return ok
+}
+
+/* Opens the image, or the mirror and resynchronizes its stale replicas in the background. */
+func openImage(o *options, mode int) (dskimg.DeviceCloser,error) {
+	if o.mirror=="" { return dskimg.OpenImage(o.image,o.slow,mode) }
+	if o.slow!="" { return nil,fmt.Errorf("mirror can not be combined with slow") }
+	names := append([]string{o.image},strings.Split(o.mirror,":")...)
+	m,e := dskimg.OpenMirror(names,mode,false)
+	if e!=nil { return nil,e }
+	for i,st := range m.Status() {
+		if st.State!=dskimg.REPLICA_DEGRADED || o.readonly { continue }
+		go func(i int) {
+			/* The daemon has no terminal; the replica stays stale and is tried again next time. */
+			e := <-m.Resync(i)
+			if e!=nil {
+				fmt.Fprintln(os.Stderr,"mount.fs1: resynchronizing",names[i],"failed:",e)
+			} else if o.verbose {
+				fmt.Println("mount.fs1: resynchronized",names[i])
+			}
+		}(i)
+	}
+	return m,nil
+}
+
+/* Loads the image and mounts it. The caller runs the returned server. */
+func mount(o *options) (*fuse.Server,*fs1.FileSystem,error) {
+	mode := os.O_RDWR
+	if o.readonly { mode = os.O_RDONLY }
+	f,e := openImage(o,mode)
+	if e!=nil { return nil,nil,fail(EX_SYSERR,"%v",e) }
+	dbgpkg.TraceOn = o.trace
+	fs := new(fs1.FileSystem)
+	fs.Device = f
+	fs.NoSync = o.nosync
+	fs.Discard = o.discard
+	fs.ReadOnly = o.readonly
+	fs.CacheBlocks = o.cache
+	fs.CacheWriteBack = o.cacheWriteBack
+	fs.ForceLock = o.force
+	e = fs.LoadFileSystem(int64(o.sbo))
+	if inUse(e) {
+		f.Close()
+		return nil,nil,fail(EX_FAIL,"%s: %v (use -o force to mount anyway)",o.image,e)
+	}
+	if e!=nil {
+		f.Close()
+		return nil,nil,fail(EX_FAIL,"%s: %v",o.image,e)
+	}
+	e = fs.Mount(o.force)
+	if e==fs1.EDirty || inUse(e) {
+		f.Close()
+		return nil,nil,fail(EX_FAIL,"%s: %v (use -o force to mount anyway)",o.image,e)
+	}
+	if e!=nil {
+		f.Close()
+		return nil,nil,fail(EX_FAIL,"%s: %v",o.image,e)
+	}
+	root,e := fs1drv.NewRoot(fs)
+	if e!=nil {
+		fs.Unmount()
+		return nil,nil,fail(EX_FAIL,"%s: %v",o.image,e)
+	}
+	
+	nopts := nodefs.NewOptions()
+	if o.uid>=0 { nopts.Owner.Uid = uint32(o.uid) }
+	if o.gid>=0 { nopts.Owner.Gid = uint32(o.gid) }
+	mopts := &fuse.MountOptions{
+		AllowOther: o.allowOther,
+		FsName: o.image,
+		Name: "fs1",
+		Debug: o.debug,
+	}
+	if o.readonly { mopts.Options = append(mopts.Options,"ro") }
+	if o.defaultPermissions { mopts.Options = append(mopts.Options,"default_permissions") }
+	
+	conn := nodefs.NewFileSystemConnector(root, nopts)
+	server,e := fuse.NewServer(fs1drv.NewRawFS(conn,root), o.mount, mopts)
+	if e!=nil {
+		fs.Unmount()
+		return nil,nil,fail(EX_FAIL,"%s: %v",o.mount,e)
+	}
+	return server,fs,nil
+}
+
+/* Unmounts on SIGINT/SIGTERM/SIGHUP; server.Serve() returns afterwards. */
+func unmountOnSignal(server *fuse.Server) {
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,os.Interrupt,syscall.SIGTERM,syscall.SIGHUP)
+	for range sig {
+		if server.Unmount()==nil { return }
+	}
+}
+
+/*
+Starts the daemon and waits until it reports the outcome of the mount.
+The daemon writes one status byte, followed by an error message, to its fd 3.
+It runs the same executable (os.Args[0] may be a name looked up in PATH or a
+path relative to the caller's directory), with stdin, stdout and stderr on
+/dev/null, so it does not hold on to the caller's terminal or pipes.
+*/
+func daemonize() int {
+	exe,e := os.Executable()
+	if e!=nil {
+		fmt.Fprintln(os.Stderr,"mount.fs1:",e)
+		return EX_SYSERR
+	}
+	null,e := os.OpenFile(os.DevNull,os.O_RDWR,0)
+	if e!=nil {
+		fmt.Fprintln(os.Stderr,"mount.fs1:",e)
+		return EX_SYSERR
+	}
+	defer null.Close()
+	r,w,e := os.Pipe()
+	if e!=nil {
+		fmt.Fprintln(os.Stderr,"mount.fs1:",e)
+		return EX_SYSERR
+	}
+	cmd := exec.Command(exe,os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(),daemonEnv+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = null
+	cmd.Stderr = null
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid:true}
+	e = cmd.Start()
+	w.Close()
+	if e!=nil {
+		fmt.Fprintln(os.Stderr,"mount.fs1:",e)
+		return EX_SYSERR
+	}
+	status,_ := ioutil.ReadAll(r)
+	if len(status)==0 {
+		e = cmd.Wait()
+		fmt.Fprintln(os.Stderr,"mount.fs1: daemon died:",e)
+		return EX_FAIL
+	}
+	if status[0]!=EX_SUCCESS {
+		fmt.Fprintln(os.Stderr,"mount.fs1:",string(bytes.TrimSpace(status[1:])))
+	}
+	return int(status[0])
+}
+
+func main() {
+	o,e := parseArgs(os.Args[1:])
+	if e!=nil {
+		fmt.Fprintln(os.Stderr,"mount.fs1:",e)
+		os.Exit(EX_USAGE)
+	}
+	if o.fake { return }
+	if o.debug || o.trace { o.foreground = true }
+	isDaemon := os.Getenv(daemonEnv)!=""
+	if !isDaemon && !o.foreground { os.Exit(daemonize()) }
+	
+	report := func(code int, msg string) {}
+	if isDaemon {
+		status := os.NewFile(3,"status")
+		report = func(code int, msg string) {
+			status.Write(append([]byte{byte(code)},msg...))
+			status.Close()
+		}
+	}
+	
+	server,fs,e := mount(o)
+	if e!=nil {
+		code := EX_SYSERR
+		if ee,ok := e.(*exitError); ok { code = ee.Code }
+		report(code,e.Error())
+		if !isDaemon { fmt.Fprintln(os.Stderr,"mount.fs1:",e) }
+		os.Exit(code)
+	}
+	go unmountOnSignal(server)
+	go func() {
+		server.WaitMount()
+		if o.verbose && !isDaemon { fmt.Println("mount.fs1: mounted",o.image,"on",o.mount) }
+		report(EX_SUCCESS,"")
+	}()
+	server.Serve()
+	e = fs.Unmount()
+	if e!=nil {
+		if !isDaemon { fmt.Fprintln(os.Stderr,"mount.fs1: unmount failed:",e) }
+		os.Exit(EX_SYSERR)
+	}
+}
@@ -30,8 +30,43 @@ import "github.com/hanwen/go-fuse/fuse/nodefs"
 import "github.com/maxymania/anyfs/dskimg/fs1"
 import "github.com/maxymania/anyfs/dskimg/ods"
 
-func opennode(fs *fs1.FileSystem, ent ods.DirectoryEntryValue) (bool,nodefs.Node,fuse.Status) {
-	file := fs.GetFile(ent.File_MFT,ent.File_IDX)
+import "syscall"
+
+var erofs = fuse.Status(syscall.EROFS)
+
+func errstatus(e error) fuse.Status {
+	switch e {
+	case nil: return fuse.OK
+	case ods.EQuota: return fuse.Status(syscall.EDQUOT)
+	case fs1.EReadOnly: return erofs
+	case ods.ELongname: return fuse.Status(syscall.ENAMETOOLONG)
+	case ods.EBadName: return fuse.Status(syscall.EILSEQ)
+	}
+	return fuse.EIO
+}
+
+/* Returns the S_IFMT bits for a file type, or 0. */
+func filemode(ft uint8) uint32 {
+	switch ft {
+	case ods.FT_FILE: return fuse.S_IFREG
+	case ods.FT_DIR:  return fuse.S_IFDIR
+	case ods.FT_FIFO: return fuse.S_IFIFO
+	case ods.FT_SOCK: return syscall.S_IFSOCK
+	case ods.FT_CHR:  return syscall.S_IFCHR
+	case ods.FT_BLK:  return syscall.S_IFBLK
+	}
+	return 0
+}
+
+/* Fills in the attributes, that are derived from the MFT entry. */
+func mfteattr(out *fuse.Attr, mfte *ods.MFTE) {
+	out.Ino   = fs1.InodeNumber(mfte.File_MFT,mfte.File_IDX)
+	out.Nlink = mfte.RefCount
+	if out.Nlink>=fs1.REFCOUNT_PINNED { out.Nlink = 1 }
+}
+
+func opennode(parent *DirNode, ent ods.DirectoryEntryValue) (bool,nodefs.Node,fuse.Status) {
+	file := parent.Backing.FS.GetFile(ent.File_MFT,ent.File_IDX)
 	mfte,e := file.GetMFTE()
 	if e!=nil { return false,nil,fuse.EIO }
 	if mfte.Cookie!=ent.Cookie { return false,nil,fuse.EINVAL } /* XXX Cookie error: delete the entry. */
@@ -47,14 +82,22 @@ func opennode(fs *fs1.FileSystem, ent ods.DirectoryEntryValue) (bool,nodefs.Node
 		dn.Node = nodefs.NewDefaultNode()
 		dn.Backing = file
 		dn.Dir = d
+		dn.tab = parent.tab
+		dn.tab.add(dn)
 		return true,dn,fuse.OK
 		}
-	case ods.FT_FIFO:{
+	case ods.FT_FIFO,ods.FT_SOCK,ods.FT_CHR,ods.FT_BLK:{
 		mm := new(ReprNode)
 		mm.Node = nodefs.NewDefaultNode()
-		mm.Attr.Mode = fuse.S_IFIFO | 0666
+		mm.Attr.Mode = filemode(mfte.FileType) | 0666
 		mm.Backing = file
-		return true,mm,fuse.OK
+		if mfte.FileType==ods.FT_CHR || mfte.FileType==ods.FT_BLK {
+			mdf,e := file.GetMDF()
+			if e!=nil { return false,nil,fuse.EIO }
+			rdev,_ := mdf.Rdev()
+			mm.Attr.Rdev = uint32(rdev)
+		}
+		return false,mm,fuse.OK
 		}
 	}
 	return false,nil,fuse.EIO
@@ -68,6 +111,9 @@ type ReprNode struct{
 
 func (m *ReprNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (fuse.Status) {
 	*out = m.Attr
+	mfte,e := m.Backing.GetMFTE()
+	if e!=nil { return fuse.EIO }
+	mfteattr(out,mfte)
 	return fuse.OK
 }
 
@@ -0,0 +1,169 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package fs1drv
+
+import "github.com/hanwen/go-fuse/fuse"
+import "github.com/hanwen/go-fuse/fuse/nodefs"
+
+import "github.com/maxymania/anyfs/dskimg/ods"
+
+import "sync"
+
+/*
+ RawFS wraps the raw file system of a nodefs.FileSystemConnector and serves
+ readdir on fs1 directories itself: instead of listing the whole directory on
+ opendir, entries are read in chunks from a cursor (see ods.DirCursor), and
+ the directory is only locked while a segment is read.
+
+ The offsets handed to the kernel count the entries, including "." and "..".
+ A stream remembers the cursor position after the last entry it returned, so
+ a listing continues there; any other offset is reached by reading from the
+ start again.
+
+ The generation of the entries is left to nodefs, which pairs it with its own
+ node ids; the cookie of the MFT entry is not reported.
+ */
+type RawFS struct{
+	fuse.RawFileSystem
+	tab     *dirTable
+	lock    sync.Mutex
+	streams map[uint64]*dirStream
+	next    uint64
+}
+
+/* Handles of RawFS have the high bit set, to keep them apart from nodefs ones. */
+const streamFh = 1<<63
+
+type dirStream struct{
+	lock sync.Mutex
+	node *DirNode
+	cur  *ods.DirCursor
+	off  uint64 /* The kernel offset of the cursor position */
+}
+
+/* Wraps the raw file system of conn. The root of conn must be root. */
+func NewRawFS(conn *nodefs.FileSystemConnector, root *DirNode) *RawFS {
+	return &RawFS{RawFileSystem:conn.RawFS(),tab:root.tab,streams:make(map[uint64]*dirStream)}
+}
+
+func (r *RawFS) stream(fh uint64) *dirStream {
+	if fh&streamFh==0 { return nil }
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.streams[fh]
+}
+
+func (r *RawFS) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	var attr fuse.AttrOut
+	st := r.RawFileSystem.GetAttr(&fuse.GetAttrIn{InHeader:input.InHeader},&attr)
+	if !st.Ok() { return st }
+	d := r.tab.get(attr.Ino)
+	if d==nil { return r.RawFileSystem.OpenDir(input,out) }
+	s := &dirStream{node:d,cur:d.openCursor()}
+	r.lock.Lock()
+	r.next++
+	fh := streamFh|r.next
+	r.streams[fh] = s
+	r.lock.Unlock()
+	out.Fh = fh
+	return fuse.OK
+}
+
+func (r *RawFS) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	s := r.stream(input.Fh)
+	if s==nil { return r.RawFileSystem.ReadDir(input,out) }
+	return s.read(input.Offset,out,nil)
+}
+
+func (r *RawFS) ReadDirPlus(input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	s := r.stream(input.Fh)
+	if s==nil { return r.RawFileSystem.ReadDirPlus(input,out) }
+	return s.read(input.Offset,out,func(name string, eo *fuse.EntryOut) {
+		r.RawFileSystem.Lookup(&input.InHeader,name,eo)
+	})
+}
+
+func (r *RawFS) ReleaseDir(input *fuse.ReleaseIn) {
+	s := r.stream(input.Fh)
+	if s==nil {
+		r.RawFileSystem.ReleaseDir(input)
+		return
+	}
+	r.lock.Lock()
+	delete(r.streams,input.Fh)
+	r.lock.Unlock()
+	s.node.closeCursor(s.cur)
+}
+
+/* Returns the next listed entry of the cursor (after "." and ".."), or false at the end. */
+func (s *dirStream) peek() (fuse.DirEntry,bool) {
+	switch s.off {
+	case 0: return fuse.DirEntry{Mode:fuse.S_IFDIR,Name:"."},true
+	case 1: return fuse.DirEntry{Mode:fuse.S_IFDIR,Name:".."},true
+	}
+	for {
+		rdi,_,e := s.cur.Peek()
+		if e!=nil { return fuse.DirEntry{},false }
+		mode := filemode(rdi.Value.FileType)
+		if mode!=0 { return fuse.DirEntry{Mode:mode,Name:rdi.Name},true }
+		s.cur.Skip()
+	}
+}
+/* Consumes the entry returned by peek. */
+func (s *dirStream) skip() {
+	if s.off>=2 { s.cur.Skip() }
+	s.off++
+}
+
+/*
+ Fills out, starting at the kernel offset off. If lookup is not nil, this is
+ readdirplus. The offsets are assigned by out.
+ */
+func (s *dirStream) read(off uint64, out *fuse.DirEntryList, lookup func(string,*fuse.EntryOut)) fuse.Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if off<s.off {
+		s.cur.Seek(0)
+		s.off = 0
+	}
+	for s.off<off {
+		if _,ok := s.peek(); !ok { return fuse.OK }
+		s.skip()
+	}
+	for {
+		ent,ok := s.peek()
+		if !ok { break }
+		if lookup==nil {
+			if !out.AddDirEntry(ent) { break }
+		} else {
+			eo := out.AddDirLookupEntry(ent)
+			if eo==nil { break }
+			eo.Ino = uint64(fuse.FUSE_UNKNOWN_INO)
+			if ent.Name!="." && ent.Name!=".." { lookup(ent.Name,eo) }
+		}
+		s.skip()
+	}
+	return fuse.OK
+}
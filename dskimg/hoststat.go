@@ -0,0 +1,47 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package dskimg
+
+import "os"
+
+/* Identity and ownership of a file on the host system. */
+type HostFileInfo struct{
+	Dev, Ino uint64
+	Nlink    uint64
+	Uid, Gid uint32
+	Rdev     uint64 /* Linux dev_t encoding. */
+}
+
+func std_host_stat (fi os.FileInfo) (*HostFileInfo,bool) {
+	return nil,false
+}
+
+/*
+ Extracts the HostFileInfo from the result of os.Stat/os.Lstat. If the
+ information is not available, false is returned. The default implementation
+ knows nothing; platform plugins replace it.
+ */
+type HostStater func(fi os.FileInfo) (*HostFileInfo,bool)
+var HostStat HostStater = std_host_stat
@@ -0,0 +1,681 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package dskimg
+
+import "io"
+import "os"
+import "sync"
+import "bytes"
+import "errors"
+import "hash/crc32"
+import "encoding/binary"
+
+var ENoReplica = errors.New("No healthy replica left")
+var EChecksum = errors.New("Checksum mismatch on all replicas")
+var EReplica = errors.New("Invalid replica")
+var EStale = errors.New("Replica is out of date")
+
+type ReplicaState int
+const (
+	REPLICA_HEALTHY ReplicaState = iota
+	REPLICA_DEGRADED /* Failed; no longer read or written. */
+	REPLICA_SYNCING  /* Being resynchronized; written, but not read. */
+)
+
+type ReplicaStatus struct{
+	State  ReplicaState
+	Err    error /* The error, that degraded the replica. */
+	Synced int64 /* Bytes copied so far, while syncing. */
+}
+
+type replica struct{
+	dev    Device
+	label  int64 /* Offset of the label on dev */
+	state  ReplicaState
+	err    error
+	synced int64
+}
+
+/*
+ The mirror is locked in stripes of mirrorStripe bytes. Writes, verified reads
+ and the resynchronization lock the stripes they touch, so a replica being
+ resynchronized never misses a write.
+ */
+const mirrorStripe = 1<<16
+const mirrorStripes = 64
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+ Every replica carries a label in its last mirrorLabel bytes, which are not
+ part of the mirror: a magic, the generation of the mirror and a checksum.
+ Whenever a replica degrades or becomes healthy again, the generation is raised
+ and written to the healthy replicas, before the failed request returns. A
+ replica, that has missed writes, therefore has an older generation or no
+ label, and NewMirror does not use it, until it is resynchronized.
+ */
+const mirrorLabel = 512
+const mirrorMagic = "dskimg-mirror-v1"
+
+func readLabel(d Device, off int64) (uint64,bool) {
+	buf := make([]byte,28)
+	n,_ := d.ReadAt(buf,off)
+	if n<len(buf) || string(buf[:16])!=mirrorMagic { return 0,false }
+	if crc32.Checksum(buf[:24],castagnoli)!=binary.BigEndian.Uint32(buf[24:]) { return 0,false }
+	return binary.BigEndian.Uint64(buf[16:]),true
+}
+/* Writes and syncs a label. Generation 0 writes an invalid one. */
+func writeLabel(d Device, off int64, gen uint64) error {
+	buf := make([]byte,mirrorLabel)
+	if gen!=0 {
+		copy(buf,mirrorMagic)
+		binary.BigEndian.PutUint64(buf[16:],gen)
+		binary.BigEndian.PutUint32(buf[24:],crc32.Checksum(buf[:24],castagnoli))
+	}
+	n,e := d.WriteAt(buf,off)
+	if n<len(buf) {
+		if e==nil { e = io.ErrShortWrite }
+		return e
+	}
+	return d.Sync()
+}
+
+/*
+ A Mirror (RAID1) is a Device, that writes to two or more replicas and reads
+ from any healthy one. A replica failing with an I/O error is marked degraded
+ and no longer used, until it is resynchronized or replaced. Callers should
+ check Status() and resynchronize degraded replicas.
+ 
+ Which replicas are current is recorded in their labels, so a replica, that
+ has been degraded, stays degraded when the mirror is opened again. Writes,
+ that have not been synced before a crash, may differ between the replicas.
+ */
+type Mirror struct{
+	mutex    sync.Mutex /* Protects the replicas. */
+	replicas []*replica
+	size     int64
+	next     uint32
+	stripes  [mirrorStripes]sync.RWMutex
+	
+	sums      Device
+	blockSize int64
+	gen       uint64 /* The generation of the current replicas */
+}
+
+func newMirror(devs []Device) (*Mirror,error) {
+	if len(devs)==0 { return nil,EReplica }
+	m := new(Mirror)
+	m.size = -1
+	for _,d := range devs {
+		s,e := d.Size()
+		if e!=nil { return nil,e }
+		s -= mirrorLabel
+		if s<=0 { return nil,EReplica }
+		if m.size<0 || s<m.size { m.size = s }
+		m.replicas = append(m.replicas,&replica{dev:d,label:s})
+	}
+	return m,nil
+}
+
+/*
+ Opens a mirror. Its size is the size of the smallest replica, less the label.
+ Replicas, whose label is older than the newest one, are marked degraded with
+ EStale and must be resynchronized. If no replica has a label, the first one
+ is taken as the only current one.
+ */
+func NewMirror(devs ...Device) (*Mirror,error) {
+	m,e := newMirror(devs)
+	if e!=nil { return nil,e }
+	gens := make([]uint64,len(devs))
+	for i,r := range m.replicas {
+		gens[i],_ = readLabel(r.dev,r.label)
+		if gens[i]>m.gen { m.gen = gens[i] }
+	}
+	if m.gen==0 {
+		/* A new mirror. The label is written, once the generation changes. */
+		m.gen = 1
+		gens[0] = 1
+	}
+	for i,r := range m.replicas {
+		if gens[i]!=m.gen { r.state,r.err = REPLICA_DEGRADED,EStale }
+	}
+	return m,nil
+}
+
+/*
+ Creates a new mirror: all replicas are labelled as current, whatever they
+ contain. Use it for fresh images, before a file system is created on them.
+ */
+func InitMirror(devs ...Device) (*Mirror,error) {
+	m,e := newMirror(devs)
+	if e!=nil { return nil,e }
+	for _,r := range m.replicas {
+		if g,_ := readLabel(r.dev,r.label); g>m.gen { m.gen = g }
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.gen++
+	m.relabel()
+	for _,r := range m.replicas {
+		if r.state==REPLICA_HEALTHY { return m,nil }
+	}
+	return nil,ENoReplica
+}
+
+/*
+ Opens the images as the replicas of a mirror, see NewMirror. If init is set,
+ the mirror is created, see InitMirror.
+ */
+func OpenMirror(names []string, flag int, init bool) (*Mirror,error) {
+	devs := make([]Device,0,len(names))
+	closeAll := func() {
+		for _,d := range devs { d.(*FileDevice).Close() }
+	}
+	for _,name := range names {
+		f,e := os.OpenFile(name,flag,0666)
+		if e!=nil {
+			closeAll()
+			return nil,e
+		}
+		devs = append(devs,&FileDevice{f})
+	}
+	var m *Mirror
+	var e error
+	if init {
+		m,e = InitMirror(devs...)
+	} else {
+		m,e = NewMirror(devs...)
+	}
+	if e!=nil { closeAll() }
+	return m,e
+}
+
+/*
+ Turns on checksum verification. The CRC32-C of every block of blockSize
+ bytes is stored on sums, 4 bytes per block. A stored checksum of 0 means,
+ that it is not known. On a mismatch, the block is read from another replica
+ and the bad copy is repaired. Must be called before the mirror is used.
+ */
+func (m *Mirror) SetChecksums(sums Device, blockSize int) error {
+	if blockSize<=0 || blockSize>mirrorStripe || mirrorStripe%blockSize!=0 { return EReplica }
+	s,e := sums.Size()
+	if e!=nil { return e }
+	bs := int64(blockSize)
+	if s < ((m.size+bs-1)/bs)*4 { return EReplica }
+	m.sums = sums
+	m.blockSize = bs
+	return nil
+}
+
+func (m *Mirror) lockRange(off, n int64, write bool) func() {
+	var set [mirrorStripes]bool
+	b := off/mirrorStripe
+	e := (off+n+mirrorStripe-1)/mirrorStripe
+	for i:=b; i<e && i<b+mirrorStripes; i++ { set[i%mirrorStripes] = true }
+	for i := range set {
+		if !set[i] { continue }
+		if write { m.stripes[i].Lock() } else { m.stripes[i].RLock() }
+	}
+	return func() {
+		for i := range set {
+			if !set[i] { continue }
+			if write { m.stripes[i].Unlock() } else { m.stripes[i].RUnlock() }
+		}
+	}
+}
+/* Returns the replicas in the given states, starting with a different one each call. */
+func (m *Mirror) pick(states ...ReplicaState) []*replica {
+	rs,_ := m.pickStates(states...)
+	return rs
+}
+/* Like pick, but also returns the state of each replica at the time of the call. */
+func (m *Mirror) pickStates(states ...ReplicaState) ([]*replica,[]ReplicaState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n := len(m.replicas)
+	m.next++
+	rs := make([]*replica,0,n)
+	ss := make([]ReplicaState,0,n)
+	for i:=0; i<n; i++ {
+		r := m.replicas[(int(m.next)+i)%n]
+		for _,s := range states {
+			if r.state==s {
+				rs = append(rs,r)
+				ss = append(ss,s)
+				break
+			}
+		}
+	}
+	return rs,ss
+}
+func (m *Mirror) fail(r *replica, e error) {
+	if e==nil { e = io.ErrShortWrite }
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if r.state==REPLICA_DEGRADED { return }
+	healthy := r.state==REPLICA_HEALTHY
+	r.state = REPLICA_DEGRADED
+	r.err = e
+	if healthy {
+		m.gen++
+		m.relabel()
+	}
+}
+/*
+ Writes the generation to the healthy replicas. A replica, that fails, is
+ degraded, which raises the generation again. m.mutex must be held.
+ */
+func (m *Mirror) relabel() {
+	for again := true; again; {
+		again = false
+		for _,r := range m.replicas {
+			if r.state!=REPLICA_HEALTHY { continue }
+			e := writeLabel(r.dev,r.label,m.gen)
+			if e==nil { continue }
+			r.state,r.err = REPLICA_DEGRADED,e
+			m.gen++
+			again = true
+			break
+		}
+	}
+}
+func (m *Mirror) clip(p []byte, off int64) ([]byte,error) {
+	if off<0 || off>=m.size { return nil,io.EOF }
+	if max := m.size-off; max<int64(len(p)) { return p[:int(max)],io.EOF }
+	return p,nil
+}
+
+/* Reads from the first healthy replica, that succeeds. */
+func (m *Mirror) read(p []byte, off int64) error {
+	for _,r := range m.pick(REPLICA_HEALTHY) {
+		n,e := r.dev.ReadAt(p,off)
+		if n==len(p) { return nil }
+		m.fail(r,e)
+	}
+	return ENoReplica
+}
+func (m *Mirror) ReadAt(p []byte, off int64) (n int, err error) {
+	p,err = m.clip(p,off)
+	if len(p)==0 { return 0,err }
+	defer m.lockRange(off,int64(len(p)),false)()
+	var e error
+	if m.sums!=nil {
+		e = m.readVerified(p,off)
+	} else {
+		e = m.read(p,off)
+	}
+	if e!=nil { return 0,e }
+	return len(p),err
+}
+func (m *Mirror) WriteAt(p []byte, off int64) (n int, err error) {
+	p,err = m.clip(p,off)
+	if len(p)==0 { return 0,err }
+	defer m.lockRange(off,int64(len(p)),true)()
+	data,at := p,off
+	if m.sums!=nil {
+		var e error
+		data,at,e = m.expand(p,off)
+		if e!=nil { return 0,e }
+	}
+	ok := false
+	rs,ss := m.pickStates(REPLICA_HEALTHY,REPLICA_SYNCING)
+	for i,r := range rs {
+		n,e := r.dev.WriteAt(data,at)
+		if n<len(data) {
+			m.fail(r,e)
+			continue
+		}
+		if ss[i]==REPLICA_HEALTHY { ok = true }
+	}
+	if !ok { return 0,ENoReplica }
+	if m.sums!=nil {
+		e := m.writeSums(data,at)
+		if e!=nil { return 0,e }
+	}
+	return len(p),err
+}
+
+func (m *Mirror) blockRange(off, n int64) (int64,int64) {
+	b := (off/m.blockSize)*m.blockSize
+	e := ((off+n+m.blockSize-1)/m.blockSize)*m.blockSize
+	if e>m.size { e = m.size }
+	return b,e
+}
+func (m *Mirror) readSums(b, e int64) ([]byte,error) {
+	sums := make([]byte,int(((e-b+m.blockSize-1)/m.blockSize)*4))
+	_,err := m.sums.ReadAt(sums,(b/m.blockSize)*4)
+	if err!=nil { return nil,err }
+	return sums,nil
+}
+func (m *Mirror) readVerified(p []byte, off int64) error {
+	b,e := m.blockRange(off,int64(len(p)))
+	buf := make([]byte,int(e-b))
+	sums,err := m.readSums(b,e)
+	if err!=nil { return err }
+	err = m.read(buf,b)
+	if err!=nil { return err }
+	for i:=int64(0); b+i<e; i+=m.blockSize {
+		j := i+m.blockSize
+		if b+j>e { j = e-b }
+		sum := binary.BigEndian.Uint32(sums[(i/m.blockSize)*4:])
+		if sum==0 || crc32.Checksum(buf[i:j],castagnoli)==sum { continue }
+		err = m.repair(buf[i:j],b+i,sum)
+		if err!=nil { return err }
+	}
+	copy(p,buf[off-b:])
+	return nil
+}
+/*
+ Looks for a replica with a good copy of the block, and writes it to all
+ replicas, that have a bad one.
+ 
+ The data is written before its checksum, so a crash in between leaves the
+ old checksum. If no copy matches it, but two or more replicas agree, their
+ copy is taken and the checksum is rewritten. A single replica can not tell
+ this apart from a corrupted block.
+ */
+func (m *Mirror) repair(blk []byte, off int64, sum uint32) error {
+	var bad []*replica
+	good,agree,read := false,true,0
+	first := make([]byte,len(blk))
+	tmp := make([]byte,len(blk))
+	for _,r := range m.pick(REPLICA_HEALTHY) {
+		n,e := r.dev.ReadAt(tmp,off)
+		if n<len(tmp) {
+			m.fail(r,e)
+			continue
+		}
+		if read==0 {
+			copy(first,tmp)
+		} else if !bytes.Equal(first,tmp) {
+			agree = false
+		}
+		read++
+		if crc32.Checksum(tmp,castagnoli)!=sum {
+			bad = append(bad,r)
+		} else if !good {
+			copy(blk,tmp)
+			good = true
+		}
+	}
+	if !good {
+		if read<2 || !agree { return EChecksum }
+		copy(blk,first)
+		var s [4]byte
+		binary.BigEndian.PutUint32(s[:],crc32.Checksum(blk,castagnoli))
+		_,e := m.sums.WriteAt(s[:],(off/m.blockSize)*4)
+		return e
+	}
+	for _,r := range bad {
+		n,e := r.dev.WriteAt(blk,off)
+		if n<len(blk) { m.fail(r,e) }
+	}
+	return nil
+}
+/*
+ Extends a write to whole blocks, so every replica gets the same blocks and
+ the checksums are computed from what has been written.
+ */
+func (m *Mirror) expand(p []byte, off int64) ([]byte,int64,error) {
+	b,e := m.blockRange(off,int64(len(p)))
+	pe := off+int64(len(p))
+	if b==off && e==pe { return p,off,nil }
+	buf := make([]byte,int(e-b))
+	if b<off {
+		n := m.blockSize
+		if n>e-b { n = e-b }
+		err := m.readVerified(buf[:n],b)
+		if err!=nil { return nil,0,err }
+	}
+	if lb := ((pe-1)/m.blockSize)*m.blockSize; pe<e && (lb>b || b==off) {
+		err := m.readVerified(buf[lb-b:],lb)
+		if err!=nil { return nil,0,err }
+	}
+	copy(buf[off-b:],p)
+	return buf,b,nil
+}
+/* Stores the checksums of whole blocks starting at off. */
+func (m *Mirror) writeSums(data []byte, off int64) error {
+	n := int64(len(data))
+	sums := make([]byte,int(((n+m.blockSize-1)/m.blockSize)*4))
+	for i:=int64(0); i<n; i+=m.blockSize {
+		j := i+m.blockSize
+		if j>n { j = n }
+		binary.BigEndian.PutUint32(sums[(i/m.blockSize)*4:],crc32.Checksum(data[i:j],castagnoli))
+	}
+	_,err := m.sums.WriteAt(sums,(off/m.blockSize)*4)
+	return err
+}
+
+func (m *Mirror) Size() (int64,error) { return m.size,nil }
+func (m *Mirror) Sync() error {
+	ok := false
+	rs,ss := m.pickStates(REPLICA_HEALTHY,REPLICA_SYNCING)
+	for i,r := range rs {
+		e := r.dev.Sync()
+		if e!=nil {
+			m.fail(r,e)
+			continue
+		}
+		if ss[i]==REPLICA_HEALTHY { ok = true }
+	}
+	if !ok { return ENoReplica }
+	if m.sums!=nil { return m.sums.Sync() }
+	return nil
+}
+/*
+ Discards the range on all replicas, that support it. If checksums are used,
+ only whole blocks are discarded and their checksums are forgotten.
+ */
+func (m *Mirror) Discard(off, n int64) error {
+	if off<0 || off>=m.size { return io.EOF }
+	if max := m.size-off; max<n { n = max }
+	if m.sums!=nil {
+		b := ((off+m.blockSize-1)/m.blockSize)*m.blockSize
+		e := ((off+n)/m.blockSize)*m.blockSize
+		if e<=b { return nil }
+		off,n = b,e-b
+	}
+	defer m.lockRange(off,n,true)()
+	err := ENotSupported
+	for _,r := range m.pick(REPLICA_HEALTHY,REPLICA_SYNCING) {
+		if Discard(r.dev,off,n)==nil { err = nil }
+	}
+	if err==nil && m.sums!=nil {
+		_,err = m.sums.WriteAt(make([]byte,int((n/m.blockSize)*4)),(off/m.blockSize)*4)
+	}
+	return err
+}
+
+/*
+ Verifies every block of every healthy replica against its checksum and
+ repairs the bad copies. Reads only check the replica they are served from,
+ so this should be run regularly. Blocks without a good copy are reported
+ with EChecksum.
+ */
+func (m *Mirror) Scrub() error {
+	if m.sums==nil { return ENotSupported }
+	var err error
+	buf := make([]byte,mirrorStripe)
+	for off:=int64(0); off<m.size; off+=mirrorStripe {
+		n := int64(mirrorStripe)
+		if max := m.size-off; max<n { n = max }
+		unlock := m.lockRange(off,n,true)
+		e := m.scrub(buf[:n],off)
+		unlock()
+		if e==EChecksum { err = e; continue }
+		if e!=nil { return e }
+	}
+	return err
+}
+func (m *Mirror) scrub(buf []byte, off int64) error {
+	n := int64(len(buf))
+	sums,err := m.readSums(off,off+n)
+	if err!=nil { return err }
+	var res error
+	for _,r := range m.pick(REPLICA_HEALTHY) {
+		k,e := r.dev.ReadAt(buf,off)
+		if k<len(buf) {
+			m.fail(r,e)
+			continue
+		}
+		for i:=int64(0); i<n; i+=m.blockSize {
+			j := i+m.blockSize
+			if j>n { j = n }
+			sum := binary.BigEndian.Uint32(sums[(i/m.blockSize)*4:])
+			if sum==0 || crc32.Checksum(buf[i:j],castagnoli)==sum { continue }
+			blk := make([]byte,int(j-i))
+			e = m.repair(blk,off+i,sum)
+			if e!=nil { res = e }
+		}
+	}
+	return res
+}
+
+/* Returns the state of every replica. */
+func (m *Mirror) Status() []ReplicaStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	st := make([]ReplicaStatus,len(m.replicas))
+	for i,r := range m.replicas {
+		st[i] = ReplicaStatus{r.state,r.err,r.synced}
+	}
+	return st
+}
+/* Returns the devices of all replicas. */
+func (m *Mirror) Devices() []Device {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	devs := make([]Device,len(m.replicas))
+	for i,r := range m.replicas { devs[i] = r.dev }
+	return devs
+}
+
+/*
+ Replaces replica i with dev and resynchronizes it in the background. The
+ mirror stays usable meanwhile. The result of the resynchronization is sent
+ on the returned channel. Another replica must be healthy, else ENoReplica is
+ sent.
+ */
+func (m *Mirror) Replace(i int, dev Device) <-chan error {
+	ch := make(chan error,1)
+	s,e := dev.Size()
+	if e==nil && s-mirrorLabel<m.size { e = EReplica }
+	if e!=nil {
+		ch <- e
+		return ch
+	}
+	r := &replica{dev:dev,label:s-mirrorLabel,state:REPLICA_SYNCING}
+	m.mutex.Lock()
+	e = m.swap(i,r)
+	m.mutex.Unlock()
+	if e!=nil {
+		ch <- e
+		return ch
+	}
+	go func() { ch <- m.resync(r) }()
+	return ch
+}
+/* Puts r in place of replica i; another replica must be healthy. m.mutex must be held. */
+func (m *Mirror) swap(i int, r *replica) error {
+	if i<0 || i>=len(m.replicas) { return EReplica }
+	others := false
+	for j,o := range m.replicas {
+		if j!=i && o.state==REPLICA_HEALTHY { others = true }
+	}
+	if !others { return ENoReplica }
+	/* The label of the new device must not claim it current, until it is. */
+	e := writeLabel(r.dev,r.label,0)
+	if e!=nil { return e }
+	old := m.replicas[i]
+	m.replicas[i] = r
+	if old.state==REPLICA_HEALTHY {
+		m.gen++
+		m.relabel()
+	}
+	return nil
+}
+/* Resynchronizes replica i with its current device. See Replace. */
+func (m *Mirror) Resync(i int) <-chan error {
+	m.mutex.Lock()
+	var dev Device
+	if i>=0 && i<len(m.replicas) { dev = m.replicas[i].dev }
+	m.mutex.Unlock()
+	if dev==nil {
+		ch := make(chan error,1)
+		ch <- EReplica
+		return ch
+	}
+	return m.Replace(i,dev)
+}
+func (m *Mirror) resync(r *replica) error {
+	buf := make([]byte,mirrorStripe)
+	for off:=int64(0); off<m.size; off+=mirrorStripe {
+		n := int64(mirrorStripe)
+		if max := m.size-off; max<n { n = max }
+		unlock := m.lockRange(off,n,true)
+		e := m.read(buf[:n],off)
+		if e==nil {
+			var w int
+			w,e = r.dev.WriteAt(buf[:n],off)
+			if w<int(n) { m.fail(r,e) }
+			if e==nil && w<int(n) { e = io.ErrShortWrite }
+		}
+		unlock()
+		m.mutex.Lock()
+		r.synced = off+n
+		state,err := r.state,r.err
+		m.mutex.Unlock()
+		if e!=nil { return e }
+		if state==REPLICA_DEGRADED { return err }
+	}
+	e := r.dev.Sync()
+	if e!=nil {
+		m.fail(r,e)
+		return e
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if r.state==REPLICA_DEGRADED { return r.err }
+	r.state = REPLICA_HEALTHY
+	m.gen++
+	m.relabel()
+	if r.state==REPLICA_DEGRADED { return r.err }
+	return nil
+}
+
+/* Closes the devices of all replicas and the checksum device, that can be closed. */
+func (m *Mirror) Close() error {
+	devs := m.Devices()
+	if m.sums!=nil { devs = append(devs,m.sums) }
+	var err error
+	for _,d := range devs {
+		cl,ok := d.(io.Closer)
+		if !ok { continue }
+		e := cl.Close()
+		if err==nil { err = e }
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package dskimg
+
+import "testing"
+import "bytes"
+
+const testMirrorSize = 4*mirrorStripe
+
+func newTestReplica() *MemDevice { return NewMemDevice(testMirrorSize+mirrorLabel) }
+
+func pattern(n int, seed byte) []byte {
+	p := make([]byte,n)
+	for i := range p { p[i] = byte(i*7)+seed }
+	return p
+}
+
+func TestMirrorDegradeResync(t *testing.T) {
+	a,b := newTestReplica(),&failingDevice{MemDevice:newTestReplica()}
+	m,e := InitMirror(a,b)
+	if e!=nil { t.Fatal(e) }
+	if s,_ := m.Size(); s!=testMirrorSize { t.Fatal("size ",s) }
+	data := pattern(testMirrorSize,1)
+	if _,e := m.WriteAt(data,0); e!=nil { t.Fatal(e) }
+	
+	b.fail = true
+	if _,e := m.WriteAt(pattern(1000,2),5000); e!=nil { t.Fatal(e) }
+	copy(data[5000:],pattern(1000,2))
+	if st := m.Status(); st[0].State!=REPLICA_HEALTHY || st[1].State!=REPLICA_DEGRADED { t.Fatal(st) }
+	
+	/* The state survives reopening. */
+	m,e = NewMirror(a,b.MemDevice)
+	if e!=nil { t.Fatal(e) }
+	if st := m.Status(); st[0].State!=REPLICA_HEALTHY || st[1].Err!=EStale { t.Fatal(st) }
+	buf := make([]byte,testMirrorSize)
+	if _,e := m.ReadAt(buf,0); e!=nil || !bytes.Equal(buf,data) { t.Fatal("read from a stale replica ",e) }
+	
+	if e := <-m.Resync(1); e!=nil { t.Fatal(e) }
+	if st := m.Status(); st[1].State!=REPLICA_HEALTHY { t.Fatal(st) }
+	b.MemDevice.ReadAt(buf,0)
+	if !bytes.Equal(buf,data) { t.Fatal("not resynchronized") }
+	m,e = NewMirror(a,b.MemDevice)
+	if e!=nil { t.Fatal(e) }
+	if st := m.Status(); st[0].State!=REPLICA_HEALTHY || st[1].State!=REPLICA_HEALTHY { t.Fatal(st) }
+	
+	/* The last healthy replica can not be replaced. */
+	b.fail = true
+	m,_ = NewMirror(a,b)
+	m.WriteAt([]byte{1},0)
+	if e := <-m.Replace(0,newTestReplica()); e!=ENoReplica { t.Fatal(e) }
+}
+
+func TestMirrorChecksumRepair(t *testing.T) {
+	a,b := newTestReplica(),&failingDevice{MemDevice:newTestReplica()}
+	m,e := InitMirror(a,b)
+	if e!=nil { t.Fatal(e) }
+	if e := m.SetChecksums(NewMemDevice(testMirrorSize/512*4),512); e!=nil { t.Fatal(e) }
+	data := pattern(testMirrorSize,3)
+	if _,e := m.WriteAt(data,0); e!=nil { t.Fatal(e) }
+	buf := make([]byte,testMirrorSize)
+	
+	/* A corrupted copy is served from the other replica and repaired by Scrub. */
+	a.WriteAt(make([]byte,512),1024)
+	for i := 0; i<2; i++ {
+		if _,e := m.ReadAt(buf,0); e!=nil || !bytes.Equal(buf,data) { t.Fatal("corrupted read ",e) }
+	}
+	if e := m.Scrub(); e!=nil { t.Fatal(e) }
+	a.ReadAt(buf,0)
+	if !bytes.Equal(buf,data) { t.Fatal("not repaired") }
+	
+	/* A crash after the data, but before its checksum: the replicas agree, so the data is taken. */
+	p := pattern(512,4)
+	a.WriteAt(p,2048)
+	b.WriteAt(p,2048)
+	copy(data[2048:],p)
+	if _,e := m.ReadAt(buf,0); e!=nil || !bytes.Equal(buf,data) { t.Fatal("torn update ",e) }
+	if e := m.Scrub(); e!=nil { t.Fatal("checksum not rewritten ",e) }
+	
+	/* A single replica can not tell a torn update from corruption. */
+	b.fail = true
+	m.WriteAt([]byte{1},0)
+	a.WriteAt(make([]byte,512),4096)
+	if _,e := m.ReadAt(buf[:512],4096); e!=EChecksum { t.Fatal(e) }
+}
@@ -0,0 +1,143 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ods
+
+import "io"
+import "sort"
+import "sync"
+import "hash/fnv"
+
+/*
+ A DirCursor iterates over a directory, one segment at a time.
+
+ Its offsets are stable: the upper 32 bits hold the segment index plus one,
+ the lower 32 bits the hash of the last entry returned from that segment plus
+ one (0 at the start of a segment). Within a segment, entries are returned in
+ the order of their hashes, so resuming at an offset continues after that
+ entry, even if entries have been inserted or deleted in the meantime.
+ Entries stay in their segment until the directory is compacted, and
+ compaction is deferred while cursors are open.
+
+ Two names of the same segment with equal 31 bit hashes are both returned
+ while the cursor moves on, but resuming from an offset between them skips
+ the second.
+
+ If Lock is not nil, it is held while a segment is read.
+ */
+type DirCursor struct{
+	Lock sync.Locker
+	d    *Directory
+	seg  int64
+	pos  uint32 /* Hash of the last returned entry plus one, or 0. */
+	buf  []cursorEntry
+}
+
+type cursorEntry struct{
+	DirectoryEntry
+	pos uint32
+}
+
+/* Opens a cursor. Must be synchronized with other accesses to the directory. */
+func (d *Directory) OpenCursor() *DirCursor {
+	d.cursors++
+	return &DirCursor{d:d}
+}
+
+/* Closes the cursor. Must be synchronized with other accesses to the directory. */
+func (c *DirCursor) Close() {
+	if c.d==nil { return }
+	c.d.cursors--
+	c.d = nil
+}
+
+/* Returns the offset of the next entry. */
+func (c *DirCursor) Offset() uint64 {
+	return uint64(c.seg+1)<<32 | uint64(c.pos)
+}
+
+/* Returns the in-segment position, that follows the entry 'name'. */
+func (c *DirCursor) posOf(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(c.d.Names.Key(name)))
+	return (h.Sum32()&0x7fffffff)+1
+}
+
+/* Reads the entries of the current segment, that follow c.pos, in order. */
+func (c *DirCursor) readSeg() ([]cursorEntry,error) {
+	if c.Lock!=nil {
+		c.Lock.Lock()
+		defer c.Lock.Unlock()
+	}
+	ents,e := c.d.ReadDir(c.seg)
+	if e!=nil { return nil,e }
+	var list []cursorEntry
+	for _,ent := range ents {
+		p := c.posOf(ent.Name)
+		if p>c.pos { list = append(list,cursorEntry{ent,p}) }
+	}
+	sort.Slice(list,func(i,j int) bool {
+		if list[i].pos!=list[j].pos { return list[i].pos<list[j].pos }
+		return list[i].Name<list[j].Name
+	})
+	return list,nil
+}
+
+/*
+ Moves the cursor to an offset, that has been returned by Offset or Peek.
+ Offsets below 1<<32 denote the beginning of the directory.
+ */
+func (c *DirCursor) Seek(off uint64) error {
+	if off==c.Offset() { return nil }
+	c.buf = nil
+	c.seg = 0
+	c.pos = 0
+	if off < 1<<32 { return nil }
+	c.seg = int64(off>>32)-1
+	c.pos = uint32(off)
+	return nil
+}
+
+/*
+ Returns the next entry without consuming it, and the offset following it,
+ or io.EOF.
+ */
+func (c *DirCursor) Peek() (DirectoryEntry,uint64,error) {
+	for len(c.buf)==0 {
+		ents,e := c.readSeg()
+		if e!=nil { return DirectoryEntry{},0,io.EOF }
+		c.buf = ents
+		if len(c.buf)>0 { break }
+		c.seg++
+		c.pos = 0
+	}
+	return c.buf[0].DirectoryEntry,uint64(c.seg+1)<<32 | uint64(c.buf[0].pos),nil
+}
+
+/* Consumes the entry returned by Peek. */
+func (c *DirCursor) Skip() {
+	if len(c.buf)==0 { return }
+	c.pos = c.buf[0].pos
+	c.buf = c.buf[1:]
+}
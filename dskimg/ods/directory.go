@@ -70,8 +70,13 @@ func resize_name_buf(nb []byte,size int) []byte {
 	return nb[:size]
 }
 
-func readDirEntries(src io.Reader) ([]DirectoryEntry,error) {
+/*
+ With NAME_LONG, a name_length of 255 is followed by the real length as
+ 2 byte big endian integer.
+ */
+func readDirEntries(src io.Reader, p NamePolicy) ([]DirectoryEntry,error) {
 	buf := []byte{0}
+	lbuf := []byte{0,0}
 	dea := []DirectoryEntry{}
 	dev := new(DirectoryEntryValue)
 	nb := []byte{}
@@ -80,7 +85,13 @@ func readDirEntries(src io.Reader) ([]DirectoryEntry,error) {
 		_,e := src.Read(buf)
 		if e!=nil { err = e; break }
 		if buf[0]==0 { break }
-		nb = resize_name_buf(nb,int(buf[0]))
+		nl := int(buf[0])
+		if nl==255 && p&NAME_LONG!=0 {
+			_,e = io.ReadFull(src,lbuf)
+			if e!=nil { err = e; break }
+			nl = int(binary.BigEndian.Uint16(lbuf))
+		}
+		nb = resize_name_buf(nb,nl)
 		_,e = io.ReadFull(src,nb)
 		if e!=nil { err = e; break }
 		e = binary.Read(src,binary.BigEndian,dev)
@@ -90,15 +101,20 @@ func readDirEntries(src io.Reader) ([]DirectoryEntry,error) {
 	if len(dea)>0 { err = nil }
 	return dea,err
 }
-func writeDirEntries(ents []DirectoryEntry, dst io.Writer) error {
+func writeDirEntries(ents []DirectoryEntry, dst io.Writer, p NamePolicy) error {
 	buf := []byte{0}
 	for _,ent := range ents {
 		n := ent.Name
 		nl := len(n)
-		if nl>255 { return ELongname }
+		if nl>p.MaxName() { return ELongname }
 		if nl==0 { return ELongname }
-		buf[0] = byte(nl)
-		_,e := dst.Write(buf)
+		var e error
+		if nl>=255 && p&NAME_LONG!=0 {
+			_,e = dst.Write([]byte{255,byte(nl>>8),byte(nl)})
+		} else {
+			buf[0] = byte(nl)
+			_,e = dst.Write(buf)
+		}
 		if e!=nil { return e }
 		_,e = dst.Write([]byte(n))
 		if e!=nil { return e }
@@ -109,17 +125,24 @@ func writeDirEntries(ents []DirectoryEntry, dst io.Writer) error {
 	dst.Write(buf)
 	return nil
 }
-func length_Dirents(ents []DirectoryEntry) int {
+func length_Dirents(ents []DirectoryEntry, p NamePolicy) int {
 	i := 1 /* null-byte on the end. */
 	for _,ent := range ents {
-		i+= len(ent.Name) + 18 /* 1 byte name_length; name; 17 byte File-Link */
+		i+= p.EntrySize(ent.Name) /* 1 byte name_length; name; 17 byte File-Link */
 	}
 	return i
 }
 
 type dir_cache_ent struct{
-	idx int64
-	dev DirectoryEntryValue
+	idx  int64
+	name string
+	dev  DirectoryEntryValue
+}
+
+/* Directory files, that implement this, release unused segments. */
+type Truncater interface{
+	Size() (int64,error)
+	Truncate(size int64) error
 }
 
 // This is a directory. Access must be synchronized.
@@ -127,6 +150,17 @@ type Directory struct{
 	File   RAS
 	Buf    *dskimg.FixedIO
 	Segsz  int
+	Names  NamePolicy
+	
+	/*
+	 Unless NoAutoCompact is set, Delete truncates empty segments from the end
+	 of the directory and compacts it, once half of its segments have dropped
+	 below a quarter of their capacity since the last compaction. This requires
+	 File to be a Truncater. Compaction is deferred, while cursors are open.
+	 */
+	NoAutoCompact bool
+	sparse        int64
+	cursors       int
 	
 	name_pos  *lru.Cache
 	name_ent  *lru.Cache
@@ -160,24 +194,36 @@ func NewDirectoryLite(file RAS,segsize int) *Directory{
 func (d *Directory) ReadDir(i int64) ([]DirectoryEntry,error) {
 	e := d.Buf.ReadIndex(i,d.File)
 	if e!=nil { return nil,e }
-	return readDirEntries(d.Buf)
+	return readDirEntries(d.Buf,d.Names)
 }
 func (d *Directory) WriteDir(i int64,des []DirectoryEntry) error {
 	d.Buf.Pos = 0
-	e := writeDirEntries(des,d.Buf)
+	e := writeDirEntries(des,d.Buf,d.Names)
 	if e!=nil { return e }
 	return d.Buf.WriteIndex(i,d.File)
 }
 func (d *Directory) Search(name string) (fidx int64,dirent DirectoryEntryValue,err error) {
+	var ent DirectoryEntry
+	fidx,ent,err = d.search(name)
+	dirent = ent.Value
+	return
+}
+/* Like Search, but returns the entry as stored, which may differ in case or normalization. */
+func (d *Directory) Lookup(name string) (DirectoryEntry,error) {
+	_,ent,err := d.search(name)
+	return ent,err
+}
+func (d *Directory) search(name string) (fidx int64,dirent DirectoryEntry,err error) {
 	i := int64(0)
 	sp := false
-	if entry,ok := d.name_ent.Get(name); ok {
+	key := d.Names.Key(name)
+	if entry,ok := d.name_ent.Get(key); ok {
 		ce := entry.(*dir_cache_ent)
-		dirent = ce.dev
+		dirent = DirectoryEntry{ce.name,ce.dev}
 		fidx   = ce.idx
 		return
 	}
-	if idx,ok := d.name_ent.Get(name); ok {
+	if idx,ok := d.name_ent.Get(key); ok {
 		i  = idx.(int64)
 		sp = true /* Only search one index. */
 	}
@@ -186,9 +232,9 @@ func (d *Directory) Search(name string) (fidx int64,dirent DirectoryEntryValue,e
 		ents,e := d.ReadDir(i)
 		if e!=nil { err = e; return }
 		for _,ent := range ents {
-			N := ent.Name
-			d.name_ent.Add(N,&dir_cache_ent{i,ent.Value})
-			if N==name { fidx = i; dirent = ent.Value; return }
+			N := d.Names.Key(ent.Name)
+			d.name_ent.Add(N,&dir_cache_ent{i,ent.Name,ent.Value})
+			if N==key { fidx = i; dirent = ent; return }
 		}
 		if sp { err = io.EOF; return }
 		i++
@@ -196,36 +242,182 @@ func (d *Directory) Search(name string) (fidx int64,dirent DirectoryEntryValue,e
 }
 func (d *Directory) Delete(name string) (dirent DirectoryEntryValue,err error) {
 	var index int64
-	index,dirent,err = d.Search(name)
-	if err!=nil { return }
-	ents,e := d.ReadDir(index)
-	if e!=nil { err = e; return }
-	err = io.EOF
-	for ri,ent := range ents {
-		if ent.Name!=name { continue }
-		nlen := len(ents)-1
-		if ri<nlen {
-			copy(ents[ri:],ents[ri+1:])
+	for try := 0; try<2; try++ {
+		index,dirent,err = d.Search(name)
+		if err!=nil { return }
+		ents,e := d.ReadDir(index)
+		if e!=nil { err = e; return }
+		err = io.EOF
+		key := d.Names.Key(name)
+		for ri,ent := range ents {
+			if d.Names.Key(ent.Name)!=key { continue }
+			nlen := len(ents)-1
+			if ri<nlen {
+				copy(ents[ri:],ents[ri+1:])
+			}
+			before := length_Dirents(ents,d.Names)
+			ents = ents[:nlen]
+			err = d.WriteDir(index,ents)
+			d.name_ent.Remove(key)
+			d.name_pos.Remove(key)
+			if err==nil { err = d.segmentShrunk(index,before,length_Dirents(ents,d.Names)) }
+			return
 		}
-		ents = ents[:nlen]
-		err = d.WriteDir(index,ents)
-		d.name_ent.Remove(name)
-		d.name_pos.Remove(name)
-		break
+		/* Stale cache entry (the directory has been compacted elsewhere). Search again. */
+		d.name_ent.Remove(key)
+		d.name_pos.Remove(key)
 	}
 	return
 }
+func (d *Directory) purgeCaches() {
+	if d.name_ent==nil { return }
+	d.name_ent.Purge() /* Evicts into name_pos. */
+	d.name_pos.Purge()
+}
+func (d *Directory) segments(t Truncater) (int64,error) {
+	size,e := t.Size()
+	if e!=nil { return 0,e }
+	return (size+int64(d.Segsz)-1)/int64(d.Segsz),nil
+}
+/*
+ Applies the auto compaction policy after the used bytes of segment 'index'
+ went from 'before' to 'after'. A segment is sparse, if less than a quarter
+ of it is used.
+ */
+func (d *Directory) segmentShrunk(index int64, before, after int) error {
+	t,ok := d.File.(Truncater)
+	if d.NoAutoCompact || !ok { return nil }
+	segs,e := d.segments(t)
+	if e!=nil { return e }
+	if after<=1 && index==segs-1 {
+		/* Drop the empty segments at the end. */
+		for index>0 {
+			ents,e := d.ReadDir(index-1)
+			if e!=nil { return e }
+			if len(ents)>0 { break }
+			index--
+		}
+		return t.Truncate(index*int64(d.Segsz))
+	}
+	thr := d.Segsz/4
+	if before<thr || after>=thr { return nil }
+	d.sparse++
+	if d.sparse*2>=segs && d.cursors==0 { return d.Compact() }
+	return nil
+}
+
+/*
+ Repacks the entries of the directory into as few segments as possible and
+ releases the rest. This requires File to be a Truncater.
+
+ The new segments are written behind the old ones first, followed by a
+ header; each of them starts with a 0 byte, so this journal reads as empty
+ segments. Then they are copied to the front and the file is truncated. A
+ crash before the header leaves the old segments intact, a crash after it is
+ finished by Recover, so no entry is ever lost or duplicated.
+ */
+func (d *Directory) Compact() error {
+	t,ok := d.File.(Truncater)
+	if !ok { return ENoTruncate }
+	if d.Segsz < 17+len(compactMagic) { return ENoTruncate }
+	n,e := d.segments(t)
+	if e!=nil { return e }
+	var all []DirectoryEntry
+	for i:=int64(0); i<n; i++ {
+		ents,e := d.ReadDir(i)
+		if e!=nil { return e }
+		all = append(all,ents...)
+	}
+	
+	/* Pack into Segsz-1 bytes, as the journal shifts every segment by one byte. */
+	var segs [][]DirectoryEntry
+	var seg []DirectoryEntry
+	used := 1
+	for _,ent := range all {
+		l := d.Names.EntrySize(ent.Name)
+		if len(seg)>0 && used+l>d.Segsz-1 {
+			segs = append(segs,seg)
+			seg,used = nil,1
+		}
+		seg = append(seg,ent)
+		used += l
+	}
+	if len(seg)>0 { segs = append(segs,seg) }
+	k := int64(len(segs))
+	
+	buf := make([]byte,d.Segsz)
+	for i,seg := range segs {
+		for j := range buf { buf[j] = 0 }
+		e = writeDirEntries(seg,&dskimg.FixedIO{buf[1:],0},d.Names)
+		if e==nil { _,e = d.File.WriteAt(buf,(n+int64(i))*int64(d.Segsz)) }
+		if e!=nil { t.Truncate(n*int64(d.Segsz)); return e }
+	}
+	for j := range buf { buf[j] = 0 }
+	copy(buf[1:],compactMagic)
+	binary.BigEndian.PutUint64(buf[1+len(compactMagic):],uint64(n))
+	binary.BigEndian.PutUint64(buf[9+len(compactMagic):],uint64(k))
+	_,e = d.File.WriteAt(buf,(n+k)*int64(d.Segsz))
+	if e!=nil { t.Truncate(n*int64(d.Segsz)); return e }
+	
+	return d.replay(t,n,k)
+}
+
+/* The header of a compaction journal, after the leading 0 byte. */
+const compactMagic = "ods.compact"
+
+var ENoTruncate = errors.New("Directory can not be compacted")
+
+/* Copies the k journal segments at n to the front and truncates the file. */
+func (d *Directory) replay(t Truncater, n, k int64) error {
+	d.purgeCaches()
+	d.sparse = 0
+	buf := make([]byte,d.Segsz)
+	for i:=int64(0); i<k; i++ {
+		l,e := d.File.ReadAt(buf,(n+i)*int64(d.Segsz))
+		if l<len(buf) && e==nil { e = io.ErrUnexpectedEOF }
+		if l<len(buf) { return e }
+		copy(buf,buf[1:])
+		buf[d.Segsz-1] = 0
+		_,e = d.File.WriteAt(buf,i*int64(d.Segsz))
+		if e!=nil { return e }
+	}
+	return t.Truncate(k*int64(d.Segsz))
+}
+
+/*
+ Finishes a compaction, that has been interrupted by a crash (see Compact).
+ Should be called, before the directory is used. Files, that are no Truncater,
+ are never compacted.
+ */
+func (d *Directory) Recover() error {
+	t,ok := d.File.(Truncater)
+	if !ok { return nil }
+	segs,e := d.segments(t)
+	if e!=nil || segs==0 { return e }
+	if d.Segsz < 17+len(compactMagic) { return nil }
+	buf := make([]byte,d.Segsz)
+	l,e := d.File.ReadAt(buf,(segs-1)*int64(d.Segsz))
+	if l<len(buf) { return nil } /* Not a header. */
+	if buf[0]!=0 || string(buf[1:1+len(compactMagic)])!=compactMagic { return nil }
+	n := int64(binary.BigEndian.Uint64(buf[1+len(compactMagic):]))
+	k := int64(binary.BigEndian.Uint64(buf[9+len(compactMagic):]))
+	if n<0 || k<0 || n+k!=segs-1 { return nil }
+	return d.replay(t,n,k)
+}
+/* Adds an entry. The name is validated and normalized according to d.Names. */
 func (d *Directory) Add(dir DirectoryEntry) error {
-	if len(dir.Name)>255 || dir.Name=="" { return ELongname }
-	if length_Dirents([]DirectoryEntry{dir})>d.Segsz { return ELongname } /* Just in case */
+	var e error
+	dir.Name,e = d.Names.Normalize(dir.Name)
+	if e!=nil { return e }
+	if length_Dirents([]DirectoryEntry{dir},d.Names)>d.Segsz { return ELongname } /* Just in case */
 	for i:=int64(0); true; i++ {
 		arr,e := d.ReadDir(i)
 		arr = append(arr,dir)
-		lng := length_Dirents(arr)
+		lng := length_Dirents(arr,d.Names)
 		if lng>d.Segsz { continue }
 		e = d.WriteDir(i,arr)
 		if e==nil {
-			d.name_ent.Add(dir.Name,&dir_cache_ent{i,dir.Value})
+			d.name_ent.Add(d.Names.Key(dir.Name),&dir_cache_ent{i,dir.Name,dir.Value})
 		}
 		return e
 	}
@@ -239,10 +431,12 @@ func (d *Directory) ListUp(dest chan <- DirectoryEntry) {
 		for _,o := range arr { dest <- o }
 	}
 }
+/* A directory, that can not be read completely, is not empty. */
 func (d* Directory) IsEmpty() bool{
 	for i:=int64(0); true; i++ {
 		arr,e := d.ReadDir(i)
-		if e!=nil { return true }
+		if e==io.EOF { return true }
+		if e!=nil { return false }
 		if len(arr)>0 { return false }
 	}
 	panic("unreachable")
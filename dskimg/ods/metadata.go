@@ -38,6 +38,19 @@ const (
 	MDE_WriteTime
 	MDE_AccessTime
 	MDE_ACE
+	MDE_Owner
+	MDE_Group
+	MDE_Rdev
+	MDE_Policy
+	MDE_Properties
+)
+
+/* Storage policies (MDE_Policy). They correspond to the lcr.StoragePolicy values. */
+const (
+	POLICY_NONE = iota
+	POLICY_HOT
+	POLICY_MEDIUM
+	POLICY_COLD
 )
 
 type MetaDataEntry struct {
@@ -71,12 +84,30 @@ func (m *metaDataTime) fromMDE(mde *MetaDataEntry) {
 func (m *metaDataTime) toMDE(Type  uint8,mde *MetaDataEntry) (*MetaDataEntry){
 	if m.tstamp==nil { return nil }
 	uts := uint64(m.tstamp.Unix())
-	utsns := uint32(m.tstamp.UnixNano())
+	utsns := uint32(m.tstamp.Nanosecond())
 	*mde = MetaDataEntry{Type,0,0,utsns,uts}
 	return mde
 }
 
 
+type metaDataSID struct {
+	idx int64
+	sid security.SID
+	set bool
+}
+
+type metaDataU64 struct {
+	idx int64
+	val uint64
+	set bool
+}
+
+type metaDataRef struct {
+	idx int64
+	ref FileRef
+	set bool
+}
+
 type MetaDataMemory struct {
 	ACL  security.AccessControlList
 	mutex     sync.Mutex
@@ -84,6 +115,11 @@ type MetaDataMemory struct {
 	birthTime metaDataTime
 	writeTime metaDataTime
 	accesTime metaDataTime
+	owner     metaDataSID
+	group     metaDataSID
+	rdev      metaDataU64
+	policy    metaDataU64
+	props     metaDataRef
 	aclidx    map[security.SID]int64
 	freelist  []int64
 	length    int64
@@ -111,32 +147,38 @@ func (m *MetaDataMemory) Init(){
 }
 
 func (m *MetaDataMemory) BirthTime() *time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.birthTime.tstamp
 }
 func (m *MetaDataMemory) BirthTimeSet(tm time.Time) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if m.birthTime.tstamp==nil { m.birthTime.idx = m.getNewIndex(); return }
+	if m.birthTime.tstamp==nil { m.birthTime.idx = m.getNewIndex() }
 	m.birthTime.Set(tm)
 }
 
 func (m *MetaDataMemory) WriteTime() *time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.writeTime.tstamp
 }
 func (m *MetaDataMemory) WriteTimeSet(tm time.Time) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if m.birthTime.tstamp==nil { m.birthTime.idx = m.getNewIndex(); return }
+	if m.writeTime.tstamp==nil { m.writeTime.idx = m.getNewIndex() }
 	m.writeTime.Set(tm)
 }
 
 func (m *MetaDataMemory) AccessTime() *time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.accesTime.tstamp
 }
 func (m *MetaDataMemory) AccessTimeSet(tm time.Time) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if m.birthTime.tstamp==nil { m.birthTime.idx = m.getNewIndex(); return }
+	if m.accesTime.tstamp==nil { m.accesTime.idx = m.getNewIndex() }
 	m.accesTime.Set(tm)
 }
 
@@ -169,10 +211,23 @@ func (m *MetaDataMemory) loadEntry(ras RAS, mde *MetaDataEntry, i int64) error{
 		m.freelist = append(m.freelist,i)
 	case MDE_BirthTime:
 		m.birthTime.fromMDE(mde)
+		m.birthTime.idx = i
 	case MDE_WriteTime:
 		m.writeTime.fromMDE(mde)
+		m.writeTime.idx = i
 	case MDE_AccessTime:
 		m.accesTime.fromMDE(mde)
+		m.accesTime.idx = i
+	case MDE_Owner:
+		m.owner = metaDataSID{i,security.SID(mde.Data4),true}
+	case MDE_Group:
+		m.group = metaDataSID{i,security.SID(mde.Data4),true}
+	case MDE_Rdev:
+		m.rdev = metaDataU64{i,mde.Data4,true}
+	case MDE_Policy:
+		m.policy = metaDataU64{i,mde.Data4,true}
+	case MDE_Properties:
+		m.props = metaDataRef{i,FileRef{mde.Data3,uint32(mde.Data4),mde.Data2},true}
 	case MDE_ACE: {
 		sid := security.SID(mde.Data4)
 		acv := security.AccessControlVector(mde.Data3)
@@ -210,7 +265,96 @@ func (m *MetaDataMemory) PutAcl(ace security.AccessControlEntry, ras RAS) {
 	m.ACL.AddEntry(ace)
 	rights,_ := m.ACL[ace.Subject]
 	mde := &MetaDataEntry{MDE_ACE,0,0,uint32(rights),uint64(ace.Subject)}
+	m.buf.Pos = 0
 	mde.put(m.buf)
 	m.buf.WriteIndex(i,ras)
 }
 
+func (m *MetaDataMemory) putSID(Type uint8, ms *metaDataSID, sid security.SID, ras RAS) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !ms.set { ms.idx = m.getNewIndex() }
+	ms.sid = sid
+	ms.set = true
+	mde := &MetaDataEntry{Type,0,0,0,uint64(sid)}
+	m.buf.Pos = 0
+	mde.put(m.buf)
+	return m.buf.WriteIndex(ms.idx,ras)
+}
+
+// Returns the owner of the file, if any.
+func (m *MetaDataMemory) Owner() (security.SID,bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.owner.sid,m.owner.set
+}
+func (m *MetaDataMemory) PutOwner(sid security.SID, ras RAS) error {
+	return m.putSID(MDE_Owner,&m.owner,sid,ras)
+}
+
+// Returns the owning group of the file, if any.
+func (m *MetaDataMemory) Group() (security.SID,bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.group.sid,m.group.set
+}
+func (m *MetaDataMemory) PutGroup(sid security.SID, ras RAS) error {
+	return m.putSID(MDE_Group,&m.group,sid,ras)
+}
+
+// Returns the device number of a device file, if any.
+func (m *MetaDataMemory) Rdev() (uint64,bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.rdev.val,m.rdev.set
+}
+func (m *MetaDataMemory) PutRdev(rdev uint64, ras RAS) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.rdev.set { m.rdev.idx = m.getNewIndex() }
+	m.rdev.val = rdev
+	m.rdev.set = true
+	mde := &MetaDataEntry{MDE_Rdev,0,0,0,rdev}
+	m.buf.Pos = 0
+	mde.put(m.buf)
+	return m.buf.WriteIndex(m.rdev.idx,ras)
+}
+
+// Returns the storage policy (POLICY_*) of the file.
+func (m *MetaDataMemory) Policy() uint8 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.policy.set { return POLICY_NONE }
+	return uint8(m.policy.val)
+}
+func (m *MetaDataMemory) PutPolicy(policy uint8, ras RAS) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.policy.set { m.policy.idx = m.getNewIndex() }
+	m.policy.val = uint64(policy)
+	m.policy.set = true
+	mde := &MetaDataEntry{MDE_Policy,0,0,0,uint64(policy)}
+	m.buf.Pos = 0
+	mde.put(m.buf)
+	return m.buf.WriteIndex(m.policy.idx,ras)
+}
+
+// Returns the property file (FT_PROPS) of the file, if any.
+func (m *MetaDataMemory) PropertyFile() (FileRef,bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.props.ref,m.props.set
+}
+func (m *MetaDataMemory) PutPropertyFile(ref FileRef, ras RAS) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	idx := m.props.idx
+	if !m.props.set { idx = m.getNewIndex() }
+	mde := &MetaDataEntry{MDE_Properties,0,ref.Cookie,ref.File_MFT,uint64(ref.File_IDX)}
+	m.buf.Pos = 0
+	mde.put(m.buf)
+	e := m.buf.WriteIndex(idx,ras)
+	if e!=nil { return e } /* Keep the old reference. */
+	m.props = metaDataRef{idx,ref,true}
+	return nil
+}
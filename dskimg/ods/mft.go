@@ -47,8 +47,15 @@ const (
 	FT_FILE = 0xf0+iota
 	FT_DIR
 	FT_FIFO
+	FT_SOCK
+	FT_CHR  /* Character device. The device number is stored in the metadata file. */
+	FT_BLK  /* Block device. The device number is stored in the metadata file. */
 	
 	FT_METADATA = 0x30
+	FT_QUOTA    = 0x31
+	FT_ORPHANS  = 0x32
+	FT_PROPS    = 0x33 /* The property file of a file, see MDE_Properties. */
+	FT_BLOB     = 0x34 /* A BLOB value of a property. */
 )
 
 type MFTH struct{
@@ -111,6 +118,10 @@ func growarray_u64(arr []uint64) []uint64{
 	return narr
 }
 
+/*
+ An MFT is safe for concurrent use. Entries are handed out as copies; updates
+ spanning several entries (like chains) must be serialized by the caller.
+ */
 type MFT struct{
 	Head  *MFTH
 	Range RAS
@@ -120,6 +131,9 @@ type MFT struct{
 	
 	list_cache  *lru.TwoQueueCache
 	entry_cache *lru.TwoQueueCache
+	
+	mutex    sync.Mutex /* Protects Buf and reserved. */
+	reserved map[uint32]bool /* Allocated, but not yet written. */
 }
 func NewMFT(r RAS,blockSize uint32) (*MFT,error) {
 	mft := new(MFT)
@@ -131,6 +145,7 @@ func NewMFT(r RAS,blockSize uint32) (*MFT,error) {
 	if e!=nil { return nil,e }
 	
 	mft.Head = new(MFTH)
+	mft.reserved = make(map[uint32]bool)
 	mft.Range = r
 	mft.Buf = &dskimg.FixedIO{make([]byte,MFTE_SIZE),0}
 	mft.Size = 0
@@ -144,6 +159,8 @@ func NewMFT(r RAS,blockSize uint32) (*MFT,error) {
 	return mft,nil
 }
 func (m* MFT) SaveMFTH() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.Buf.Pos = 0
 	m.Size = m.Head.Num_BLK * m.EntriesPerBlock
 	e := binary.Write(m.Buf,binary.BigEndian,m.Head)
@@ -172,15 +189,28 @@ func (m* MFT) GetEntry(i uint32) (*MFTE,error) {
 	return f,nil
 }
 func (m* MFT) GetEntryLL(i uint32) (*MFTE,error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.getEntry(i)
+}
+func (m* MFT) getEntry(i uint32) (*MFTE,error) {
 	mer,ok := m.entry_cache.Get(i)
-	if ok { return mer.(*MFTE),nil }
-	mfe,e := m.GetEntryLLL(i)
-	if e==nil {
+	if !ok {
+		mfe,e := m.readEntry(i)
+		if e!=nil { return mfe,e }
 		m.entry_cache.Add(i,mfe)
+		mer = mfe
 	}
-	return mfe,e
+	c := *mer.(*MFTE)
+	return &c,nil
 }
+/* Reads an entry from disk, bypassing the cache. */
 func (m* MFT) GetEntryLLL(i uint32) (*MFTE,error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.readEntry(i)
+}
+func (m* MFT) readEntry(i uint32) (*MFTE,error) {
 	if i==0 { return nil,badmfte }
 	if i>=m.Size { return nil,badmfte }
 	e := m.Buf.ReadIndex(int64(i),m.Range)
@@ -195,13 +225,23 @@ func (m* MFT) PutEntry(mfte *MFTE) error {
 }
 */
 func (m* MFT) PutEntryLL(i uint32,mfte *MFTE) error {
-	e := m.PutEntryLLL(i,mfte)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e := m.writeEntry(i,mfte)
 	if e==nil {
-		m.entry_cache.Add(i,mfte)
+		c := *mfte
+		m.entry_cache.Add(i,&c)
+		delete(m.reserved,i)
 	}
 	return e
 }
+/* Writes an entry to disk, bypassing the cache. */
 func (m* MFT) PutEntryLLL(i uint32,mfte *MFTE) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.writeEntry(i,mfte)
+}
+func (m* MFT) writeEntry(i uint32,mfte *MFTE) error {
 	if i==0 { return badmfte }
 	if i>=m.Size { return badmfte }
 	m.Buf.Pos = 0
@@ -249,14 +289,32 @@ func (m* MFT) GetEntryChain(i uint32) (*MFTE_Chain,error) {
 func (m* MFT) ResetEntryChain(i uint32){
 	m.list_cache.Remove(i)
 }
+/*
+ Returns a fresh entry. The entry is reserved until it is written using
+ PutEntryLL or given back using Unreserve, so concurrent calls never return
+ the same entry. An entry, that can not be read, fails the allocation.
+ */
 func (m* MFT) Allocate() (*MFTE,error) {
-	for i:=uint32(0); i<m.Size; i++ {
-		_,e := m.GetEntry(i)
-		if e==cormfte { return m.CreateEntry(i),nil }
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i:=uint32(1); i<m.Size; i++ {
+		if m.reserved[i] { continue }
+		f,e := m.getEntry(i)
+		if e!=nil { return nil,e }
+		if f.File_IDX==i && f.File_MFT==m.Head.MFT_ID { continue }
+		m.reserved[i] = true
+		return m.CreateEntry(i),nil
 	}
 	return nil,allocmfte
 }
 
+/* Gives back an entry returned by Allocate, that is not going to be written. */
+func (m* MFT) Unreserve(i uint32) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.reserved,i)
+}
+
 func MFT_IsAllocFail(e error) bool {
 	return e==allocmfte
 }
@@ -324,6 +382,11 @@ func (mm* MMFT) GetEntryChain(ii, i uint32) (*MFTE_Chain,error) {
 	if !ok { return nil,nomfte }
 	return m.GetEntryChain(i)
 }
+func (mm* MMFT) GetEntryChainLL(ii, i uint32) (*MFTE_Chain,error) {
+	m,ok := mm.get(ii)
+	if !ok { return nil,nomfte }
+	return m.GetEntryChainLL(i)
+}
 func (mm* MMFT) ResetEntryChain(ii,i uint32) {
 	m,ok := mm.get(ii)
 	if ok { m.ResetEntryChain(i) }
@@ -338,5 +401,10 @@ func (mm* MMFT) Allocate(ii uint32) (*MFTE,error) {
 	if !ok { return nil,nomfte }
 	return m.Allocate()
 }
+func (mm* MMFT) Unreserve(ii, i uint32) {
+	m,ok := mm.get(ii)
+	if !ok { return }
+	m.Unreserve(i)
+}
 
 
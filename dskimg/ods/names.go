@@ -0,0 +1,76 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ods
+
+import "errors"
+import "unicode/utf8"
+
+import "golang.org/x/text/cases"
+import "golang.org/x/text/unicode/norm"
+
+var EBadName = errors.New("Invalid filename")
+
+/* The filename policy of a volume, as stored in Superblock.NameFlags. */
+type NamePolicy uint32
+
+const (
+	NAME_CASEFOLD NamePolicy = 1<<iota /* Case-insensitive, case-preserving lookup (Unicode case folding). */
+	NAME_NFC      /* Names are normalized to NFC on insert and lookup. */
+	NAME_UTF8     /* Names must be valid UTF-8. */
+	NAME_LONG     /* Extended entry encoding, that allows names longer than 255 bytes. */
+)
+
+/* The longest name with NAME_LONG. Every entry must fit into one directory segment, too. */
+const MaxLongName = 0xffff
+
+func (p NamePolicy) MaxName() int {
+	if p&NAME_LONG!=0 { return MaxLongName }
+	return 255
+}
+
+/* Validates a name, that is about to be inserted, and returns the form to be stored. */
+func (p NamePolicy) Normalize(name string) (string,error) {
+	if name=="" { return "",EBadName }
+	if p&NAME_UTF8!=0 && !utf8.ValidString(name) { return "",EBadName }
+	if p&NAME_NFC!=0 { name = norm.NFC.String(name) }
+	if len(name)>p.MaxName() { return "",ELongname }
+	return name,nil
+}
+
+/* Returns the form, by which names are compared. */
+func (p NamePolicy) Key(name string) string {
+	if p&NAME_NFC!=0 { name = norm.NFC.String(name) }
+	if p&NAME_CASEFOLD!=0 && utf8.ValidString(name) {
+		name = cases.Fold().String(name)
+		if p&NAME_NFC!=0 { name = norm.NFC.String(name) }
+	}
+	return name
+}
+
+/* The encoded size of a directory entry. */
+func (p NamePolicy) EntrySize(name string) int {
+	if p&NAME_LONG!=0 && len(name)>=255 { return len(name)+20 } /* 255; 2 byte length; name; 17 byte File-Link */
+	return len(name)+18
+}
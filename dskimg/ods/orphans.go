@@ -0,0 +1,134 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ods
+
+import "sync"
+import "encoding/binary"
+import "github.com/maxymania/anyfs/dskimg"
+
+const ORPHAN_SIZE = 16
+
+/*
+ A record of the orphan file: a file without links, that is still open.
+ File_IDX==0 marks a free record.
+ */
+type OrphanEntry struct{
+	File_MFT  uint32
+	File_IDX  uint32
+	Cookie    uint64
+}
+func orphanKey(ii, i uint32) uint64 {
+	return (uint64(ii)<<32)|uint64(i)
+}
+
+// The in-memory copy of the orphan file.
+type OrphanList struct{
+	mutex    sync.Mutex
+	buf      *dskimg.FixedIO
+	entries  map[uint64]OrphanEntry
+	index    map[uint64]int64
+	freelist []int64
+	length   int64
+}
+func (o *OrphanList) Init() {
+	o.buf = &dskimg.FixedIO{make([]byte,ORPHAN_SIZE),0}
+	o.entries = make(map[uint64]OrphanEntry)
+	o.index   = make(map[uint64]int64)
+}
+func (o *OrphanList) LoadMax(ras RAS, max int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	max /= ORPHAN_SIZE
+	for i:=int64(0); i<max; i++ {
+		var oe OrphanEntry
+		if o.buf.ReadIndex(i,ras)!=nil { continue }
+		if binary.Read(o.buf,binary.BigEndian,&oe)!=nil { continue }
+		if oe.File_IDX==0 { o.freelist = append(o.freelist,i); continue }
+		key := orphanKey(oe.File_MFT,oe.File_IDX)
+		o.entries[key] = oe
+		o.index[key] = i
+	}
+	o.length = max
+}
+func (o *OrphanList) write(i int64, oe *OrphanEntry, ras RAS) error {
+	o.buf.Pos = 0
+	e := binary.Write(o.buf,binary.BigEndian,oe)
+	if e!=nil { return e }
+	return o.buf.WriteIndex(i,ras)
+}
+
+// Adds a file to the orphan list.
+func (o *OrphanList) Add(oe OrphanEntry, ras RAS) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	key := orphanKey(oe.File_MFT,oe.File_IDX)
+	i,ok := o.index[key]
+	if !ok {
+		i = o.length
+		if len(o.freelist)>0 {
+			i = o.freelist[0]
+			o.freelist = o.freelist[1:]
+		} else {
+			o.length++
+		}
+	}
+	e := o.write(i,&oe,ras)
+	if e!=nil { return e }
+	o.entries[key] = oe
+	o.index[key] = i
+	return nil
+}
+
+// Removes a file from the orphan list.
+func (o *OrphanList) Remove(ii, i uint32, ras RAS) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	key := orphanKey(ii,i)
+	idx,ok := o.index[key]
+	if !ok { return nil }
+	e := o.write(idx,&OrphanEntry{},ras)
+	if e!=nil { return e }
+	delete(o.entries,key)
+	delete(o.index,key)
+	o.freelist = append(o.freelist,idx)
+	return nil
+}
+
+// Returns the orphan record of a file, if any.
+func (o *OrphanList) Get(ii, i uint32) (OrphanEntry,bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	oe,ok := o.entries[orphanKey(ii,i)]
+	return oe,ok
+}
+
+// Returns copies of all orphan records.
+func (o *OrphanList) List() []OrphanEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	l := make([]OrphanEntry,0,len(o.entries))
+	for _,oe := range o.entries { l = append(l,oe) }
+	return l
+}
@@ -0,0 +1,158 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ods
+
+import "io"
+import "encoding/binary"
+import "errors"
+
+var EPropName  = errors.New("Bad property name")
+var EPropValue = errors.New("Bad property value")
+
+/* Property value types. They correspond to the lcr.TypeID values. */
+const (
+	PROP_BLOB = iota
+	PROP_STRING
+	PROP_INTEGER
+	PROP_DATETIME
+)
+
+/*
+ A reference to a file, that is owned by another file. Like MFTE.Mdf_Cookie,
+ it only keeps the 16 least significant bits of the cookie.
+ */
+type FileRef struct{
+	File_MFT uint32
+	File_IDX uint32
+	Cookie   uint16
+}
+
+type PropertyValue struct{
+	Type uint8
+	Int  int64   /* PROP_INTEGER; the seconds of PROP_DATETIME */
+	Nsec uint32  /* The nanoseconds of PROP_DATETIME */
+	Str  string  /* PROP_STRING */
+	Blob FileRef /* PROP_BLOB */
+}
+
+type Property struct{
+	Name   string
+	Values []PropertyValue
+}
+
+/*
+ A property file is a sequence of properties, terminated by an empty name:
+ 2 byte name_length; name; 4 byte value count; values. A value is a 1 byte
+ type followed by: BLOB 10 byte FileRef; STRING 4 byte length and the string;
+ INTEGER 8 byte; DATETIME 8 byte seconds and 4 byte nanoseconds.
+ */
+func ReadProperties(src io.Reader) ([]Property,error) {
+	var nl uint16
+	var cnt uint32
+	var props []Property
+	for {
+		e := binary.Read(src,binary.BigEndian,&nl)
+		if e==io.EOF && len(props)==0 { return nil,nil } /* Empty file. */
+		if e!=nil { return props,e }
+		if nl==0 { break }
+		nb := make([]byte,nl)
+		_,e = io.ReadFull(src,nb)
+		if e!=nil { return props,e }
+		e = binary.Read(src,binary.BigEndian,&cnt)
+		if e!=nil { return props,e }
+		p := Property{Name:string(nb)}
+		for ; cnt>0; cnt-- {
+			v,e := readPropertyValue(src)
+			if e!=nil { return props,e }
+			p.Values = append(p.Values,v)
+		}
+		props = append(props,p)
+	}
+	return props,nil
+}
+func readPropertyValue(src io.Reader) (v PropertyValue,e error) {
+	buf := []byte{0}
+	_,e = io.ReadFull(src,buf)
+	if e!=nil { return }
+	v.Type = buf[0]
+	switch v.Type {
+	case PROP_BLOB:
+		e = binary.Read(src,binary.BigEndian,&v.Blob)
+	case PROP_STRING:
+		var l uint32
+		e = binary.Read(src,binary.BigEndian,&l)
+		if e!=nil { return }
+		sb := make([]byte,l)
+		_,e = io.ReadFull(src,sb)
+		v.Str = string(sb)
+	case PROP_INTEGER:
+		e = binary.Read(src,binary.BigEndian,&v.Int)
+	case PROP_DATETIME:
+		e = binary.Read(src,binary.BigEndian,&v.Int)
+		if e!=nil { return }
+		e = binary.Read(src,binary.BigEndian,&v.Nsec)
+	default:
+		e = EPropValue
+	}
+	if e==io.EOF { e = io.ErrUnexpectedEOF }
+	return
+}
+func WriteProperties(props []Property, dst io.Writer) error {
+	for _,p := range props {
+		if len(p.Name)==0 || len(p.Name)>0xffff { return EPropName }
+		e := binary.Write(dst,binary.BigEndian,uint16(len(p.Name)))
+		if e!=nil { return e }
+		_,e = dst.Write([]byte(p.Name))
+		if e!=nil { return e }
+		e = binary.Write(dst,binary.BigEndian,uint32(len(p.Values)))
+		if e!=nil { return e }
+		for _,v := range p.Values {
+			e = writePropertyValue(v,dst)
+			if e!=nil { return e }
+		}
+	}
+	return binary.Write(dst,binary.BigEndian,uint16(0))
+}
+func writePropertyValue(v PropertyValue, dst io.Writer) error {
+	_,e := dst.Write([]byte{v.Type})
+	if e!=nil { return e }
+	switch v.Type {
+	case PROP_BLOB:
+		return binary.Write(dst,binary.BigEndian,v.Blob)
+	case PROP_STRING:
+		if uint64(len(v.Str))>0xffffffff { return EPropValue }
+		e = binary.Write(dst,binary.BigEndian,uint32(len(v.Str)))
+		if e!=nil { return e }
+		_,e = dst.Write([]byte(v.Str))
+		return e
+	case PROP_INTEGER:
+		return binary.Write(dst,binary.BigEndian,v.Int)
+	case PROP_DATETIME:
+		e = binary.Write(dst,binary.BigEndian,v.Int)
+		if e!=nil { return e }
+		return binary.Write(dst,binary.BigEndian,v.Nsec)
+	}
+	return EPropValue
+}
@@ -0,0 +1,176 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ods
+
+import "sync"
+import "errors"
+import "encoding/binary"
+import "github.com/maxymania/anyfs/dskimg"
+import "github.com/maxymania/anyfs/security"
+
+var EQuota = errors.New("Disk quota exceeded")
+
+const QUOTA_SIZE = 48
+
+/*
+ A record of the quota file. Subject==0 marks a free record.
+ A limit of 0 means "unlimited".
+ */
+type QuotaEntry struct{
+	Subject    security.SID
+	BlockLimit uint64
+	FileLimit  uint64
+	Blocks     uint64 /* Blocks in use */
+	Files      uint64 /* Files in use */
+	Reserved   uint64
+}
+func (q *QuotaEntry) exceeds(blocks, files int64) bool {
+	if blocks>0 && q.BlockLimit!=0 && q.Blocks+uint64(blocks)>q.BlockLimit { return true }
+	if files>0 && q.FileLimit!=0 && q.Files+uint64(files)>q.FileLimit { return true }
+	return false
+}
+func add_saturated(u uint64, i int64) uint64 {
+	if i>=0 { return u+uint64(i) }
+	if uint64(-i)>u { return 0 }
+	return u-uint64(-i)
+}
+
+// The in-memory copy of the quota file.
+type QuotaTable struct{
+	mutex    sync.Mutex
+	buf      *dskimg.FixedIO
+	entries  map[security.SID]*QuotaEntry
+	index    map[security.SID]int64
+	freelist []int64
+	length   int64
+}
+func (q *QuotaTable) Init() {
+	q.buf = &dskimg.FixedIO{make([]byte,QUOTA_SIZE),0}
+	q.entries = make(map[security.SID]*QuotaEntry)
+	q.index   = make(map[security.SID]int64)
+}
+func (q *QuotaTable) LoadMax(ras RAS, max int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	max /= QUOTA_SIZE
+	for i:=int64(0); i<max; i++ {
+		qe := new(QuotaEntry)
+		if q.buf.ReadIndex(i,ras)!=nil { continue }
+		if binary.Read(q.buf,binary.BigEndian,qe)!=nil { continue }
+		if qe.Subject==0 { q.freelist = append(q.freelist,i); continue }
+		q.entries[qe.Subject] = qe
+		q.index[qe.Subject] = i
+	}
+	q.length = max
+}
+func (q *QuotaTable) store(qe *QuotaEntry, ras RAS) error {
+	i,ok := q.index[qe.Subject]
+	if !ok {
+		i = q.length
+		if len(q.freelist)>0 {
+			i = q.freelist[0]
+			q.freelist = q.freelist[1:]
+		} else {
+			q.length++
+		}
+		q.index[qe.Subject] = i
+	}
+	q.buf.Pos = 0
+	e := binary.Write(q.buf,binary.BigEndian,qe)
+	if e!=nil { return e }
+	return q.buf.WriteIndex(i,ras)
+}
+func (q *QuotaTable) get(sid security.SID) *QuotaEntry {
+	qe,ok := q.entries[sid]
+	if !ok {
+		qe = &QuotaEntry{Subject:sid}
+		q.entries[sid] = qe
+	}
+	return qe
+}
+
+// Returns a copy of the quota record of 'sid'.
+func (q *QuotaTable) Get(sid security.SID) (QuotaEntry,bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	qe,ok := q.entries[sid]
+	if !ok { return QuotaEntry{Subject:sid},false }
+	return *qe,true
+}
+
+// Returns copies of all quota records.
+func (q *QuotaTable) List() []QuotaEntry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	l := make([]QuotaEntry,0,len(q.entries))
+	for _,qe := range q.entries { l = append(l,*qe) }
+	return l
+}
+
+func (q *QuotaTable) SetLimits(sid security.SID, blocks, files uint64, ras RAS) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	qe := q.get(sid)
+	qe.BlockLimit = blocks
+	qe.FileLimit  = files
+	return q.store(qe,ras)
+}
+
+// Overwrites the usage counters of 'sid'. Used by quota checkers.
+func (q *QuotaTable) SetUsage(sid security.SID, blocks, files uint64, ras RAS) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	qe := q.get(sid)
+	qe.Blocks = blocks
+	qe.Files  = files
+	return q.store(qe,ras)
+}
+
+/*
+ Adds 'blocks' and 'files' to the usage of every SID in 'sids' (SID 0 is skipped).
+ If 'enforce' is true and any positive delta would exceed a limit, nothing is
+ changed and EQuota is returned.
+ */
+func (q *QuotaTable) Charge(sids []security.SID, blocks, files int64, enforce bool, ras RAS) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if enforce {
+		for _,sid := range sids {
+			if sid==0 { continue }
+			qe,ok := q.entries[sid]
+			if ok && qe.exceeds(blocks,files) { return EQuota }
+		}
+	}
+	var err error
+	for _,sid := range sids {
+		if sid==0 { continue }
+		qe := q.get(sid)
+		qe.Blocks = add_saturated(qe.Blocks,blocks)
+		qe.Files  = add_saturated(qe.Files,files)
+		e := q.store(qe,ras)
+		if e!=nil { err = e }
+	}
+	return err
+}
@@ -29,6 +29,11 @@ import "github.com/maxymania/anyfs/dskimg"
 
 const Superblock_MagicNumber = 0x19771025
 
+const (
+	SB_STATE_CLEAN   = 0 /* Cleanly unmounted (or never mounted). */
+	SB_STATE_MOUNTED = 1 /* Mounted, or not cleanly unmounted. */
+)
+
 type Superblock struct{
 	MagicNumber uint32
 	BlockSize   uint32
@@ -38,6 +43,11 @@ type Superblock struct{
 	Bitmap_LEN  uint64
 	FirstMFT    uint64
 	DirSegSize  uint32 /* Directory Segment Size */
+	State       uint32 /* SB_STATE_* */
+	MountPID    uint32   /* Process, that has mounted the file system. */
+	MountHost   [64]byte /* Host, that has mounted the file system (NUL-padded). */
+	NameFlags   uint32   /* Filename policy (NAME_*), set by mkfs. 0 on older images. */
+	Tier_BLK    uint64   /* First block of the slow tier. 0, if the volume has only one tier. */
 }
 
 func (sb *Superblock) LoadSuperblock(i int64,rwa dskimg.IoReaderWriterAt) error{
@@ -53,6 +63,17 @@ func (sb *Superblock) StoreSuperblock(i int64,rwa dskimg.IoReaderWriterAt) error
 	_,e = rwa.WriteAt(fio.Buffer,i)
 	return e
 }
+func (sb *Superblock) SetMountHost(host string) {
+	sb.MountHost = [64]byte{}
+	copy(sb.MountHost[:],host)
+}
+func (sb *Superblock) GetMountHost() string {
+	b := sb.MountHost[:]
+	for i,c := range b {
+		if c==0 { return string(b[:i]) }
+	}
+	return string(b)
+}
 func (sb *Superblock) Offset(i uint64) int64 {
 	return int64(i*uint64(sb.BlockSize))
 }
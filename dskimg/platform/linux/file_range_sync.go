@@ -36,7 +36,7 @@ SYNC_FILE_RANGE_WAIT_AFTER     = 4
 
 
 func linux_file_syncer (file *os.File, off int64, n int) (err error) {
-	return syscall.SyncFileRange(int(file.Fd()),off,int64(n),1|4)
+	return syscall.SyncFileRange(int(file.Fd()),off,int64(n),1|2|4)
 }
 
 func init(){
@@ -0,0 +1,46 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package linuxplugin
+
+import "os"
+import "syscall"
+import "github.com/maxymania/anyfs/dskimg"
+
+func linux_host_stat (fi os.FileInfo) (*dskimg.HostFileInfo,bool) {
+	st,ok := fi.Sys().(*syscall.Stat_t)
+	if !ok { return nil,false }
+	return &dskimg.HostFileInfo{
+		Dev: uint64(st.Dev),
+		Ino: uint64(st.Ino),
+		Nlink: uint64(st.Nlink),
+		Uid: st.Uid,
+		Gid: st.Gid,
+		Rdev: uint64(st.Rdev),
+	},true
+}
+
+func init(){
+	dskimg.HostStat = linux_host_stat
+}
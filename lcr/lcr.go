@@ -36,6 +36,9 @@ const (
 	DATETIME
 )
 
+/* Returned by Values.GetTypeID for an index out of range. */
+const INVALID = TypeID(-1)
+
 type StoragePolicy string
 const (
 	STORE_HOT    = StoragePolicy("standard.policy.Hot")
@@ -43,6 +46,7 @@ const (
 	STORE_COLD   = StoragePolicy("standard.policy.Cold")
 )
 
+/* An open BLOB value. It must be closed after use. */
 type Blob interface{
 	io.ReaderAt
 	io.WriterAt
@@ -52,6 +56,10 @@ type Blob interface{
 	UnderlyingObject() interface{}
 }
 
+/*
+ The values of a property. A getter returns the zero value, if the value at
+ index i has a different type or does not exist; GetTypeID returns INVALID.
+ */
 type Values interface{
 	GetBlob(i int) Blob
 	GetString(i int) string
@@ -63,9 +71,42 @@ type Values interface{
 }
 
 type Node interface{
+	/* Returns the values of the property, nil if it does not exist. */
 	GetProperty(name string) Values
+	/*
+	 Adds values to the property, or replaces them if overwrite is set (then,
+	 no values remove the property). See Canonical for the accepted types.
+	 Returns the resulting values of the property, nil on failure.
+	 */
 	PutProperties(name string, overwrite bool, i ...interface{}) Values
+	/* Returns the child node, nil if it does not exist. */
 	Lookup(name string) Node
+	/* Returns the child node; it is created, if it does not exist. nil on failure. */
 	Create(name string) Node
 }
 
+/*
+ Converts a value passed to PutProperties to the form it is stored in:
+ []byte (the initial content of a BLOB; nil is an empty one), string, int64
+ for all integer types and time.Time. ok is false for other types.
+ */
+func Canonical(v interface{}) (c interface{}, t TypeID, ok bool) {
+	switch x := v.(type) {
+	case nil: return []byte(nil),BLOB,true
+	case []byte: return x,BLOB,true
+	case string: return x,STRING,true
+	case int: return int64(x),INTEGER,true
+	case int8: return int64(x),INTEGER,true
+	case int16: return int64(x),INTEGER,true
+	case int32: return int64(x),INTEGER,true
+	case int64: return x,INTEGER,true
+	case uint8: return int64(x),INTEGER,true
+	case uint16: return int64(x),INTEGER,true
+	case uint32: return int64(x),INTEGER,true
+	case uint: return int64(x),INTEGER,true
+	case uint64: return int64(x),INTEGER,true
+	case time.Time: return x,DATETIME,true
+	}
+	return nil,BLOB,false
+}
+
@@ -0,0 +1,400 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+/*
+Secondary indexes over a tree of lcr nodes, which makes them queryable (see
+lcr.Querier). The indexes are maintained by PutProperties of the nodes handed
+out by the index and kept in a log on the root node (see LogProperty), which
+New loads. Properties set bypassing the index are not seen until the next New,
+removed nodes are skipped. Names must not contain "/".
+
+Loading the log still walks the tree, to compare the stamp of every node (see
+lcr.Stamper) with the log; on fs1, that is a metadata file and an MFT entry
+read per node. Only nodes, that have changed, are read. Without a usable log,
+New scans the tree: it reads every property of every node, which is a
+property file read more per node. Removing LogProperty from the root forces a
+scan; so does a crash, as the log is only clean after Close.
+*/
+package lcrindex
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/maxymania/anyfs/lcr"
+)
+
+var ENotLister  = errors.New("Node does not implement lcr.Lister")
+var ENotIndexed = errors.New("Property is not indexed")
+var ENotStamper = errors.New("Node does not implement lcr.Stamper")
+
+/* An indexed value. Fields, that do not apply to the type, are 0. */
+type key struct{
+	t lcr.TypeID
+	i int64 /* INTEGER; the seconds of DATETIME */
+	n int64 /* The nanoseconds of DATETIME */
+	s string
+}
+func (a key) less(b key) bool {
+	if a.t!=b.t { return a.t<b.t }
+	if a.i!=b.i { return a.i<b.i }
+	if a.n!=b.n { return a.n<b.n }
+	return a.s<b.s
+}
+func keyOf(t lcr.TypeID, v interface{}) (key,bool) {
+	switch t {
+	case lcr.STRING: return key{t:t,s:v.(string)},true
+	case lcr.INTEGER: return key{t:t,i:v.(int64)},true
+	case lcr.DATETIME:
+		d := v.(time.Time)
+		return key{t:t,i:d.Unix(),n:int64(d.Nanosecond())},true
+	}
+	return key{},false
+}
+/* Returns the key of a value given as for PutProperties. */
+func keyOfValue(v interface{}) (key,bool) {
+	c,t,ok := lcr.Canonical(v)
+	if !ok { return key{},false }
+	return keyOf(t,c)
+}
+func keysOf(v lcr.Values) []key {
+	var keys []key
+	for i := 0; i<v.Length(); i++ {
+		var k key
+		ok := false
+		switch t := v.GetTypeID(i); t {
+		case lcr.STRING: k,ok = keyOf(t,v.GetString(i))
+		case lcr.INTEGER: k,ok = keyOf(t,v.GetInt(i))
+		case lcr.DATETIME: k,ok = keyOf(t,v.GetDate(i))
+		}
+		if ok { keys = append(keys,k) }
+	}
+	return keys
+}
+
+type entry struct{
+	k    key
+	path string
+}
+func (a entry) less(b entry) bool {
+	if a.k!=b.k { return a.k.less(b.k) }
+	return a.path<b.path
+}
+
+/* The index of a property: its entries, sorted. */
+type column []entry
+func (c column) find(e entry) int {
+	return sort.Search(len(c),func(i int) bool { return !c[i].less(e) })
+}
+func (c *column) insert(e entry) {
+	i := c.find(e)
+	if i<len(*c) && (*c)[i]==e { return }
+	*c = append(*c,entry{})
+	copy((*c)[i+1:],(*c)[i:])
+	(*c)[i] = e
+}
+func (c *column) remove(e entry) {
+	i := c.find(e)
+	if i<len(*c) && (*c)[i]==e { *c = append((*c)[:i],(*c)[i+1:]...) }
+}
+
+type Index struct{
+	root  lcr.Node
+	names map[string]bool /* The indexed properties; nil means all. */
+	
+	lock  sync.RWMutex
+	cols  map[string]*column
+	fwd   map[string]map[string][]key /* path -> property -> keys */
+	stamps map[string]string /* path -> stamp of the node, as far as known */
+	
+	log     lcr.Blob /* nil, if the index is not persisted */
+	size    int64
+	records int /* The records in the log */
+	limit   int /* The records, that cause a rewrite */
+}
+
+/*
+New indexes the tree below root and returns root as indexed node. If names are
+given, only these properties are indexed. All nodes must implement lcr.Lister.
+The index is loaded from the log on root, if all nodes implement lcr.Stamper,
+or built by a scan of the tree. Only one index may be open on a tree at a time; it should be closed after use.
+
+If root cannot store the log, the index still works, but is not persisted.
+*/
+func New(root lcr.Node, names ...string) (*Node,error) {
+	ix := &Index{root:root}
+	ix.reset()
+	if len(names)>0 {
+		ix.names = make(map[string]bool)
+		for _,name := range names { ix.names[name] = true }
+	}
+	if !ix.load() {
+		ix.reset()
+		e := ix.scan(root,"")
+		if e!=nil { return nil,e }
+		if ix.rewrite(false)!=nil && ix.log!=nil { ix.abandon() }
+	}
+	return &Node{ix,root,""},nil
+}
+
+func (ix *Index) reset() {
+	ix.cols = make(map[string]*column)
+	ix.fwd = make(map[string]map[string][]key)
+	ix.stamps = make(map[string]string)
+}
+
+func join(base, name string) string {
+	if base=="" { return name }
+	return base+"/"+name
+}
+
+func (ix *Index) indexed(name string) bool {
+	return ix.names==nil || ix.names[name]
+}
+func (ix *Index) scan(n lcr.Node, path string) error {
+	l,ok := n.(lcr.Lister)
+	if !ok { return ENotLister }
+	ix.scanNode(n,l,path)
+	for _,name := range l.Children() {
+		c := n.Lookup(name)
+		if c==nil { continue }
+		e := ix.scan(c,join(path,name))
+		if e!=nil { return e }
+	}
+	return nil
+}
+/* Reads the properties of a node. The stamp is taken first, so a concurrent change shows up as a newer stamp. */
+func (ix *Index) scanNode(n lcr.Node, l lcr.Lister, path string) {
+	if st,ok := n.(lcr.Stamper); ok {
+		if s,ok := st.PropertyStamp(); ok { ix.stamps[path] = s }
+	}
+	for _,name := range l.PropertyNames() {
+		if !ix.indexed(name) || (path=="" && name==LogProperty) { continue }
+		if v := n.GetProperty(name); v!=nil { ix.set(path,name,keysOf(v)) }
+	}
+}
+/* Replaces the indexed values of a property of a node. The caller must hold the write lock. */
+func (ix *Index) update(path, name string, v lcr.Values) {
+	keys := keysOf(v)
+	ix.set(path,name,keys)
+	ix.append(func(buf *bytes.Buffer) { putRecord(buf,path,name,keys) })
+}
+/* Records the stamp of a node after an update. The caller must hold the write lock. */
+func (ix *Index) stamp(path string, n lcr.Node) {
+	st,ok := n.(lcr.Stamper)
+	if !ok { return }
+	s,ok := st.PropertyStamp()
+	if !ok { return } /* The old stamp differs, so the node is read again. */
+	ix.stamps[path] = s
+	ix.append(func(buf *bytes.Buffer) { putStamp(buf,path,s) })
+}
+func (ix *Index) set(path, name string, keys []key) {
+	col := ix.cols[name]
+	if col==nil {
+		col = new(column)
+		ix.cols[name] = col
+	}
+	props := ix.fwd[path]
+	if props==nil {
+		props = make(map[string][]key)
+		ix.fwd[path] = props
+	}
+	for _,k := range props[name] { col.remove(entry{k,path}) }
+	for _,k := range keys { col.insert(entry{k,path}) }
+	if len(keys)==0 {
+		delete(props,name)
+	} else {
+		props[name] = keys
+	}
+}
+/* Drops a node, that has been removed. */
+func (ix *Index) forget(path string) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	_,ok := ix.fwd[path]
+	_,ok2 := ix.stamps[path]
+	if !ok && !ok2 { return }
+	ix.drop(path)
+	ix.append(func(buf *bytes.Buffer) { putDrop(buf,path) })
+}
+func (ix *Index) drop(path string) {
+	for name,keys := range ix.fwd[path] {
+		for _,k := range keys { ix.cols[name].remove(entry{k,path}) }
+	}
+	delete(ix.fwd,path)
+	delete(ix.stamps,path)
+}
+
+/* Returns the paths of the nodes, whose property satisfies the predicate. The caller must hold the lock. */
+func (ix *Index) lookup(p lcr.Predicate) (map[string]bool,error) {
+	if !ix.indexed(p.Name) { return nil,ENotIndexed }
+	var lo key
+	var in func(k key) bool
+	switch p.Op {
+	case lcr.EQUAL:
+		k,ok := keyOfValue(p.Value)
+		if !ok { return nil,lcr.EQuery }
+		lo = k
+		in = func(x key) bool { return x==k }
+	case lcr.RANGE:
+		var hi key
+		var ok bool
+		open := p.Limit==nil
+		if p.Value!=nil {
+			lo,ok = keyOfValue(p.Value)
+			if !ok { return nil,lcr.EQuery }
+		}
+		if !open {
+			hi,ok = keyOfValue(p.Limit)
+			if !ok || (p.Value!=nil && hi.t!=lo.t) { return nil,lcr.EQuery }
+		}
+		switch {
+		case p.Value==nil && open: return nil,lcr.EQuery
+		case p.Value==nil: lo = key{t:hi.t,i:math.MinInt64,n:math.MinInt64}
+		}
+		if lo.t!=lcr.INTEGER && lo.t!=lcr.DATETIME { return nil,lcr.EQuery }
+		t := lo.t
+		in = func(x key) bool { return x.t==t && (open || x.less(hi)) }
+	case lcr.PREFIX:
+		s,ok := p.Value.(string)
+		if !ok { return nil,lcr.EQuery }
+		lo = key{t:lcr.STRING,s:s}
+		in = func(x key) bool { return x.t==lcr.STRING && strings.HasPrefix(x.s,s) }
+	default:
+		return nil,lcr.EQuery
+	}
+	set := make(map[string]bool)
+	col := ix.cols[p.Name]
+	if col==nil { return set,nil }
+	c := *col
+	i := sort.Search(len(c),func(i int) bool { return !c[i].k.less(lo) })
+	for ; i<len(c) && in(c[i].k); i++ { set[c[i].path] = true }
+	return set,nil
+}
+/* Returns the sorted paths below base, that satisfy all predicates and follow 'after'. */
+func (ix *Index) match(preds []lcr.Predicate, base, after string) ([]string,error) {
+	if len(preds)==0 { return nil,lcr.EQuery }
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	var set map[string]bool
+	for _,p := range preds {
+		s,e := ix.lookup(p)
+		if e!=nil { return nil,e }
+		if set==nil {
+			set = s
+			continue
+		}
+		for path := range set {
+			if !s[path] { delete(set,path) }
+		}
+	}
+	prefix := join(base,"")
+	var list []string
+	for path := range set {
+		if path==base || !strings.HasPrefix(path,prefix) { continue }
+		if after!="" && path<=after { continue }
+		list = append(list,path)
+	}
+	sort.Strings(list)
+	return list,nil
+}
+/* Returns the node at path, nil if it has been removed. */
+func (ix *Index) resolve(path string) *Node {
+	n := ix.root
+	for _,name := range strings.Split(path,"/") {
+		n = n.Lookup(name)
+		if n==nil { return nil }
+	}
+	return &Node{ix,n,path}
+}
+
+// A Node is a node of an indexed tree. It implements lcr.Node, lcr.Lister and lcr.Querier.
+type Node struct{
+	ix   *Index
+	n    lcr.Node
+	path string
+}
+
+// Unwrap returns the underlying node.
+func (n *Node) Unwrap() lcr.Node { return n.n }
+
+func (n *Node) GetProperty(name string) lcr.Values {
+	return n.n.GetProperty(name)
+}
+func (n *Node) PutProperties(name string, overwrite bool, i ...interface{}) lcr.Values {
+	if n.path=="" && name==LogProperty { return n.n.PutProperties(name,overwrite,i...) }
+	/* Hold the lock across the update, so the index sees the updates in order. */
+	n.ix.lock.Lock()
+	defer n.ix.lock.Unlock()
+	v := n.n.PutProperties(name,overwrite,i...)
+	if v!=nil && n.ix.indexed(name) { n.ix.update(n.path,name,v) }
+	n.ix.stamp(n.path,n.n)
+	return v
+}
+func (n *Node) Lookup(name string) lcr.Node {
+	c := n.n.Lookup(name)
+	if c==nil { return nil }
+	return &Node{n.ix,c,join(n.path,name)}
+}
+func (n *Node) Create(name string) lcr.Node {
+	c := n.n.Create(name)
+	if c==nil { return nil }
+	return &Node{n.ix,c,join(n.path,name)}
+}
+func (n *Node) Children() []string {
+	l,ok := n.n.(lcr.Lister)
+	if !ok { return nil }
+	return l.Children()
+}
+func (n *Node) PropertyNames() []string {
+	l,ok := n.n.(lcr.Lister)
+	if !ok { return nil }
+	return l.PropertyNames()
+}
+
+func (n *Node) Query(preds []lcr.Predicate, cursor string, limit int) (lcr.Page,error) {
+	after := ""
+	if cursor!="" { after = join(n.path,cursor) }
+	list,e := n.ix.match(preds,n.path,after)
+	if e!=nil { return lcr.Page{},e }
+	var page lcr.Page
+	skip := len(join(n.path,""))
+	for _,path := range list {
+		if limit>0 && len(page.Matches)==limit {
+			page.Next = page.Matches[limit-1].Path
+			break
+		}
+		m := n.ix.resolve(path)
+		if m==nil {
+			n.ix.forget(path)
+			continue
+		}
+		page.Matches = append(page.Matches,lcr.Match{path[skip:],m})
+	}
+	return page,nil
+}
@@ -0,0 +1,320 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package lcrindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	
+	"github.com/maxymania/anyfs/lcr"
+)
+
+/*
+LogProperty is the BLOB property of the root node, that holds the index. It
+starts with a header (magic, clean flag, indexed names) followed by records,
+of which the last one for a path (and property) wins: the keys of a property,
+the stamp of a node (see lcr.Stamper) or the removal of a node. Every update
+through the index appends records; the log is rewritten once it holds more
+than twice the records needed.
+
+The clean flag is cleared, while an Index is open, and set by Close. If the
+log is missing, not clean, unreadable or made for other names, or if a node
+does not implement lcr.Stamper, New falls back to scanning the tree.
+Otherwise, New walks the tree and compares the stamps of the nodes with the
+log: nodes, whose properties have been changed bypassing the index, are read
+again, removed ones are dropped.
+*/
+const LogProperty = "lcrindex.log"
+
+const logMagic = "lcrindex\x02"
+
+var eLog = errors.New("Bad index log")
+
+type syncer interface{
+	Sync() error
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:],uint64(len(s)))])
+	buf.WriteString(s)
+}
+func putUvarint(buf *bytes.Buffer, u uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:],u)])
+}
+func putVarint(buf *bytes.Buffer, i int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:],i)])
+}
+func getString(r *bytes.Reader) (string,error) {
+	n,e := binary.ReadUvarint(r)
+	if e!=nil { return "",e }
+	if n>uint64(r.Len()) { return "",eLog }
+	b := make([]byte,n)
+	_,e = io.ReadFull(r,b)
+	return string(b),e
+}
+
+/* The kinds of records. */
+const (
+	recDrop = iota
+	recProps
+	recStamp
+)
+
+func putRecord(buf *bytes.Buffer, path, name string, keys []key) {
+	buf.WriteByte(recProps)
+	putString(buf,path)
+	putString(buf,name)
+	putUvarint(buf,uint64(len(keys)))
+	for _,k := range keys {
+		buf.WriteByte(byte(k.t))
+		putVarint(buf,k.i)
+		putVarint(buf,k.n)
+		putString(buf,k.s)
+	}
+}
+func putDrop(buf *bytes.Buffer, path string) {
+	buf.WriteByte(recDrop)
+	putString(buf,path)
+}
+func putStamp(buf *bytes.Buffer, path, stamp string) {
+	buf.WriteByte(recStamp)
+	putString(buf,path)
+	putString(buf,stamp)
+}
+/* Reads a record. For recStamp, name holds the stamp. */
+func getRecord(r *bytes.Reader) (kind byte, path, name string, keys []key, e error) {
+	kind,e = r.ReadByte()
+	if e!=nil { return }
+	path,e = getString(r)
+	if e!=nil || kind==recDrop { return }
+	name,e = getString(r)
+	if e!=nil || kind==recStamp { return }
+	if kind!=recProps { e = eLog; return }
+	n,e := binary.ReadUvarint(r)
+	if e!=nil { return }
+	if n>uint64(r.Len()) { e = eLog; return }
+	keys = make([]key,n)
+	for i := range keys {
+		var t byte
+		t,e = r.ReadByte()
+		if e!=nil { return }
+		keys[i].t = lcr.TypeID(t)
+		keys[i].i,e = binary.ReadVarint(r)
+		if e!=nil { return }
+		keys[i].n,e = binary.ReadVarint(r)
+		if e!=nil { return }
+		keys[i].s,e = getString(r)
+		if e!=nil { return }
+	}
+	return
+}
+
+func (ix *Index) header(clean bool) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	buf.WriteString(logMagic)
+	if clean { buf.WriteByte(1) } else { buf.WriteByte(0) }
+	names := make([]string,0,len(ix.names))
+	for name := range ix.names { names = append(names,name) }
+	sort.Strings(names)
+	putUvarint(buf,uint64(len(names)))
+	for _,name := range names { putString(buf,name) }
+	return buf
+}
+
+/*
+Loads the index from a clean log and brings it up to date with the tree. On
+success, the log is kept open and marked as not clean.
+*/
+func (ix *Index) load() bool {
+	v := ix.root.GetProperty(LogProperty)
+	if v==nil || v.GetTypeID(0)!=lcr.BLOB { return false }
+	b := v.GetBlob(0)
+	if b==nil { return false }
+	data := make([]byte,b.Length())
+	_,e := b.ReadAt(data,0)
+	hdr := ix.header(true).Bytes()
+	if (e!=nil && e!=io.EOF) || !bytes.HasPrefix(data,hdr) {
+		b.Close()
+		return false
+	}
+	r := bytes.NewReader(data[len(hdr):])
+	for r.Len()>0 {
+		kind,path,name,keys,e := getRecord(r)
+		if e!=nil {
+			b.Close()
+			return false
+		}
+		ix.records++
+		switch kind {
+		case recDrop: ix.drop(path)
+		case recStamp: ix.stamps[path] = name
+		default: ix.set(path,name,keys)
+		}
+	}
+	seen := make(map[string]bool)
+	changed,e := ix.verify(ix.root,"",seen)
+	if e!=nil {
+		b.Close()
+		return false
+	}
+	for path := range ix.stamps {
+		if !seen[path] { ix.drop(path); changed = true }
+	}
+	for path := range ix.fwd {
+		if !seen[path] { ix.drop(path); changed = true }
+	}
+	ix.log,ix.size = b,int64(len(data))
+	ix.limit = 2*ix.live()+1024
+	if changed {
+		e = ix.rewrite(false)
+	} else {
+		_,e = b.WriteAt([]byte{0},int64(len(logMagic)))
+		if e==nil { e = syncBlob(b) }
+	}
+	if e!=nil {
+		ix.abandon()
+		return false
+	}
+	return true
+}
+
+/*
+Walks the tree below n and reads the properties of the nodes again, whose
+stamp differs from the log. seen collects the paths of the nodes.
+*/
+func (ix *Index) verify(n lcr.Node, path string, seen map[string]bool) (changed bool, e error) {
+	l,ok := n.(lcr.Lister)
+	if !ok { return false,ENotLister }
+	st,ok := n.(lcr.Stamper)
+	if !ok { return false,ENotStamper }
+	seen[path] = true
+	s,ok := st.PropertyStamp()
+	if old,had := ix.stamps[path]; !ok || !had || old!=s {
+		ix.drop(path)
+		ix.scanNode(n,l,path)
+		changed = true
+	}
+	for _,name := range l.Children() {
+		c := n.Lookup(name)
+		if c==nil { continue }
+		ch,e := ix.verify(c,join(path,name),seen)
+		if e!=nil { return false,e }
+		changed = changed || ch
+	}
+	return
+}
+
+func syncBlob(b lcr.Blob) error {
+	if s,ok := b.(syncer); ok { return s.Sync() }
+	return nil
+}
+
+func (ix *Index) live() (n int) {
+	for _,props := range ix.fwd { n += len(props) }
+	return n+len(ix.stamps)
+}
+
+/*
+Writes the whole index to the log. The clean flag is written last, so a log,
+that has been cut short, is never taken as clean. The caller must hold the
+write lock or own the index exclusively.
+*/
+func (ix *Index) rewrite(clean bool) error {
+	if ix.log==nil {
+		v := ix.root.PutProperties(LogProperty,true,[]byte(nil))
+		if v==nil { return eLog }
+		ix.log = v.GetBlob(0)
+		if ix.log==nil { return eLog }
+		/* Creating the property has changed the stamp of the root. */
+		ix.stamp("",ix.root)
+	}
+	buf := ix.header(false)
+	paths := make([]string,0,len(ix.stamps))
+	for path := range ix.stamps { paths = append(paths,path) }
+	sort.Strings(paths)
+	for _,path := range paths { putStamp(buf,path,ix.stamps[path]) }
+	paths = paths[:0]
+	for path := range ix.fwd { paths = append(paths,path) }
+	sort.Strings(paths)
+	for _,path := range paths {
+		for name,keys := range ix.fwd[path] { putRecord(buf,path,name,keys) }
+	}
+	ix.records = ix.live()
+	ix.limit = 2*ix.records+1024
+	_,e := ix.log.WriteAt(buf.Bytes(),0)
+	if e==nil { e = ix.log.Truncate(int64(buf.Len())) }
+	if e!=nil { return e }
+	ix.size = int64(buf.Len())
+	if !clean { return syncBlob(ix.log) }
+	e = syncBlob(ix.log)
+	if e==nil { _,e = ix.log.WriteAt([]byte{1},int64(len(logMagic))) }
+	if e==nil { e = syncBlob(ix.log) }
+	return e
+}
+
+/*
+Appends a record to the log. On failure, the log is given up; as it is not
+clean, the next New scans the tree. The caller must hold the write lock.
+*/
+func (ix *Index) append(rec func(buf *bytes.Buffer)) {
+	if ix.log==nil { return }
+	ix.records++
+	if ix.records>ix.limit {
+		if ix.rewrite(false)!=nil { ix.abandon() }
+		return
+	}
+	buf := new(bytes.Buffer)
+	rec(buf)
+	_,e := ix.log.WriteAt(buf.Bytes(),ix.size)
+	if e!=nil {
+		ix.abandon()
+		return
+	}
+	ix.size += int64(buf.Len())
+}
+func (ix *Index) abandon() {
+	ix.log.Close()
+	ix.log = nil
+}
+
+/*
+Close writes the index to the log and marks it as clean, so the next New loads
+it instead of scanning the tree. The nodes of the index must not be updated
+afterwards.
+*/
+func (n *Node) Close() error {
+	ix := n.ix
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	e := ix.rewrite(true)
+	if ix.log!=nil { ix.abandon() }
+	return e
+}
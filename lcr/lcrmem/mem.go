@@ -0,0 +1,261 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+/*
+An in-memory implementation of package lcr. It is safe for concurrent use and
+serves as the reference, other implementations are compared against (see
+package lcrtest).
+*/
+package lcrmem
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	
+	"github.com/maxymania/anyfs/lcr"
+)
+
+/* A value; v is a *Buffer, string, int64 or time.Time. */
+type value struct{
+	t lcr.TypeID
+	v interface{}
+}
+
+// A Node implements lcr.Node.
+type Node struct{
+	lock     sync.RWMutex
+	props    map[string][]value
+	children map[string]*Node
+	stamp    uint64
+}
+
+/* The last stamp handed out; stamps are unique across all nodes. */
+var lastStamp uint64
+
+// NewNode returns an empty root node.
+func NewNode() *Node {
+	return &Node{props:make(map[string][]value),children:make(map[string]*Node)}
+}
+
+func (n *Node) GetProperty(name string) lcr.Values {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	vals,ok := n.props[name]
+	if !ok { return nil }
+	return Values(vals)
+}
+
+func (n *Node) PutProperties(name string, overwrite bool, i ...interface{}) lcr.Values {
+	if name=="" { return nil }
+	nv := make([]value,len(i))
+	for j,v := range i {
+		c,t,ok := lcr.Canonical(v)
+		if !ok { return nil }
+		if t==lcr.BLOB { c = newBuffer(c.([]byte)) }
+		nv[j] = value{t,c}
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	vals := n.props[name]
+	if overwrite {
+		vals = nv
+	} else {
+		/* Never append in place; earlier Values share the array. */
+		vals = append(vals[:len(vals):len(vals)],nv...)
+	}
+	n.stamp = atomic.AddUint64(&lastStamp,1)
+	if len(vals)==0 {
+		delete(n.props,name)
+		return Values(nil)
+	}
+	n.props[name] = vals
+	return Values(vals)
+}
+
+func (n *Node) Lookup(name string) lcr.Node {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	c,ok := n.children[name]
+	if !ok { return nil }
+	return c
+}
+
+func (n *Node) Create(name string) lcr.Node {
+	if name=="" { return nil }
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	c,ok := n.children[name]
+	if !ok {
+		c = NewNode()
+		n.children[name] = c
+	}
+	return c
+}
+
+// Children returns the names of the children, sorted. It implements lcr.Lister.
+func (n *Node) Children() []string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	names := make([]string,0,len(n.children))
+	for name := range n.children { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+// PropertyNames returns the names of the properties, sorted.
+func (n *Node) PropertyNames() []string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	names := make([]string,0,len(n.props))
+	for name := range n.props { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+
+// PropertyStamp implements lcr.Stamper.
+func (n *Node) PropertyStamp() (string,bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return strconv.FormatUint(n.stamp,16),true
+}
+
+// Values implements lcr.Values. It is a snapshot, that is not changed by PutProperties.
+type Values []value
+
+func (v Values) get(i int, t lcr.TypeID) interface{} {
+	if i<0 || i>=len(v) || v[i].t!=t { return nil }
+	return v[i].v
+}
+func (v Values) GetBlob(i int) lcr.Blob {
+	b,ok := v.get(i,lcr.BLOB).(*Buffer)
+	if !ok { return nil }
+	return &Blob{buf:b}
+}
+func (v Values) GetString(i int) string {
+	s,_ := v.get(i,lcr.STRING).(string)
+	return s
+}
+func (v Values) GetInt(i int) int64 {
+	n,_ := v.get(i,lcr.INTEGER).(int64)
+	return n
+}
+func (v Values) GetDate(i int) time.Time {
+	t,_ := v.get(i,lcr.DATETIME).(time.Time)
+	return t
+}
+func (v Values) GetTypeID(i int) lcr.TypeID {
+	if i<0 || i>=len(v) { return lcr.INVALID }
+	return v[i].t
+}
+func (v Values) Length() int { return len(v) }
+
+// A Buffer holds the content of a BLOB value. It is shared by all Blobs of the value.
+type Buffer struct{
+	lock sync.RWMutex
+	data []byte
+}
+func newBuffer(p []byte) *Buffer {
+	return &Buffer{data:append([]byte(nil),p...)}
+}
+// Bytes returns a copy of the content.
+func (b *Buffer) Bytes() []byte {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]byte(nil),b.data...)
+}
+func (b *Buffer) resize(size int64) {
+	if size<=int64(len(b.data)) {
+		b.data = b.data[:size]
+		return
+	}
+	if size<=int64(cap(b.data)) {
+		old := len(b.data)
+		b.data = b.data[:size]
+		for i := old; i<len(b.data); i++ { b.data[i] = 0 }
+		return
+	}
+	nd := make([]byte,size,size+size/4)
+	copy(nd,b.data)
+	b.data = nd
+}
+
+// A Blob is an open BLOB value; it implements lcr.Blob.
+type Blob struct{
+	buf    *Buffer
+	lock   sync.Mutex
+	closed bool
+}
+func (b *Blob) check() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed { return os.ErrClosed }
+	return nil
+}
+func (b *Blob) ReadAt(p []byte, off int64) (int,error) {
+	if e := b.check(); e!=nil { return 0,e }
+	if off<0 { return 0,os.ErrInvalid }
+	b.buf.lock.RLock()
+	defer b.buf.lock.RUnlock()
+	if off>=int64(len(b.buf.data)) {
+		if len(p)==0 { return 0,nil }
+		return 0,io.EOF
+	}
+	n := copy(p,b.buf.data[off:])
+	if n<len(p) { return n,io.EOF }
+	return n,nil
+}
+func (b *Blob) WriteAt(p []byte, off int64) (int,error) {
+	if e := b.check(); e!=nil { return 0,e }
+	if off<0 { return 0,os.ErrInvalid }
+	if len(p)==0 { return 0,nil }
+	b.buf.lock.Lock()
+	defer b.buf.lock.Unlock()
+	if end := off+int64(len(p)); end>int64(len(b.buf.data)) { b.buf.resize(end) }
+	return copy(b.buf.data[off:],p),nil
+}
+func (b *Blob) Truncate(i int64) error {
+	if e := b.check(); e!=nil { return e }
+	if i<0 { return os.ErrInvalid }
+	b.buf.lock.Lock()
+	defer b.buf.lock.Unlock()
+	b.buf.resize(i)
+	return nil
+}
+func (b *Blob) Length() int64 {
+	b.buf.lock.RLock()
+	defer b.buf.lock.RUnlock()
+	return int64(len(b.buf.data))
+}
+// UnderlyingObject returns the *Buffer of the blob.
+func (b *Blob) UnderlyingObject() interface{} { return b.buf }
+func (b *Blob) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed { return os.ErrClosed }
+	b.closed = true
+	return nil
+}
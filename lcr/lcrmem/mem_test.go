@@ -0,0 +1,99 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package lcrmem
+
+import (
+	"testing"
+	"github.com/maxymania/anyfs/lcr"
+	"github.com/maxymania/anyfs/lcr/lcrindex"
+	"github.com/maxymania/anyfs/lcr/lcrtest"
+)
+
+func TestNode(t *testing.T) {
+	if e := lcrtest.TestNode(NewNode()); e!=nil { t.Fatal(e) }
+}
+
+func TestQuery(t *testing.T) {
+	root,e := lcrindex.New(NewNode())
+	if e!=nil { t.Fatal(e) }
+	if e := lcrtest.TestQuery(root); e!=nil { t.Fatal(e) }
+	if e := lcrtest.TestNode(root); e!=nil { t.Fatal(e) }
+}
+
+/* Counts the nodes, whose properties are read by an index. */
+type countNode struct{
+	*Node
+	reads *int
+}
+func (c countNode) wrap(n lcr.Node) lcr.Node {
+	if n==nil { return nil }
+	return countNode{n.(*Node),c.reads}
+}
+func (c countNode) Lookup(name string) lcr.Node { return c.wrap(c.Node.Lookup(name)) }
+func (c countNode) Create(name string) lcr.Node { return c.wrap(c.Node.Create(name)) }
+func (c countNode) PropertyNames() []string {
+	*c.reads++
+	return c.Node.PropertyNames()
+}
+
+func TestIndexLog(t *testing.T) {
+	mem := NewNode()
+	reads := 0
+	root := countNode{mem,&reads}
+	count := func(ix *lcrindex.Node, v int) int {
+		p,e := ix.Query([]lcr.Predicate{lcr.Equal("n",v)},"",0)
+		if e!=nil { t.Fatal(e) }
+		return len(p.Matches)
+	}
+	mem.Create("a").PutProperties("n",true,1)
+	mem.Create("b").Create("c")
+	ix,e := lcrindex.New(root,"n")
+	if e!=nil { t.Fatal(e) }
+	if reads!=4 { t.Fatal("tree not scanned: ",reads) }
+	ix.Lookup("b").Lookup("c").PutProperties("n",true,2)
+	if e := ix.Close(); e!=nil { t.Fatal(e) }
+	
+	/* A clean log is loaded; only the node changed bypassing the index is read. */
+	mem.Lookup("a").PutProperties("n",true,5)
+	reads = 0
+	ix,e = lcrindex.New(root,"n")
+	if e!=nil { t.Fatal(e) }
+	if reads!=1 { t.Fatal("log not loaded: ",reads) }
+	if count(ix,1)!=0 || count(ix,2)!=1 || count(ix,5)!=1 { t.Fatal("change not seen") }
+	ix.Create("d").PutProperties("n",true,3)
+	
+	/* The index has not been closed, so the tree is scanned. */
+	reads = 0
+	ix,e = lcrindex.New(root,"n")
+	if e!=nil { t.Fatal(e) }
+	if reads!=5 { t.Fatal("tree not scanned: ",reads) }
+	if count(ix,5)!=1 || count(ix,2)!=1 || count(ix,3)!=1 { t.Fatal("wrong index") }
+	if e := ix.Close(); e!=nil { t.Fatal(e) }
+	
+	/* A log for other names is not used. */
+	ix,e = lcrindex.New(mem)
+	if e!=nil { t.Fatal(e) }
+	if count(ix,5)!=1 || count(ix,2)!=1 { t.Fatal("names") }
+}
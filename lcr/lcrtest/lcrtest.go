@@ -0,0 +1,336 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+/*
+A conformance suite for implementations of package lcr. Every implementation
+should pass it, just like the reference implementation in package lcrmem:
+
+	func TestNode(t *testing.T) {
+		if e := lcrtest.TestNode(root); e!=nil { t.Fatal(e) }
+	}
+
+Implementations of lcr.Querier (like the nodes of package lcrindex) should
+pass TestQuery as well.
+*/
+package lcrtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/maxymania/anyfs/lcr"
+)
+
+/* The names of the children of the root node, the suites work in. */
+const (
+	Child      = "lcrtest"
+	QueryChild = "lcrquery"
+)
+
+// Errors lists the failures of the suite.
+type Errors []string
+func (e Errors) Error() string {
+	return fmt.Sprintf("%d lcr conformance failures:\n\t%s",len(e),strings.Join(e,"\n\t"))
+}
+
+type tester struct{
+	lock sync.Mutex
+	errs Errors
+}
+func (t *tester) errorf(format string, args ...interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.errs = append(t.errs,fmt.Sprintf(format,args...))
+}
+
+/*
+TestNode checks the implementation behind root. It works below the child
+Child of root, which must not exist yet. It returns nil or Errors.
+*/
+func TestNode(root lcr.Node) error {
+	t := new(tester)
+	if root.Lookup(Child)!=nil { return fmt.Errorf("lcrtest: %q already exists",Child) }
+	n := root.Create(Child)
+	if n==nil { return fmt.Errorf("lcrtest: cannot create %q",Child) }
+	t.testTree(root,n)
+	t.testScalars(n.Create("scalars"))
+	t.testUpdate(n.Create("update"))
+	t.testBlob(n.Create("blob"))
+	t.testConcurrent(n.Create("concurrent"))
+	if len(t.errs)>0 { return t.errs }
+	return nil
+}
+
+/*
+TestQuery checks the queries of root, which must implement lcr.Querier. It
+works below the child QueryChild of root, which must not exist yet.
+*/
+func TestQuery(root lcr.Node) error {
+	t := new(tester)
+	if root.Lookup(QueryChild)!=nil { return fmt.Errorf("lcrtest: %q already exists",QueryChild) }
+	n := root.Create(QueryChild)
+	if n==nil { return fmt.Errorf("lcrtest: cannot create %q",QueryChild) }
+	q,ok := n.(lcr.Querier)
+	if !ok { return fmt.Errorf("lcrtest: the nodes do not implement lcr.Querier") }
+	t.testQuery(n,q)
+	if len(t.errs)>0 { return t.errs }
+	return nil
+}
+
+func (t *tester) testTree(root, n lcr.Node) {
+	if n.Lookup("missing")!=nil { t.errorf("Lookup of a missing child returned a node") }
+	if n.GetProperty("missing")!=nil { t.errorf("GetProperty of a missing property returned values") }
+	c := n.Create("child")
+	if c==nil { t.errorf("Create failed"); return }
+	c.PutProperties("id",true,"child")
+	for _,m := range []lcr.Node{n.Create("child"),n.Lookup("child"),root.Lookup(Child).Lookup("child")} {
+		if m==nil { t.errorf("existing child not found"); continue }
+		v := m.GetProperty("id")
+		if v==nil || v.GetString(0)!="child" { t.errorf("Create or Lookup returned a different node") }
+	}
+	if c.Create("grandchild")==nil || n.Lookup("child").Lookup("grandchild")==nil { t.errorf("grandchild not found") }
+}
+
+func (t *tester) testScalars(n lcr.Node) {
+	tm := time.Date(2017,time.March,4,5,6,7,890123456,time.UTC)
+	in := []interface{}{"text",int64(-1)<<40,tm,int8(-8),uint16(16),int(42),""}
+	want := []lcr.TypeID{lcr.STRING,lcr.INTEGER,lcr.DATETIME,lcr.INTEGER,lcr.INTEGER,lcr.INTEGER,lcr.STRING}
+	v := n.PutProperties("p",false,in...)
+	if v==nil { t.errorf("PutProperties of scalars failed"); return }
+	for _,v := range []lcr.Values{v,n.GetProperty("p")} {
+		if v==nil || v.Length()!=len(in) { t.errorf("scalars: wrong number of values"); return }
+		for i,w := range want {
+			if g := v.GetTypeID(i); g!=w { t.errorf("scalars: value %d has type %v, want %v",i,g,w) }
+		}
+		if v.GetTypeID(-1)!=lcr.INVALID || v.GetTypeID(len(in))!=lcr.INVALID { t.errorf("GetTypeID out of range") }
+		if v.GetString(0)!="text" { t.errorf("GetString: %q",v.GetString(0)) }
+		if v.GetInt(1)!=int64(-1)<<40 { t.errorf("GetInt: %d",v.GetInt(1)) }
+		if !v.GetDate(2).Equal(tm) { t.errorf("GetDate: %v, want %v",v.GetDate(2),tm) }
+		if v.GetInt(3)!=-8 || v.GetInt(4)!=16 || v.GetInt(5)!=42 { t.errorf("integer conversion") }
+		/* Wrong types yield zero values. */
+		if v.GetString(1)!="" || v.GetInt(0)!=0 || !v.GetDate(0).IsZero() || v.GetBlob(0)!=nil {
+			t.errorf("getters of the wrong type returned values")
+		}
+	}
+	if n.PutProperties("p",false,3.5)!=nil { t.errorf("PutProperties accepted a float64") }
+	if n.PutProperties("p",true,"ok",struct{}{})!=nil { t.errorf("PutProperties accepted a struct") }
+	if v := n.GetProperty("p"); v==nil || v.Length()!=len(in) { t.errorf("a failed PutProperties changed the property") }
+}
+
+func (t *tester) testUpdate(n lcr.Node) {
+	n.PutProperties("p",false,"a")
+	old := n.PutProperties("p",false,"b","c")
+	if old==nil || old.Length()!=3 || old.GetString(2)!="c" { t.errorf("append: wrong result"); return }
+	v := n.PutProperties("p",true,int64(1))
+	if v==nil || v.Length()!=1 || v.GetTypeID(0)!=lcr.INTEGER { t.errorf("overwrite: wrong result") }
+	if old.Length()!=3 || old.GetString(0)!="a" { t.errorf("overwrite changed earlier values") }
+	n.PutProperties("p",false,int64(2))
+	if old.Length()!=3 { t.errorf("append changed earlier values") }
+	if v := n.GetProperty("p"); v==nil || v.Length()!=2 || v.GetInt(1)!=2 { t.errorf("append after overwrite") }
+	n.PutProperties("q",true,"other")
+	v = n.PutProperties("p",true)
+	if v==nil || v.Length()!=0 { t.errorf("overwrite without values failed") }
+	if n.GetProperty("p")!=nil { t.errorf("overwrite without values did not remove the property") }
+	if v := n.GetProperty("q"); v==nil || v.GetString(0)!="other" { t.errorf("removing a property changed another one") }
+}
+
+func (t *tester) testBlob(n lcr.Node) {
+	v := n.PutProperties("b",false,[]byte("content"),nil,"s")
+	if v==nil || v.Length()!=3 { t.errorf("PutProperties of blobs failed"); return }
+	if v.GetTypeID(0)!=lcr.BLOB || v.GetTypeID(1)!=lcr.BLOB { t.errorf("blobs have the wrong type") }
+	if v.GetBlob(2)!=nil { t.errorf("GetBlob of a string returned a blob") }
+	b := n.GetProperty("b").GetBlob(0)
+	if b==nil { t.errorf("GetBlob failed"); return }
+	if b.UnderlyingObject()==nil { t.errorf("UnderlyingObject is nil") }
+	t.expect("initial content",b,[]byte("content"))
+	if b.Length()!=7 { t.errorf("Length: %d",b.Length()) }
+	if e := b.Close(); e!=nil { t.errorf("Close: %v",e) }
+	if e := b.Close(); e==nil { t.errorf("second Close succeeded") }
+	if _,e := b.ReadAt(make([]byte,1),0); e==nil { t.errorf("ReadAt after Close succeeded") }
+	
+	eb := v.GetBlob(1)
+	if eb==nil { t.errorf("GetBlob of an empty blob failed"); return }
+	if eb.Length()!=0 { t.errorf("empty blob has length %d",eb.Length()) }
+	if k,err := eb.ReadAt(make([]byte,4),0); k!=0 || err!=io.EOF { t.errorf("ReadAt at the end: %d %v",k,err) }
+	if k,err := eb.WriteAt([]byte("tail"),100000); k!=4 || err!=nil { t.errorf("WriteAt: %d %v",k,err) }
+	want := make([]byte,100004)
+	copy(want[100000:],"tail")
+	t.expect("sparse write",eb,want)
+	eb.WriteAt([]byte("abcdef"),0)
+	if err := eb.Truncate(2); err!=nil || eb.Length()!=2 { t.errorf("Truncate to 2: %v %d",err,eb.Length()) }
+	if err := eb.Truncate(6); err!=nil || eb.Length()!=6 { t.errorf("Truncate to 6: %v %d",err,eb.Length()) }
+	t.expect("truncate",eb,[]byte("ab\x00\x00\x00\x00"))
+	eb.Truncate(2)
+	eb.WriteAt([]byte("f"),5)
+	t.expect("write after truncate",eb,[]byte("ab\x00\x00\x00f"))
+	k,err := eb.ReadAt(make([]byte,10),2)
+	if k!=4 || err!=io.EOF { t.errorf("short ReadAt: %d %v",k,err) }
+	eb.WriteAt([]byte("shared"),0)
+	eb.Close()
+	
+	/* Blobs are shared by all handles and stay readable after an overwrite. */
+	b1 := n.GetProperty("b").GetBlob(1)
+	if b1==nil { t.errorf("GetBlob after Close failed"); return }
+	defer b1.Close()
+	t.expect("content after Close",b1,[]byte("shared"))
+	b2 := n.GetProperty("b").GetBlob(1)
+	if b2==nil { t.errorf("second GetBlob failed"); return }
+	b2.WriteAt([]byte("S"),0)
+	b2.Close()
+	t.expect("write through another handle",b1,[]byte("Shared"))
+	n.PutProperties("b",true,"gone")
+	t.expect("open blob after overwrite",b1,[]byte("Shared"))
+}
+func (t *tester) expect(what string, b lcr.Blob, want []byte) {
+	got := make([]byte,len(want)+1)
+	k,_ := b.ReadAt(got,0)
+	if !bytes.Equal(got[:k],want) { t.errorf("%s: blob has %d bytes %q, want %d bytes",what,k,clip(got[:k]),len(want)) }
+}
+func clip(p []byte) []byte {
+	if len(p)>16 { return p[:16] }
+	return p
+}
+
+func (t *tester) testConcurrent(n lcr.Node) {
+	const workers,rounds = 8,16
+	var wg sync.WaitGroup
+	for w := 0; w<workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r<rounds; r++ {
+				if n.PutProperties("p",false,int64(w*rounds+r))==nil { t.errorf("concurrent PutProperties failed") }
+				c := n.Create(fmt.Sprint("c",r))
+				if c==nil { t.errorf("concurrent Create failed"); continue }
+				c.PutProperties("w",false,int64(w))
+				if v := n.GetProperty("p"); v==nil || v.Length()==0 { t.errorf("concurrent GetProperty failed") }
+			}
+		}(w)
+	}
+	wg.Wait()
+	v := n.GetProperty("p")
+	if v==nil || v.Length()!=workers*rounds { t.errorf("concurrent appends were lost"); return }
+	seen := make(map[int64]bool)
+	for i := 0; i<v.Length(); i++ { seen[v.GetInt(i)] = true }
+	if len(seen)!=workers*rounds { t.errorf("concurrent appends were duplicated") }
+	for r := 0; r<rounds; r++ {
+		c := n.Lookup(fmt.Sprint("c",r))
+		if c==nil { t.errorf("concurrently created node missing"); continue }
+		if v := c.GetProperty("w"); v==nil || v.Length()!=workers { t.errorf("concurrent Create returned different nodes") }
+	}
+}
+
+func (t *tester) testQuery(n lcr.Node, q lcr.Querier) {
+	base := time.Date(2017,time.January,1,0,0,0,0,time.UTC)
+	items := n.Create("items")
+	if items==nil { t.errorf("Create failed"); return }
+	for i := 0; i<20; i++ {
+		c := items.Create(fmt.Sprintf("i%02d",i))
+		if c==nil { t.errorf("Create failed"); return }
+		tag := "even"
+		if i%2==1 { tag = "odd" }
+		c.PutProperties("n",true,i)
+		c.PutProperties("name",true,fmt.Sprintf("item%02d",i))
+		c.PutProperties("t",true,base.Add(time.Duration(i)*time.Hour))
+		c.PutProperties("tag",true,tag,"all")
+	}
+	items.Lookup("i03").Create("sub").PutProperties("n",true,100)
+	
+	expect := func(what string, want []string, preds ...lcr.Predicate) {
+		page,e := q.Query(preds,"",0)
+		if e!=nil { t.errorf("%s: %v",what,e); return }
+		var got []string
+		for _,m := range page.Matches {
+			got = append(got,m.Path)
+			if m.Node==nil { t.errorf("%s: match %s has no node",what,m.Path) }
+		}
+		if strings.Join(got,",")!=strings.Join(want,",") { t.errorf("%s: got %v, want %v",what,got,want) }
+		if page.Next!="" { t.errorf("%s: unlimited query returned a cursor",what) }
+	}
+	paths := func(from, to int) (l []string) {
+		for i := from; i<to; i++ { l = append(l,fmt.Sprintf("items/i%02d",i)) }
+		return
+	}
+	expect("equal",paths(7,8),lcr.Equal("n",int64(7)))
+	expect("equal string",paths(7,8),lcr.Equal("name","item07"))
+	expect("equal date",paths(7,8),lcr.Equal("t",base.Add(7*time.Hour)))
+	expect("multi-valued",paths(0,20),lcr.Equal("tag","all"))
+	expect("range",paths(5,10),lcr.Range("n",5,10))
+	expect("open range",paths(0,2),lcr.Range("n",nil,2))
+	expect("open range",[]string{"items/i03/sub"},lcr.Range("n",20,nil))
+	expect("date range",paths(3,5),lcr.Range("t",base.Add(3*time.Hour),base.Add(5*time.Hour)))
+	expect("prefix",paths(10,20),lcr.Prefix("name","item1"))
+	expect("and",[]string{"items/i10","items/i12","items/i14","items/i16","items/i18"},lcr.Prefix("name","item1"),lcr.Equal("tag","even"))
+	expect("no match",nil,lcr.Equal("n",int64(1000)))
+	expect("type mismatch",nil,lcr.Equal("n","7"))
+	
+	/* Pagination. */
+	var all []string
+	cursor := ""
+	for pages := 0; pages<10; pages++ {
+		page,e := q.Query([]lcr.Predicate{lcr.Range("n",0,nil)},cursor,7)
+		if e!=nil { t.errorf("page: %v",e); break }
+		if len(page.Matches)>7 { t.errorf("page: %d matches, limit 7",len(page.Matches)) }
+		for _,m := range page.Matches { all = append(all,m.Path) }
+		cursor = page.Next
+		if cursor=="" { break }
+	}
+	want := append(append(paths(0,4),"items/i03/sub"),paths(4,20)...)
+	if strings.Join(all,",")!=strings.Join(want,",") { t.errorf("pagination: got %v, want %v",all,want) }
+	
+	/* Queries are relative to the node. */
+	if iq,ok := items.(lcr.Querier); ok {
+		page,e := iq.Query([]lcr.Predicate{lcr.Equal("n",100)},"",0)
+		if e!=nil || len(page.Matches)!=1 || page.Matches[0].Path!="i03/sub" { t.errorf("query of a child: %v %v",page,e) }
+		if e==nil && len(page.Matches)==1 {
+			if v := page.Matches[0].Node.GetProperty("n"); v==nil || v.GetInt(0)!=100 { t.errorf("match has the wrong node") }
+		}
+	} else {
+		t.errorf("child nodes do not implement lcr.Querier")
+	}
+	
+	/* The indexes follow PutProperties. */
+	items.Lookup("i00").PutProperties("n",true,50)
+	items.Lookup("i02").PutProperties("tag",true)
+	items.Create("new").PutProperties("name",false,"item-new")
+	expect("after overwrite",paths(1,3),lcr.Range("n",0,3))
+	expect("after overwrite",paths(0,1),lcr.Equal("n",50))
+	expect("after removal",[]string{"items/i04","items/i06"},lcr.Equal("tag","even"),lcr.Range("n",0,7))
+	expect("new node",[]string{"items/new"},lcr.Prefix("name","item-"))
+	
+	for _,preds := range [][]lcr.Predicate{
+		nil,
+		{lcr.Range("n",nil,nil)},
+		{lcr.Range("n","a","b")},
+		{lcr.Range("n",1,base)},
+		{lcr.Equal("n",[]byte("x"))},
+		{lcr.Equal("n",3.5)},
+		{{Name:"n",Op:lcr.Op(99),Value:1}},
+	} {
+		if _,e := q.Query(preds,"",0); e==nil { t.errorf("invalid query %v accepted",preds) }
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * MIT License
+ * 
+ * Copyright (c) 2017 Simon Schmidt
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package lcr
+
+import "errors"
+
+var EQuery = errors.New("Invalid query")
+
+/* Optionally implemented by nodes; required to build indexes (see package lcrindex). */
+type Lister interface{
+	/* Returns the names of the children. */
+	Children() []string
+	/* Returns the names of the properties. */
+	PropertyNames() []string
+}
+
+/*
+ Optionally implemented by nodes. The stamp changes, whenever the properties of
+ the node change, however they are changed; ok is false, if it is not known.
+ Indexes use it to find changes, that bypassed them.
+ */
+type Stamper interface{
+	PropertyStamp() (stamp string, ok bool)
+}
+
+type Op int
+const (
+	EQUAL = Op(iota)
+	RANGE
+	PREFIX
+)
+
+/*
+ A condition on a property. It holds, if one of the values of the property
+ matches: EQUAL compares with Value (STRING, INTEGER or DATETIME); RANGE
+ matches INTEGER or DATETIME values from Value (inclusive) to Limit
+ (exclusive), a nil bound is open; PREFIX matches STRING values starting with
+ Value. The values are given as for PutProperties.
+ */
+type Predicate struct{
+	Name  string
+	Op    Op
+	Value interface{}
+	Limit interface{}
+}
+func Equal(name string, v interface{}) Predicate { return Predicate{name,EQUAL,v,nil} }
+func Range(name string, from, to interface{}) Predicate { return Predicate{name,RANGE,from,to} }
+func Prefix(name, prefix string) Predicate { return Predicate{name,PREFIX,prefix,nil} }
+
+type Match struct{
+	Path string /* Relative to the queried node, slash-separated. */
+	Node Node
+}
+
+type Page struct{
+	Matches []Match
+	Next    string /* The cursor of the next page; "" after the last one. */
+}
+
+/* Implemented by nodes, that can be queried (see package lcrindex). */
+type Querier interface{
+	/*
+	 Returns the descendants of the node, that satisfy all predicates, ordered
+	 by path. A page has at most limit matches (0 means no limit) and starts
+	 after the cursor, which is "" for the first page.
+	 */
+	Query(preds []Predicate, cursor string, limit int) (Page,error)
+}
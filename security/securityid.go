@@ -79,3 +79,14 @@ func (s SID) String() string{
 	return fmt.Sprint("SID:",s.Upper(),"-",s.Lower())
 }
 
+
+// Parses the output of SID.String().
+func ParseSID(s string) (SID,error) {
+	var u,l uint32
+	if _,e := fmt.Sscanf(s,"uid:%d",&l); e==nil { return UidSID(l),nil }
+	if _,e := fmt.Sscanf(s,"gid:%d",&l); e==nil { return GidSID(l),nil }
+	if _,e := fmt.Sscanf(s,"type:%d",&l); e==nil { return TypeSID(l),nil }
+	_,e := fmt.Sscanf(s,"SID:%d-%d",&u,&l)
+	if e!=nil { return 0,e }
+	return SID((uint64(u)<<32)|uint64(l)),nil
+}